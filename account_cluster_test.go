@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"example/flow-key-indexer/model"
+	"example/flow-key-indexer/pkg/pg"
+	"testing"
+)
+
+func TestAccountClusters(t *testing.T) {
+	db := newTestStore(t)
+
+	ctx := context.Background()
+	// e01 - e02 - e03 share keys in a chain, e04 only shares a revoked key
+	keys := []model.PublicKeyAccountIndexer{
+		{Account: "0x0000000000000e01", KeyId: 0, PublicKey: "e1e1e1e1e1e1e1e1e1e1e1e1", Weight: 1000, SigAlgo: 1, HashAlgo: 3},
+		{Account: "0x0000000000000e02", KeyId: 0, PublicKey: "e1e1e1e1e1e1e1e1e1e1e1e1", Weight: 1000, SigAlgo: 1, HashAlgo: 3},
+		{Account: "0x0000000000000e02", KeyId: 1, PublicKey: "e2e2e2e2e2e2e2e2e2e2e2e2", Weight: 1000, SigAlgo: 1, HashAlgo: 3},
+		{Account: "0x0000000000000e03", KeyId: 0, PublicKey: "e2e2e2e2e2e2e2e2e2e2e2e2", Weight: 1000, SigAlgo: 1, HashAlgo: 3},
+		{Account: "0x0000000000000e03", KeyId: 1, PublicKey: "e3e3e3e3e3e3e3e3e3e3e3e3", Weight: 1000, SigAlgo: 1, HashAlgo: 3},
+		{Account: "0x0000000000000e04", KeyId: 0, PublicKey: "e3e3e3e3e3e3e3e3e3e3e3e3", Weight: 1000, SigAlgo: 1, HashAlgo: 3, IsRevoked: true},
+	}
+	if _, err := savePublicKeys(ctx, db, keys); err != nil {
+		t.Fatalf("Failed to save keys: %v", err)
+	}
+
+	cluster, err := db.GetAccountCluster(ctx, "0x0000000000000e01", 3, 100)
+	if err != nil {
+		t.Fatalf("Failed to walk the cluster: %v", err)
+	}
+	if !cluster.Complete || len(cluster.Accounts) != 2 ||
+		cluster.Accounts[0] != (model.ClusterAccount{Address: "0x0000000000000e02", Depth: 1}) ||
+		cluster.Accounts[1] != (model.ClusterAccount{Address: "0x0000000000000e03", Depth: 2}) {
+		t.Errorf("Expected e02 and e03 in a complete cluster, got %+v", cluster)
+	}
+
+	cluster, err = db.GetAccountCluster(ctx, "0x0000000000000e01", 1, 100)
+	if err != nil || cluster.Complete || len(cluster.Accounts) != 1 {
+		t.Errorf("Expected the walk to stop at depth 1, got %+v, %v", cluster, err)
+	}
+	cluster, err = db.GetAccountCluster(ctx, "0x0000000000000e02", 3, 1)
+	if err != nil || cluster.Complete || len(cluster.Accounts) != 1 {
+		t.Errorf("Expected the walk to stop at one account, got %+v, %v", cluster, err)
+	}
+
+	if _, err := db.ComputeAccountClusters(ctx, 3); err != nil {
+		t.Fatalf("Failed to compute clusters: %v", err)
+	}
+	cluster, err = db.GetAccountCluster(ctx, "0x0000000000000e03", 3, 100)
+	if err != nil || cluster.ClusterID != "0x0000000000000e01" || cluster.ClusterSize != 3 {
+		t.Errorf("Expected the precomputed cluster of e01, got %+v, %v", cluster, err)
+	}
+	cluster, err = db.GetAccountCluster(ctx, "0x0000000000000e04", 3, 100)
+	if err != nil || cluster.ClusterID != "" || len(cluster.Accounts) != 0 {
+		t.Errorf("Expected e04 on its own, got %+v, %v", cluster, err)
+	}
+
+	if _, err := db.GetAccountCluster(ctx, "not an address", 3, 100); !errors.Is(err, pg.ErrInvalidAccount) {
+		t.Errorf("Expected an invalid account error, got %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"example/flow-key-indexer/model"
+)
+
+func TestFailedRefreshKeepsAccountHeight(t *testing.T) {
+	db := newTestStore(t)
+
+	ctx := context.Background()
+	address := "0x00000000000f0a1e"
+
+	if err := db.UpsertAccounts(ctx, []model.AccountRecord{{
+		Address:             address,
+		Status:              model.AccountStatusOK,
+		KeyCount:            3,
+		LastRefreshedHeight: 100,
+	}}); err != nil {
+		t.Fatalf("Failed to record account: %v", err)
+	}
+	if err := db.UpsertAccounts(ctx, []model.AccountRecord{{
+		Address:             address,
+		Status:              model.AccountStatusError,
+		LastRefreshedHeight: 200,
+		LastError:           "unavailable",
+	}}); err != nil {
+		t.Fatalf("Failed to record failed account: %v", err)
+	}
+
+	account, err := db.GetAccount(address)
+	if err != nil {
+		t.Fatalf("Failed to get account: %v", err)
+	}
+	if account.Status != model.AccountStatusError || account.LastError != "unavailable" {
+		t.Errorf("Expected the failure to be recorded, got %+v", account)
+	}
+	if account.KeyCount != 3 || account.LastRefreshedHeight != 100 {
+		t.Errorf("Expected the last successful refresh to be kept, got %+v", account)
+	}
+
+	heights, err := db.GetAccountRefreshHeights([]string{address})
+	if err != nil {
+		t.Fatalf("Failed to get refresh heights: %v", err)
+	}
+	if _, ok := heights[address]; ok {
+		t.Errorf("Expected a failed account not to count as refreshed, got %v", heights)
+	}
+
+	if err := db.UpsertAccounts(ctx, []model.AccountRecord{{
+		Address:             address,
+		Status:              model.AccountStatusOK,
+		KeyCount:            4,
+		LastRefreshedHeight: 150,
+	}}); err != nil {
+		t.Fatalf("Failed to record account: %v", err)
+	}
+	if account, err := db.GetAccount(address); err != nil || account.Status != model.AccountStatusOK || account.LastRefreshedHeight != 150 {
+		t.Errorf("Expected a later successful refresh to replace the failure, got %+v, %v", account, err)
+	}
+}
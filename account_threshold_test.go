@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"example/flow-key-indexer/model"
+	"example/flow-key-indexer/pkg/pg"
+	"testing"
+)
+
+func TestGetAccountThresholds(t *testing.T) {
+	db := newTestStore(t)
+
+	ctx := context.Background()
+	signer := "d1d2d3d4d5d6d7d8d9dadbdc"
+	keys := []model.PublicKeyAccountIndexer{
+		// signer alone has the full weight
+		{Account: "0x0000000000000d01", KeyId: 0, PublicKey: signer, Weight: 1000, SigAlgo: 1, HashAlgo: 3},
+		// signer needs the heaviest other key, the revoked one does not count
+		{Account: "0x0000000000000d02", KeyId: 0, PublicKey: signer, Weight: 400, SigAlgo: 1, HashAlgo: 3},
+		{Account: "0x0000000000000d02", KeyId: 1, PublicKey: "e1e2e3e4e5e6e7e8e9eaebec", Weight: 200, SigAlgo: 1, HashAlgo: 3},
+		{Account: "0x0000000000000d02", KeyId: 2, PublicKey: "f1f2f3f4f5f6f7f8f9fafbfc", Weight: 600, SigAlgo: 1, HashAlgo: 3},
+		{Account: "0x0000000000000d02", KeyId: 3, PublicKey: "c1c2c3c4c5c6c7c8c9cacbcc", Weight: 1000, SigAlgo: 1, HashAlgo: 3, IsRevoked: true},
+		// signer is revoked and the remaining keys fall short
+		{Account: "0x0000000000000d03", KeyId: 0, PublicKey: signer, Weight: 1000, SigAlgo: 1, HashAlgo: 3, IsRevoked: true},
+		{Account: "0x0000000000000d03", KeyId: 1, PublicKey: "e1e2e3e4e5e6e7e8e9eaebec", Weight: 500, SigAlgo: 1, HashAlgo: 3},
+	}
+	if _, err := savePublicKeys(ctx, db, keys); err != nil {
+		t.Fatalf("Failed to save keys: %v", err)
+	}
+
+	found, err := db.GetAccountThresholds(ctx, []string{"0x" + signer})
+	if err != nil {
+		t.Fatalf("Failed to get thresholds: %v", err)
+	}
+	if len(found) != 3 {
+		t.Fatalf("Expected 3 accounts, got %+v", found)
+	}
+
+	if a := found[0]; a.Weight != 1000 || !a.MeetsThreshold || !a.Reachable || len(a.NeededKeys) != 0 {
+		t.Errorf("Expected 0x0000000000000d01 to meet the threshold, got %+v", a)
+	}
+	if a := found[1]; a.Weight != 400 || a.MeetsThreshold || !a.Reachable || len(a.NeededKeys) != 1 || a.NeededKeys[0].KeyId != 2 || a.NeededKeys[0].PublicKey != "f1f2f3f4f5f6f7f8f9fafbfc" {
+		t.Errorf("Expected 0x0000000000000d02 to need key 2, got %+v", a)
+	}
+	if a := found[2]; a.Weight != 0 || a.MeetsThreshold || a.Reachable || len(a.NeededKeys) != 1 || len(a.Keys) != 1 || !a.Keys[0].IsRevoked {
+		t.Errorf("Expected 0x0000000000000d03 to be unreachable, got %+v", a)
+	}
+
+	if _, err := db.GetAccountThresholds(ctx, []string{"not hex"}); !errors.Is(err, pg.ErrInvalidPublicKey) {
+		t.Errorf("Expected an invalid key error, got %v", err)
+	}
+	if _, err := db.GetAccountThresholds(ctx, nil); !errors.Is(err, pg.ErrInvalidPublicKey) {
+		t.Errorf("Expected an invalid key error without keys, got %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"example/flow-key-indexer/pkg/pg"
+	"testing"
+	"time"
+)
+
+func TestAddressQueue(t *testing.T) {
+	db := newTestStore(t)
+
+	ctx := context.Background()
+	backfill := []string{"0x0000000000000a01", "0xa02"}
+	events := []string{"0x0000000000000a03", "0x0000000000000a02"}
+
+	if err := db.EnqueueAddresses(ctx, backfill, pg.PriorityBackfill); err != nil {
+		t.Fatalf("Failed to enqueue addresses: %v", err)
+	}
+	// a queued address with key events moves up to the event priority
+	if err := db.EnqueueAddresses(ctx, events, pg.PriorityEvent); err != nil {
+		t.Fatalf("Failed to enqueue addresses: %v", err)
+	}
+
+	claimed, err := db.ClaimAddresses(ctx, pg.PriorityEvent, 10, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to claim addresses: %v", err)
+	}
+	if len(claimed) != 2 {
+		t.Fatalf("Expected 2 event addresses, got %v", claimed)
+	}
+
+	// leased addresses are not handed out twice
+	again, err := db.ClaimAddresses(ctx, pg.PriorityEvent, 10, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to claim addresses: %v", err)
+	}
+	if len(again) != 0 {
+		t.Errorf("Expected leased addresses to be skipped, got %v", again)
+	}
+
+	if err := db.FailAddresses(ctx, claimed[:1], errors.New("node unavailable")); err != nil {
+		t.Fatalf("Failed to record failed addresses: %v", err)
+	}
+	if err := db.RemoveAccountsProcessing(ctx, claimed[1:]); err != nil {
+		t.Fatalf("Failed to remove addresses: %v", err)
+	}
+
+	if depth, err := db.QueueDepth(pg.PriorityEvent); err != nil || depth != 1 {
+		t.Errorf("Expected the failed address to stay queued, got %d, %v", depth, err)
+	}
+
+	claimed, err = db.ClaimAddresses(ctx, pg.PriorityBackfill, 10, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to claim addresses: %v", err)
+	}
+	if len(claimed) != 1 || claimed[0].Account != "0x0000000000000a01" {
+		t.Errorf("Expected the backfill address, got %v", claimed)
+	}
+}
+
+func TestAddressQueueRequeueDuringFetch(t *testing.T) {
+	db := newTestStore(t)
+
+	ctx := context.Background()
+	account := "0x0000000000000a05"
+	if err := db.EnqueueAddresses(ctx, []string{account}, pg.PriorityEvent); err != nil {
+		t.Fatalf("Failed to enqueue addresses: %v", err)
+	}
+	claimed, err := db.ClaimAddresses(ctx, pg.PriorityEvent, 1000, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to claim addresses: %v", err)
+	}
+	var claim pg.QueuedAddress
+	for _, c := range claimed {
+		if c.Account == account {
+			claim = c
+		}
+	}
+	if claim.Account == "" {
+		t.Fatalf("Expected %s to be claimed, got %v", account, claimed)
+	}
+
+	// a key event arrives while the claim is being fetched
+	if err := db.EnqueueAddresses(ctx, []string{account}, pg.PriorityEvent); err != nil {
+		t.Fatalf("Failed to enqueue addresses: %v", err)
+	}
+	if err := db.FailAddresses(ctx, []pg.QueuedAddress{claim}, errors.New("node unavailable")); err != nil {
+		t.Fatalf("Failed to record failed addresses: %v", err)
+	}
+	if err := db.RemoveAccountsProcessing(ctx, []pg.QueuedAddress{claim}); err != nil {
+		t.Fatalf("Failed to remove addresses: %v", err)
+	}
+
+	// the newer enqueue stays queued, without the lease or back off of the old claim
+	again, err := db.ClaimAddresses(ctx, pg.PriorityEvent, 1000, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to claim addresses: %v", err)
+	}
+	var requeued pg.QueuedAddress
+	for _, c := range again {
+		if c.Account == account {
+			requeued = c
+		}
+	}
+	if requeued.Generation <= claim.Generation {
+		t.Fatalf("Expected a newer generation of %s to be claimable, got %v", account, again)
+	}
+	if err := db.RemoveAccountsProcessing(ctx, []pg.QueuedAddress{requeued}); err != nil {
+		t.Fatalf("Failed to remove addresses: %v", err)
+	}
+}
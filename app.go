@@ -2,150 +2,213 @@ package main
 
 import (
 	"context"
+	"example/flow-key-indexer/pkg/config"
 	"example/flow-key-indexer/pkg/pg"
 	"strings"
 	"time"
 
 	_ "net/http/pprof"
 
-	"github.com/onflow/cadence"
 	"github.com/onflow/flow-go-sdk"
-	"github.com/onflow/flow-go-sdk/access/grpc"
 	"github.com/rs/zerolog/log"
 )
 
-type Params struct {
-	LogLevel               string `default:"info"`
-	Port                   string `default:"8080"`
-	FlowUrl1               string `default:"access.mainnet.nodes.onflow.org:9000"`
-	FlowUrl2               string
-	FlowUrl3               string
-	FlowUrl4               string
-	AllFlowUrls            []string `ignored:"true"`
-	ChainId                string   `default:"flow-mainnet"`
-	MaxAcctKeys            int      `default:"1000"`
-	BatchSize              int      `default:"50000"`
-	IgnoreZeroWeight       bool     `default:"true"`
-	IgnoreRevoked          bool     `default:"false"`
-	WaitNumBlocks          int      `default:"200"`
-	BlockPolIntervalSec    int      `default:"180"`
-	SyncDataPolIntervalMin int      `default:"1"`
-	SyncDataStartIndex     int      `default:"30000000"`
-	MaxBlockRange          int      `default:"600"`
-	FetchSlowDownMs        int      `default:"500"`
-	PurgeOnStart           bool     `default:"false"`
-	EnableSyncData         bool     `default:"true"`
-	EnableIncremental      bool     `default:"true"`
-
-	PostgreSQLHost              string        `default:"localhost"`
-	PostgreSQLPort              uint16        `default:"5432"`
-	PostgreSQLUsername          string        `default:"postgres"`
-	PostgreSQLPassword          string        `required:"false"`
-	PostgreSQLDatabase          string        `default:"keyindexer"`
-	PostgreSQLSSL               bool          `default:"true"`
-	PostgreSQLLogQueries        bool          `default:"false"`
-	PostgreSQLSetLogger         bool          `default:"false"`
-	PostgreSQLRetryNumTimes     uint16        `default:"30"`
-	PostgreSQLRetrySleepTime    time.Duration `default:"1s"`
-	PostgreSQLPoolSize          int           `default:"1"`
-	PostgresLoggerPrefix        string        `default:"keyindexer"`
-	PostgresPrometheusSubSystem string        `default:"keyindexer"`
-}
+const (
+	legacyDrainBatchSize = 10000
+	legacyDrainPause     = 100 * time.Millisecond
+	// identifierFillBatchSize is the number of keys given their derived identifiers per update
+	identifierFillBatchSize = 5000
+	// queueLease is how long a claimed address is reserved for the worker that claimed it
+	queueLease = 10 * time.Minute
+)
 
 type App struct {
 	DB         *pg.Store
 	flowClient *FlowAdapter
-	p          Params
+	p          config.Params
 	dataLoader *DataLoader
 	rest       *Rest
 }
 
-type ClientWrapper struct {
-	*grpc.BaseClient
-}
-
-func (cw *ClientWrapper) ExecuteScriptAtBlockHeight(ctx context.Context, blockHeight uint64, script []byte, arguments []cadence.Value) (cadence.Value, error) {
-	return cw.BaseClient.ExecuteScriptAtBlockHeight(ctx, blockHeight, script, arguments)
-}
-
-func (a *App) Initialize(params Params) {
-	params.AllFlowUrls = setAllFlowUrls(params)
+func (a *App) Initialize(params config.Params) {
 	a.p = params
+	log.Info().Msgf("Starting in %s mode", params.Mode)
 
-	dbConfig := getPostgresConfig(params)
+	dbConfig := params.PostgresConfig()
 
 	db := pg.NewStore(dbConfig, log.Logger)
-	err := db.Start(params.PurgeOnStart)
+	var err error
+	if params.Mode == config.ModeAPI {
+		err = db.StartReadOnly()
+	} else {
+		err = db.Start(params.PurgeOnStart)
+	}
 	if err != nil {
-		log.Fatal().Err(err).Msg("Database could not be found or created")
+		log.Fatal().Err(err).Msg("Database could not be migrated or connected")
 	}
 	a.DB = db
 
-	a.flowClient = NewFlowClient(strings.TrimSpace(a.p.FlowUrl1))
-	a.dataLoader = NewDataLoader(*a.DB, *a.flowClient, params)
-	a.rest = NewRest(*a.DB, *a.flowClient, params)
+	if params.Mode != config.ModeAPI {
+		a.flowClient = NewFlowClient(strings.TrimSpace(a.p.FlowUrl1), newNodeLimiter(a.p.FlowRequestsPerSec, a.p.FlowRequestBurst))
+		if err := params.CheckAccessNode(context.Background(), a.flowClient.Client); err != nil {
+			log.Fatal().Err(err).Msg("Access node does not match the configuration")
+		}
+		a.dataLoader = NewDataLoader(*a.DB, *a.flowClient, params)
+	}
+	a.rest = NewRest(*a.DB, a.flowClient, params)
 }
 
 func (a *App) Run() {
 	ctx := context.Background()
-	highPriChan := make(chan []flow.Address)
-	lowPriAddressChan := make(chan []flow.Address)
-	currentBlock, err := a.flowClient.Client.GetLatestBlockHeader(context.Background(), true)
 
-	if err != nil {
-		log.Error().Err(err).Msg("Could not get current block height")
-		return
+	// jobs guarded by a lock run on one replica at a time, the others stand by
+	if a.p.RunsIngest() {
+		log.Info().Msgf("Incremental service is enabled")
+		if _, err := ProcessEventAddresses(ctx, log.Logger, a.flowClient.Client, a.DB, a.p); err != nil {
+			log.Error().Err(err).Msg("Could not start event address processing")
+			return
+		}
+		go a.runAsLeader(ctx, pg.LockIncremental, "incremental loader", a.loadIncrementalData)
 	}
-	if currentBlock == nil {
-		log.Error().Msg("Could not get current block height")
-		return
+	if a.p.RunsBackfill() {
+		log.Info().Msgf("Data Sync service is enabled")
+		lowPriAddressChan := make(chan []pg.QueuedAddress)
+		if err := ProcessBackfillAddresses(ctx, log.Logger, a.flowClient.Client, lowPriAddressChan, a.DB, a.p); err != nil {
+			log.Error().Err(err).Msg("Could not start backfill processing")
+			return
+		}
+		go a.bulkLoad(ctx, lowPriAddressChan)
+		go a.runAsLeader(ctx, pg.LockTruncated, "truncated accounts", a.loadTruncatedAccounts)
 	}
-	if currentBlock.Height == 0 {
-		log.Error().Msg("Could not get current block height")
-		return
+	if a.p.Mode != config.ModeAPI {
+		go a.runAsLeader(ctx, pg.LockMaintenance, "maintenance", a.runMaintenance)
 	}
+	a.rest.Start()
+}
 
-	startingBlockHeight := currentBlock.Height - uint64(a.p.MaxBlockRange)
-
-	a.DB.UpdateLoadedBlockHeight(startingBlockHeight)
+// runMaintenance runs the background jobs that only need one replica.
+func (a *App) runMaintenance(ctx context.Context) {
+	// convert rows left in the varchar layout by the typed columns migration,
+	// then derive the identifiers of the keys stored before they were added
+	go func() {
+		err := a.DB.DrainLegacyKeys(ctx, legacyDrainBatchSize, legacyDrainPause)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Error().Err(err).Msg("Could not convert legacy public key rows")
+			}
+			return
+		}
+		err = a.DB.FillKeyIdentifiers(ctx, identifierFillBatchSize, legacyDrainPause)
+		if err != nil && ctx.Err() == nil {
+			log.Error().Err(err).Msg("Could not fill in key identifiers")
+		}
+	}()
+	if a.p.ClusterIntervalMin > 0 {
+		go a.computeClusters(ctx, time.Duration(a.p.ClusterIntervalMin)*time.Minute)
+	}
+	a.waitForChannelsToUpdateDistinct(ctx, time.Duration(a.p.SyncDataPolIntervalMin)*time.Minute, a.DB.UpdateDistinctCount)
+}
 
-	log.Debug().Msgf("Current block from server %v", currentBlock.Height)
+// computeClusters precomputes the large account clusters now and every interval.
+func (a *App) computeClusters(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := a.DB.ComputeAccountClusters(ctx, a.p.MinClusterSize); err != nil && ctx.Err() == nil {
+			log.Error().Err(err).Msg("Could not compute account clusters")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
 
-	// start up process to handle addresses that are put in addressChan channel
-	ProcessAddressChannels(ctx,
-		log.Logger,
-		a.flowClient.Client,
-		highPriChan,
-		lowPriAddressChan,
-		a.DB,
-		a.p)
-	if a.p.EnableSyncData {
-		log.Info().Msgf("Data Sync service is enabled")
-		go a.bulkLoad(lowPriAddressChan)
+func (a *App) loadIncrementalData(ctx context.Context) {
+	currentBlock, ok := a.startBlock(ctx)
+	if !ok {
+		return
 	}
+	log.Debug().Msgf("Current block from server %v", currentBlock.Height)
 
-	if a.p.EnableIncremental {
-		log.Info().Msgf("Incremental service is enabled")
-		go a.loadIncrementalData(highPriChan)
+	// a new leader resumes from the stored cursor, left by the previous leader
+	// or an imported snapshot, when it is at most MaxCatchUpBlocks behind,
+	// otherwise it starts from a recent block, see MaxBlockRange
+	loadedBlockHeight, _ := a.DB.GetLoadedBlockHeight()
+	if loadedBlockHeight == 0 || loadedBlockHeight > currentBlock.Height ||
+		currentBlock.Height-loadedBlockHeight > uint64(a.p.MaxCatchUpBlocks) {
+		startingBlockHeight := currentBlock.Height - uint64(a.p.MaxBlockRange)
+		a.DB.UpdateLoadedBlockHeight(startingBlockHeight)
+	} else if !a.catchUp(ctx, loadedBlockHeight) {
+		return
 	}
-	go a.waitForChannelsToUpdateDistinct(ctx, highPriChan, lowPriAddressChan, time.Duration(a.p.SyncDataPolIntervalMin)*time.Minute, a.DB.UpdateDistinctCount)
-	a.rest.Start()
-}
 
-func (a *App) loadIncrementalData(addressChan chan []flow.Address) {
 	// Kick off the incremental load first
-	a.incrementalLoad(addressChan)
+	a.incrementalLoad()
 
 	ticker := time.NewTicker(time.Duration(a.p.BlockPolIntervalSec) * time.Second)
+	defer ticker.Stop()
 
-	go func() {
-		for range ticker.C {
-			a.incrementalLoad(addressChan)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.incrementalLoad()
 		}
-	}()
+	}
+}
+
+// startBlock reads the latest sealed block a new leader starts from, retrying
+// every BlockPolIntervalSec until it succeeds. It returns false when ctx is
+// done first.
+func (a *App) startBlock(ctx context.Context) (*flow.BlockHeader, bool) {
+	for {
+		currentBlock, err := a.flowClient.Client.GetLatestBlockHeader(ctx, true)
+		if err == nil && currentBlock != nil && currentBlock.Height > 0 {
+			return currentBlock, true
+		}
+		log.Error().Err(err).Msg("Could not get current block height")
+		select {
+		case <-ctx.Done():
+			return nil, false
+		case <-time.After(time.Duration(a.p.BlockPolIntervalSec) * time.Second):
+		}
+	}
+}
+
+// catchUp queues the accounts with key events from height on, MaxBlockRange
+// blocks at a time, until the cursor is within MaxBlockRange of the current
+// block. It returns false when ctx is done first.
+func (a *App) catchUp(ctx context.Context, height uint64) bool {
+	log.Info().Msgf("Inc resuming from block %d", height)
+	blockRange := uint64(a.p.MaxBlockRange)
+	for ctx.Err() == nil {
+		currentHeight, err := a.flowClient.GetCurrentBlockHeight()
+		if err != nil {
+			log.Error().Err(err).Msg("Inc could not get current block height")
+		} else if currentHeight-height <= blockRange {
+			return true
+		} else {
+			synched, err := a.dataLoader.RunIncAddressesLoader(height, height+blockRange)
+			if err == nil {
+				height = synched
+				a.DB.UpdateLoadedBlockHeight(height)
+				log.Info().Msgf("Inc caught up to block %d, %d behind", height, currentHeight-height)
+				continue
+			}
+			log.Error().Err(err).Msgf("Inc could not catch up from block %d", height)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Duration(a.p.BlockPolIntervalSec) * time.Second):
+		}
+	}
+	return false
 }
 
-func (a *App) waitForChannelsToUpdateDistinct(ctx context.Context, highChan chan []flow.Address, lowChan chan []flow.Address, pause time.Duration, updateDistinctCount func()) {
+func (a *App) waitForChannelsToUpdateDistinct(ctx context.Context, pause time.Duration, updateDistinctCount func()) {
 	ticker := time.NewTicker(pause)
 	defer ticker.Stop()
 
@@ -155,83 +218,71 @@ func (a *App) waitForChannelsToUpdateDistinct(ctx context.Context, highChan chan
 			log.Debug().Msg("Service is stopping, exiting waitForChannelsToUpdateDistinct")
 			return
 		case <-ticker.C:
-			log.Debug().Msgf("High-priority channel size %d", len(highChan))
-			log.Debug().Msgf("Low-priority channel size %d", len(lowChan))
+			eventDepth, _ := a.DB.QueueDepth(pg.PriorityEvent)
+			log.Debug().Msgf("High-priority queue depth %d", eventDepth)
 
-			if len(highChan) < 10 && len(lowChan) < 10 {
-				log.Debug().Msg("Both channels have cleared enough, run another bulk loader")
+			if eventDepth < 10 {
+				log.Debug().Msg("High-priority queue has cleared enough, update the distinct count")
 				updateDistinctCount()
 			}
 		}
 	}
 }
 
-func (a *App) bulkLoad(lowPrioAddressChan chan []flow.Address) {
+func (a *App) bulkLoad(ctx context.Context, lowPrioAddressChan chan []pg.QueuedAddress) {
 	batchSize := a.p.BatchSize
-	ignoreList := []string{}
 	maxWaitTime := time.Duration(a.p.SyncDataPolIntervalMin) * time.Minute
 
 	for {
 		start := time.Now()
 
-		// Fetch addresses to process
-		addresses, err := a.DB.GetAccountsToProcess(batchSize, ignoreList)
+		// Claim addresses to process, they are removed from the queue once their keys are stored
+		addresses, err := a.DB.ClaimAddresses(ctx, pg.PriorityBackfill, batchSize, queueLease)
 		fetch := time.Since(start)
-		log.Debug().Msgf("Bulk Fetch Addresses, duration %.2f min", fetch.Seconds())
+		log.Debug().Msgf("Bulk Claim Addresses, duration %.2f sec", fetch.Seconds())
 
 		if err != nil {
-			log.Error().Err(err).Msg("Bulk Could not get unique addresses without algos")
-			time.Sleep(time.Minute)
+			if ctx.Err() != nil {
+				return
+			}
+			log.Error().Err(err).Msg("Bulk Could not claim addresses to process")
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Minute):
+			}
 			continue
 		}
 
 		if len(addresses) == 0 {
 			log.Info().Msg("Bulk No new addresses to process, waiting before next attempt")
-			time.Sleep(maxWaitTime)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(maxWaitTime):
+			}
 			continue
 		}
 
 		log.Debug().Msgf("Bulk addresses to process %d ", len(addresses))
 
-		flowAddresses := make([]flow.Address, len(addresses))
-		for i, address := range addresses {
-			flowAddresses[i] = flow.HexToAddress(address)
-		}
-
 		// Try to send addresses to channel with a timeout
 		select {
-		case lowPrioAddressChan <- flowAddresses:
+		case <-ctx.Done():
+			return
+		case lowPrioAddressChan <- addresses:
 		case <-time.After(30 * time.Second):
+			// the lease runs out and the addresses are claimed again later
 			log.Warn().Msg("Bulk Channel full, skipping this batch")
 			continue
 		}
 
-		// Wait for the channel to clear or timeout
-		waitStart := time.Now()
-		for len(lowPrioAddressChan) > 0 {
-			if time.Since(waitStart) > maxWaitTime {
-				log.Warn().Msg("Bulk Max wait time exceeded, continuing to next iteration")
-				break
-			}
-			time.Sleep(time.Second)
-		}
-
-		// After the channel clears, remove the addresses from the addressprocessing table
-		removeStart := time.Now()
-		err = a.DB.RemoveAccountsProcessing(addresses)
-		removeDuration := time.Since(removeStart)
-		if err != nil {
-			log.Error().Err(err).Msg("Bulk Could not remove processed addresses")
-		} else {
-			log.Debug().Msgf("Bulk Removed %d processed addresses, duration %.2f min", len(addresses), removeDuration.Minutes())
-		}
-
 		duration := time.Since(start)
-		log.Info().Msgf("Bulk End Load, duration %.2f min, fetched %d addresses", duration.Minutes(), len(addresses))
+		log.Info().Msgf("Bulk End Load, duration %.2f min, claimed %d addresses", duration.Minutes(), len(addresses))
 	}
 }
 
-func (a *App) incrementalLoad(addressChan chan []flow.Address) {
+func (a *App) incrementalLoad() {
 	start := time.Now()
 	loadedBlkHeight, _ := a.DB.GetLoadedBlockHeight()
 	currentHeight, errCurr := a.flowClient.GetCurrentBlockHeight()
@@ -245,7 +296,7 @@ func (a *App) incrementalLoad(addressChan chan []flow.Address) {
 
 	var synchToBlockHeight uint64
 	var err error
-	synchToBlockHeight, err = a.dataLoader.RunIncAddressesLoader(addressChan, loadedBlkHeight, currentHeight)
+	synchToBlockHeight, err = a.dataLoader.RunIncAddressesLoader(loadedBlkHeight, currentHeight)
 	if err != nil {
 		log.Error().Err(err).Msg("Inc could not load incremental public keys, will retry if falling behind ")
 	}
@@ -263,34 +314,7 @@ func (a *App) incrementalLoad(addressChan chan []flow.Address) {
 	if newBlockRange > uint64(a.p.WaitNumBlocks) {
 		refreshBlock := currentBlockHeight - uint64(a.p.MaxBlockRange)
 		log.Warn().Msgf("Inc load is lagging, running incremental at %d, %d blocks", refreshBlock, newBlockRange)
-		synchToBlockHeight, _ = a.dataLoader.RunIncAddressesLoader(addressChan, refreshBlock, currentBlockHeight)
+		synchToBlockHeight, _ = a.dataLoader.RunIncAddressesLoader(refreshBlock, currentBlockHeight)
 		a.DB.UpdateLoadedBlockHeight(synchToBlockHeight)
 	}
 }
-
-func setAllFlowUrls(params Params) []string {
-	var all []string
-	all = processUrl(params.FlowUrl1, all)
-	all = processUrl(params.FlowUrl2, all)
-	all = processUrl(params.FlowUrl3, all)
-	all = processUrl(params.FlowUrl4, all)
-	return all
-}
-
-func processUrl(url string, collection []string) []string {
-	newUrl := strings.TrimSpace(url)
-	if newUrl != "" {
-		collection = append(collection, newUrl)
-	}
-	return collection
-}
-
-func getPostgresConfig(conf Params) pg.DatabaseConfig {
-	return pg.DatabaseConfig{
-		Host:     conf.PostgreSQLHost,
-		Password: conf.PostgreSQLPassword,
-		Name:     conf.PostgreSQLDatabase,
-		User:     conf.PostgreSQLUsername,
-		Port:     int(conf.PostgreSQLPort),
-	}
-}
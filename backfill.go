@@ -2,9 +2,9 @@ package main
 
 import (
 	"context"
-	"strings"
 
 	"example/flow-key-indexer/model"
+	"example/flow-key-indexer/pkg/config"
 	"example/flow-key-indexer/pkg/pg"
 
 	"github.com/onflow/flow-go-sdk"
@@ -12,63 +12,152 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-func backfillPublicKeys(ctx context.Context, flowAddresses []flow.Address, db *pg.Store, client access.Client, params Params) error {
+// backfillPublicKeys reads the keys of the claimed addresses with the bulk
+// script in batches sized for the node, bisecting batches that fail for their
+// size or an account. Addresses are removed from the work queue once their
+// keys are committed, a node or database error puts the rest back with a
+// back off.
+func backfillPublicKeys(ctx context.Context, claims []pg.QueuedAddress, db *pg.Store, client access.Client, params config.Params, sizer *batchSizer) error {
+	flowAddresses := make([]flow.Address, len(claims))
+	generations := make(map[flow.Address]int64, len(claims))
+	for i, claim := range claims {
+		flowAddresses[i] = flow.HexToAddress(claim.Account)
+		generations[flowAddresses[i]] = claim.Generation
+	}
+	// queueClaims returns the claims of a batch
+	queueClaims := func(addresses []flow.Address) []pg.QueuedAddress {
+		queued := make([]pg.QueuedAddress, len(addresses))
+		for i, addr := range addresses {
+			queued[i] = pg.QueuedAddress{Account: addr.HexWithPrefix(), Generation: generations[addr]}
+		}
+		return queued
+	}
 
 	if len(flowAddresses) == 0 {
 		log.Info().Msg("No more addresses to process. Backfill complete.")
 		return nil
 	}
-	log.Debug().Msgf("Batch Bulk Backfilling %v", len(flowAddresses))
-	updatedRecords, err := ProcessAddressWithScript(ctx, params, flowAddresses, log.Logger, client, params.FetchSlowDownMs)
-	if err != nil {
-		log.Warn().Err(err).Msg("Failed to process addresses, processing them individually")
-		// loop over each address and process them individually
-		for _, addr := range flowAddresses {
-			updatedRecords, err := ProcessAddressWithScript(ctx, params, []flow.Address{addr}, log.Logger, client, params.FetchSlowDownMs)
-			if err != nil {
-				log.Error().Err(err).Msgf("Failed to process address %v", addr)
-				continue
-			}
-			if len(updatedRecords) == 0 {
-				log.Debug().Msgf("No updated records for %v", addr)
-				continue
-			}
-			_, err = generateAndSaveCopyString(ctx, db, updatedRecords)
+	log.Debug().Msgf("Batch Bulk Backfilling %v, batch size %d", len(flowAddresses), sizer.Size())
+
+	run := func(batch []flow.Address) error {
+		result, err := ProcessAddressWithScript(ctx, params, batch, log.Logger, client)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Failed to process %d addresses", len(batch))
+			return err
+		}
+		if len(result.Keys) > 0 {
+			_, err := savePublicKeys(ctx, db, result.Keys)
 			if err != nil {
-				log.Error().Err(err).Msg("Failed to generate and save copy string")
-				continue
+				log.Error().Err(err).Msg("Failed to save public keys")
+				return err
 			}
+		} else {
+			log.Debug().Msgf("No updated records to process, %v", batch)
+		}
+		recordScriptAccounts(ctx, db, batch, result)
+		if err := db.RemoveAccountsProcessing(ctx, queueClaims(batch)); err != nil {
+			log.Error().Err(err).Msgf("Failed to remove %d processed addresses", len(batch))
 		}
 		return nil
+	}
+	failed := func(addr flow.Address, err error) {
+		log.Error().Err(err).Msgf("Failed to process address %v", addr)
+		recordAccounts(ctx, db, []model.AccountRecord{{
+			Address:   addr.HexWithPrefix(),
+			Status:    model.AccountStatusError,
+			LastError: err.Error(),
+		}})
+		failQueued(ctx, db, queueClaims([]flow.Address{addr}), err)
+	}
 
-	} else {
-		if len(updatedRecords) == 0 {
-			log.Debug().Msgf("No updated records to process, %v", flowAddresses)
-			return nil
+	rest, err := splitBatches(ctx, sizer, flowAddresses, run, failed)
+	if err != nil && ctx.Err() == nil {
+		log.Error().Err(err).Msgf("Stopped backfilling, %d addresses are put back in the queue", len(rest))
+		failQueued(ctx, db, queueClaims(rest), err)
+		return err
+	}
+	return nil
+}
+
+// accountRecordsFromScript builds the registry entries of a script batch. The
+// script reports the real key count and whether MaxAcctKeys cut the keys short,
+// truncated accounts are marked over_cap until their remaining keys are paged in.
+func accountRecordsFromScript(addresses []flow.Address, result scriptResult) []model.AccountRecord {
+	records := make([]model.AccountRecord, 0, len(addresses))
+	for _, addr := range addresses {
+		account := result.Accounts[addr]
+		record := model.AccountRecord{
+			Address:             addr.HexWithPrefix(),
+			Status:              model.AccountStatusOK,
+			KeyCount:            account.KeyCount,
+			LastRefreshedHeight: result.Height,
 		}
-		_, err := generateAndSaveCopyString(ctx, db, updatedRecords)
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to generate and save copy string")
-			return err
+		if account.Truncated {
+			record.Status = model.AccountStatusOverCap
+		} else if record.KeyCount == 0 {
+			record.Status = model.AccountStatusKeyless
 		}
+		records = append(records, record)
 	}
+	return records
+}
 
-	return nil
+// truncatedAccountsFromScript lists the accounts of a script batch whose keys
+// were cut short by MaxAcctKeys.
+func truncatedAccountsFromScript(result scriptResult) []model.TruncatedAccount {
+	var truncated []model.TruncatedAccount
+	for addr, account := range result.Accounts {
+		if !account.Truncated {
+			continue
+		}
+		truncated = append(truncated, model.TruncatedAccount{
+			Address:        addr.HexWithPrefix(),
+			KeyCount:       account.KeyCount,
+			NextKeyIndex:   account.NextKeyIndex,
+			DetectedHeight: result.Height,
+		})
+	}
+	return truncated
 }
 
-func generateAndSaveCopyString(ctx context.Context, db *pg.Store, updatedRecords []model.PublicKeyAccountIndexer) (int64, error) {
-	copyString, err := db.GenerateCopyStringForPublicKeyAccounts(ctx, updatedRecords)
-	if err != nil {
-		return 0, err
+// recordScriptAccounts stores the registry entries of a script batch and
+// queues truncated accounts for the follow-up fetch.
+func recordScriptAccounts(ctx context.Context, db *pg.Store, addresses []flow.Address, result scriptResult) {
+	recordAccounts(ctx, db, accountRecordsFromScript(addresses, result))
+
+	truncated := truncatedAccountsFromScript(result)
+	if len(truncated) == 0 {
+		return
+	}
+	log.Warn().Msgf("%d accounts have more keys than the configured maximum, queued for paged fetch", len(truncated))
+	if err := db.RecordTruncatedAccounts(ctx, truncated); err != nil {
+		log.Error().Err(err).Msgf("Failed to record %d truncated accounts", len(truncated))
 	}
-	// Create an io.Reader from the copyString
-	copyReader := strings.NewReader(copyString)
+}
 
-	log.Debug().Msgf("updatedRecords: %v", len(updatedRecords))
+// queueAddresses converts addresses to the format of the work queue rows
+func queueAddresses(addresses []flow.Address) []string {
+	queued := make([]string, len(addresses))
+	for i, addr := range addresses {
+		queued[i] = addr.HexWithPrefix()
+	}
+	return queued
+}
+
+func failQueued(ctx context.Context, db *pg.Store, addresses []pg.QueuedAddress, cause error) {
+	if err := db.FailAddresses(ctx, addresses, cause); err != nil {
+		log.Error().Err(err).Msgf("Failed to record %d failed addresses", len(addresses))
+	}
+}
 
-	rowsCopied, err := db.LoadPublicKeyIndexerFromReader(ctx, copyReader)
-	if err != nil {
-		return 0, err
+func recordAccounts(ctx context.Context, db *pg.Store, records []model.AccountRecord) {
+	if err := db.UpsertAccounts(ctx, records); err != nil {
+		log.Error().Err(err).Msgf("Failed to record %d accounts", len(records))
 	}
-	return rowsCopied, nil
+}
+
+// savePublicKeys copies the keys into the index.
+func savePublicKeys(ctx context.Context, db *pg.Store, updatedRecords []model.PublicKeyAccountIndexer) (int64, error) {
+	log.Debug().Msgf("updatedRecords: %v", len(updatedRecords))
+	return db.CopyPublicKeyAccounts(ctx, updatedRecords)
 }
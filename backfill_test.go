@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"example/flow-key-indexer/model"
+
+	"github.com/onflow/flow-go-sdk"
+)
+
+func TestAccountRecordsFromScript(t *testing.T) {
+	withKeys := flow.HexToAddress("0x01")
+	keyless := flow.HexToAddress("0x02")
+	capped := flow.HexToAddress("0x03")
+	missing := flow.HexToAddress("0x04")
+
+	result := scriptResult{
+		Accounts: map[flow.Address]scriptAccount{
+			withKeys: {KeyCount: 1, NextKeyIndex: 1},
+			keyless:  {KeyCount: 0, NextKeyIndex: 0},
+			capped:   {KeyCount: 5, NextKeyIndex: 2, Truncated: true},
+		},
+		Height: 42,
+	}
+
+	records := accountRecordsFromScript([]flow.Address{withKeys, keyless, capped, missing}, result)
+
+	expected := map[string]struct {
+		status   string
+		keyCount int
+	}{
+		withKeys.HexWithPrefix(): {status: model.AccountStatusOK, keyCount: 1},
+		keyless.HexWithPrefix():  {status: model.AccountStatusKeyless, keyCount: 0},
+		capped.HexWithPrefix():   {status: model.AccountStatusOverCap, keyCount: 5},
+		missing.HexWithPrefix():  {status: model.AccountStatusKeyless, keyCount: 0},
+	}
+
+	if len(records) != len(expected) {
+		t.Fatalf("Expected %d records, got %d", len(expected), len(records))
+	}
+	for _, r := range records {
+		e, ok := expected[r.Address]
+		if !ok {
+			t.Errorf("Unexpected record for %s", r.Address)
+			continue
+		}
+		if r.Status != e.status || r.KeyCount != e.keyCount || r.LastRefreshedHeight != 42 {
+			t.Errorf("Unexpected record for %s: %+v", r.Address, r)
+		}
+	}
+
+	truncated := truncatedAccountsFromScript(result)
+	if len(truncated) != 1 {
+		t.Fatalf("Expected 1 truncated account, got %d", len(truncated))
+	}
+	if truncated[0].Address != capped.HexWithPrefix() || truncated[0].KeyCount != 5 || truncated[0].NextKeyIndex != 2 || truncated[0].DetectedHeight != 42 {
+		t.Errorf("Unexpected truncated account: %+v", truncated[0])
+	}
+}
@@ -22,33 +22,18 @@ import (
 	"context"
 	_ "embed"
 	"example/flow-key-indexer/model"
+	"example/flow-key-indexer/pkg/config"
 	"example/flow-key-indexer/pkg/pg"
 	"example/flow-key-indexer/utils"
 	"fmt"
 	"time"
 
-	"google.golang.org/grpc/credentials/insecure"
-
 	"github.com/onflow/flow-go-sdk"
 	"github.com/onflow/flow-go-sdk/access"
-	"github.com/onflow/flow-go-sdk/access/grpc"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	grpcOpts "google.golang.org/grpc"
 )
 
-// getFlowClient initializes and returns a flow client
-func getFlowClient(flowClientUrl string) *grpc.BaseClient {
-	flowClient, err := grpc.NewBaseClient(flowClientUrl,
-		grpcOpts.WithTransportCredentials(insecure.NewCredentials()),
-	)
-	if err != nil {
-		panic(err)
-	}
-
-	return flowClient
-}
-
 // Config defines that application's config
 type Config struct {
 	// BachSize is the number of addresses for which to run each script
@@ -68,90 +53,50 @@ var ignoreAccounts = map[string]bool{
 	"0000000000000000": true, // placeholder, replace when account identified
 }
 
-func ProcessAddressChannels(
+// ProcessEventAddresses starts the high-priority worker, it fetches the
+// accounts with key events claimed from the queue.
+func ProcessEventAddresses(
 	ctx context.Context,
 	log zerolog.Logger,
 	client access.Client,
-	highPriorityChan chan []flow.Address,
-	lowPriorityChan chan []flow.Address,
 	db *pg.Store,
-	config Params,
-) error {
+	config config.Params,
+) (*accountFetchPool, error) {
 	if client == nil {
-		return fmt.Errorf("batch Failed to initialize flow client")
+		return nil, fmt.Errorf("batch Failed to initialize flow client")
 	}
-	bufferSize := 1000
-	resultsChan := make(chan []model.PublicKeyAccountIndexer, bufferSize)
-	fetchSlowdown := config.FetchSlowDownMs
 
-	insertionHandler := db.InsertPublicKeyAccounts
-	// Launch a goroutine to handle results
-	go func() {
-		log.Debug().Msg("Batch Results channel handler started")
-		for {
-			select {
-			case <-ctx.Done():
-				log.Info().Msg("Batch Context done, exiting result handler")
-				return
-			case keys, ok := <-resultsChan:
-				log.Debug().Msgf("Batch Results channel received %v keys", len(keys))
-				if !ok {
-					log.Info().Msg("Batch Results channel closed, exiting result handler")
-					return
-				}
-
-				if len(keys) == 0 {
-					continue
-				}
-
-				start := time.Now()
-				errHandler := insertionHandler(ctx, keys)
-				duration := time.Since(start)
-				log.Info().Msgf("Batch DB d(%f) q(%v) to be stored", duration.Seconds(), len(resultsChan))
-				if errHandler != nil {
-					log.Error().Err(errHandler).Msgf("Batch Failed to handle keys, %v, break up into smaller chunks", len(keys))
-					// break up batch into smaller chunks
-					for i := 0; i < len(keys); i += config.BatchSize {
-						end := i + config.BatchSize
-						if end > len(keys) {
-							end = len(keys)
-						}
-						errHandler = insertionHandler(ctx, keys[i:end])
-						if errHandler != nil {
-							log.Error().Err(errHandler).Msg("Batch Failed to handle keys")
-						}
-					}
-				}
-			}
-		}
-	}()
-
-	// High-priority worker
+	// High-priority worker, fetches the accounts with key events claimed from the queue
+	pool := newAccountFetchPool(ctx, log, client, config.HighPriorityWorkers, config.HighPriorityQueueSize,
+		db.InsertPublicKeyAccounts, db.UpsertAccounts, db.RemoveAccountsProcessing, db.FailAddresses)
 	go func() {
 		defer func() {
 			if r := recover(); r != nil {
 				log.Error().Msgf("Batch High-priority worker recovered from panic: %v", r)
 			}
 		}()
-
-		for {
-			select {
-			case <-ctx.Done():
-				log.Info().Msg("Batch High-priority Context done, exiting high-priority worker")
-				return
-			case accountAddresses, ok := <-highPriorityChan:
-				if !ok {
-					log.Warn().Msg("Batch High-priority channel closed, exiting high-priority worker")
-					return
-				}
-				// Create a new goroutine to process each high-priority address array
-				log.Debug().Msgf("Batch High-priority worker processing %d addresses", len(accountAddresses))
-				go processAddresses(accountAddresses, ctx, log, client, resultsChan, fetchSlowdown, insertionHandler)
-			}
-		}
+		claimEventAddresses(ctx, log, db, pool, config.HighPriorityQueueSize)
 	}()
 
-	// Low-priority workers
+	return pool, nil
+}
+
+// ProcessBackfillAddresses starts the low-priority worker, it backfills the
+// batches of addresses sent to lowPriorityChan.
+func ProcessBackfillAddresses(
+	ctx context.Context,
+	log zerolog.Logger,
+	client access.Client,
+	lowPriorityChan chan []pg.QueuedAddress,
+	db *pg.Store,
+	config config.Params,
+) error {
+	if client == nil {
+		return fmt.Errorf("batch Failed to initialize flow client")
+	}
+	// the client talks to a single access node, the sizer learns its script batch size
+	scriptSizer := newBatchSizer(config.ScriptBatchSize, config.BatchSize)
+
 	go func() {
 		log.Info().Msgf("Batch Bulk Low-priority started")
 		defer func() {
@@ -174,7 +119,7 @@ func ProcessAddressChannels(
 					continue
 				}
 				log.Debug().Msgf("Batch Bulk Low-priority processing %d addresses", len(accountAddresses))
-				err := backfillPublicKeys(ctx, accountAddresses, db, client, config)
+				err := backfillPublicKeys(ctx, accountAddresses, db, client, config, scriptSizer)
 				if err != nil {
 					log.Error().Err(err).Msgf("Batch Bulk Low-priority failed to backfill addresses %d", len(accountAddresses))
 				}
@@ -185,83 +130,102 @@ func ProcessAddressChannels(
 	return nil
 }
 
-func processAddresses(
-	accountAddresses []flow.Address,
-	ctx context.Context,
-	log zerolog.Logger,
-	client access.Client,
-	resultsChan chan []model.PublicKeyAccountIndexer,
-	fetchSlowdown int, insertHandler func(context.Context, []model.PublicKeyAccountIndexer) error) {
-
-	var keys []model.PublicKeyAccountIndexer
+// claimEventAddresses keeps the pool supplied with addresses that had key
+// events, claiming more whenever less than half of its queue is in use.
+func claimEventAddresses(ctx context.Context, log zerolog.Logger, db *pg.Store, pool *accountFetchPool, queueSize int) {
+	for {
+		if free := queueSize - pool.QueueDepth(); free > queueSize/2 {
+			addresses, err := db.ClaimAddresses(ctx, pg.PriorityEvent, free, queueLease)
+			if err != nil {
+				log.Error().Err(err).Msg("Batch High-priority could not claim addresses")
+			}
+			if len(addresses) > 0 {
+				log.Debug().Msgf("Batch High-priority worker queueing %d addresses, %d queued", len(addresses), pool.QueueDepth())
+				pool.Submit(ctx, addresses)
+				continue
+			}
+		}
 
-	if len(accountAddresses) == 0 {
-		return
+		select {
+		case <-ctx.Done():
+			log.Info().Msg("Batch High-priority Context done, exiting high-priority worker")
+			return
+		case <-time.After(time.Second):
+		}
 	}
+}
 
-	log.Info().Msgf("Batch API Processing addresses: %v", len(accountAddresses))
-
-	for _, addr := range accountAddresses {
-		addrStr := utils.Add0xPrefix(addr.String())
-		if _, ok := ignoreAccounts[addrStr]; ok {
-			continue
-		}
+// fetchAccount reads the keys of one account at height and the registry entry
+// describing the outcome.
+func fetchAccount(ctx context.Context, log zerolog.Logger, client access.Client, addr flow.Address, height uint64) ([]model.PublicKeyAccountIndexer, model.AccountRecord) {
+	var keys []model.PublicKeyAccountIndexer
 
-		time.Sleep(time.Duration(fetchSlowdown) * time.Millisecond)
+	addrStr := utils.Add0xPrefix(addr.String())
+	record := model.AccountRecord{
+		Address:             addrStr,
+		LastRefreshedHeight: height,
+	}
+	if _, ok := ignoreAccounts[addr.Hex()]; ok {
+		record.Status = model.AccountStatusBroken
+		return keys, record
+	}
 
-		log.Debug().Msgf("Batch Getting account: %v", addrStr)
-		acct, err := client.GetAccount(ctx, addr)
-		log.Debug().Msgf("Batch Got account: %v", addrStr)
+	log.Debug().Msgf("Batch Getting account: %v", addrStr)
+	acct, err := getAccountAt(ctx, client, addr, height)
+	log.Debug().Msgf("Batch Got account: %v", addrStr)
 
-		if err != nil {
-			log.Warn().Err(err).Msgf("Batch Failed to get account, %v", addrStr)
-			continue
-		}
-		if acct == nil {
-			log.Warn().Msgf("Batch Account not found: %v", addrStr)
-			continue
-		}
-		if acct.Keys == nil {
-			log.Warn().Msgf("Batch Account has nil Keys: %v", addrStr)
-			continue
-		}
-		if len(acct.Keys) == 0 {
-			log.Warn().Msgf("Batch Account has no keys: %v", addrStr)
-			// Save account with blank public key to avoid querying it again
-			keys = append(keys, model.PublicKeyAccountIndexer{
-				PublicKey: "blank",
-				Account:   utils.Add0xPrefix(addrStr),
-				Weight:    0,
-				KeyId:     0,
-				IsRevoked: false,
-			})
-		} else {
-			for _, key := range acct.Keys {
-				// Clean up the public key, remove the 0x prefix
-				keys = append(keys, model.PublicKeyAccountIndexer{
-					PublicKey: utils.Strip0xPrefix(key.PublicKey.String()),
-					Account:   utils.Add0xPrefix(addrStr),
-					Weight:    key.Weight,
-					KeyId:     int(key.Index),
-					IsRevoked: key.Revoked,
-					SigAlgo:   GetSignatureAlgoIndex(key.SigAlgo.String()),
-					HashAlgo:  GetHashingAlgoIndex(key.HashAlgo.String()),
-				})
-			}
-		}
+	if err != nil {
+		log.Warn().Err(err).Msgf("Batch Failed to get account, %v", addrStr)
+		record.Status = model.AccountStatusError
+		record.LastError = err.Error()
+		return keys, record
+	}
+	if acct == nil {
+		log.Warn().Msgf("Batch Account not found: %v", addrStr)
+		record.Status = model.AccountStatusError
+		record.LastError = "account not found"
+		return keys, record
+	}
+	if acct.Keys == nil {
+		log.Warn().Msgf("Batch Account has nil Keys: %v", addrStr)
+		record.Status = model.AccountStatusError
+		record.LastError = "account has nil keys"
+		return keys, record
+	}
+	record.KeyCount = len(acct.Keys)
+	if len(acct.Keys) == 0 {
+		log.Warn().Msgf("Batch Account has no keys: %v", addrStr)
+		// Register the account as keyless to avoid querying it again
+		record.Status = model.AccountStatusKeyless
+		return keys, record
 	}
 
-	log.Debug().Msgf("adding public keys: %v", keys)
-	log.Debug().Msgf("Batch API Processed %v keys of %v addresses", len(keys), len(accountAddresses))
-	// Send the keys to the results channel
-	err := insertHandler(ctx, keys)
-	if err != nil {
-		log.Error().Err(err).Msgf("Batch API Failed save keys, %v sending to DB channel instead", len(keys))
-		resultsChan <- keys
-	} else {
-		log.Info().Msgf("Batch API Saved %v keys of %v addresses", len(keys), len(accountAddresses))
+	record.Status = model.AccountStatusOK
+	for _, key := range acct.Keys {
+		// Clean up the public key, remove the 0x prefix
+		keys = append(keys, model.PublicKeyAccountIndexer{
+			PublicKey:     utils.Strip0xPrefix(key.PublicKey.String()),
+			Account:       utils.Add0xPrefix(addrStr),
+			Weight:        key.Weight,
+			KeyId:         int(key.Index),
+			IsRevoked:     key.Revoked,
+			SigAlgo:       GetSignatureAlgoIndex(key.SigAlgo.String()),
+			HashAlgo:      GetHashingAlgoIndex(key.HashAlgo.String()),
+			UpdatedHeight: height,
+		})
 	}
+	return keys, record
+}
 
+// getAccountAt reads the account at the given height so the keys match the
+// height recorded with them, or at the latest block when the height is unknown.
+func getAccountAt(ctx context.Context, client access.Client, addr flow.Address, height uint64) (*flow.Account, error) {
+	return retryCall(ctx, defaultRetryPolicy, "Account", func(ctx context.Context) (*flow.Account, error) {
+		if height == 0 {
+			return client.GetAccount(ctx, addr)
+		}
+		return client.GetAccountAtBlockHeight(ctx, addr, height)
+	})
 }
 
 func GetHashingAlgoIndex(hashAlgo string) int {
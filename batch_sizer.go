@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/onflow/flow-go-sdk"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// growAfterSuccesses is the number of full size batches in a row that have to
+// succeed before the batch size is increased again
+const growAfterSuccesses = 5
+
+// batchSizer learns how many addresses a node can handle in one script call.
+// Batches that are too large for the node shrink it, sustained success grows it
+// back up to max.
+type batchSizer struct {
+	mu        sync.Mutex
+	size      int
+	max       int
+	successes int
+}
+
+func newBatchSizer(initial int, max int) *batchSizer {
+	if max < 1 {
+		max = 1
+	}
+	if initial < 1 || initial > max {
+		initial = max
+	}
+	return &batchSizer{size: initial, max: max}
+}
+
+// Size returns the number of addresses to send in the next script call.
+func (b *batchSizer) Size() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.size
+}
+
+// Succeeded records a batch of n addresses that ran without errors.
+func (b *batchSizer) Succeeded(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n < b.size {
+		return
+	}
+	b.successes++
+	if b.successes >= growAfterSuccesses && b.size < b.max {
+		b.size += b.size/4 + 1
+		if b.size > b.max {
+			b.size = b.max
+		}
+		b.successes = 0
+	}
+}
+
+// Failed records a batch of n addresses that failed. Only errors caused by the
+// size of the batch shrink it, reports whether err was one of those.
+func (b *batchSizer) Failed(n int, err error) bool {
+	if !isBatchTooLarge(err) {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.successes = 0
+	if half := n / 2; half < b.size {
+		b.size = half
+	}
+	if b.size < 1 {
+		b.size = 1
+	}
+	return true
+}
+
+// isBatchTooLarge tells errors caused by too many addresses in one script call
+// apart from errors caused by the node or by a single account.
+func isBatchTooLarge(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	switch status.Code(err) {
+	case codes.DeadlineExceeded:
+		return true
+	case codes.ResourceExhausted:
+		// rate limits are ResourceExhausted as well, only the message size is about the batch
+		return strings.Contains(msg, "larger than max")
+	}
+	return strings.Contains(msg, "deadlineexceeded") ||
+		strings.Contains(msg, "computation exceeds limit") ||
+		strings.Contains(msg, "computation limit")
+}
+
+// isAccountError tells script errors caused by one of the accounts of the
+// batch, splitting the batch isolates the account.
+func isAccountError(err error) bool {
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.NotFound:
+		return true
+	default:
+		return false
+	}
+}
+
+// splitBatches runs addresses through run in batches of the learned size.
+// A batch failing for its size or one of its accounts is bisected until the
+// failing addresses are isolated, they are reported to failed one by one. Any
+// other error, a node outage or a database error, would fail every half the
+// same way: splitBatches stops and returns it with the addresses not
+// processed.
+func splitBatches(
+	ctx context.Context,
+	sizer *batchSizer,
+	addresses []flow.Address,
+	run func([]flow.Address) error,
+	failed func(flow.Address, error),
+) ([]flow.Address, error) {
+	for len(addresses) > 0 {
+		n := sizer.Size()
+		if n > len(addresses) {
+			n = len(addresses)
+		}
+		if rest, err := bisectBatch(ctx, sizer, addresses[:n], run, failed); err != nil {
+			return append(rest, addresses[n:]...), err
+		}
+		addresses = addresses[n:]
+	}
+	return nil, nil
+}
+
+// bisectBatch runs a batch, splitting it on errors about its size or its
+// accounts. It returns the addresses not processed when another error stopped it.
+func bisectBatch(
+	ctx context.Context,
+	sizer *batchSizer,
+	batch []flow.Address,
+	run func([]flow.Address) error,
+	failed func(flow.Address, error),
+) ([]flow.Address, error) {
+	if err := ctx.Err(); err != nil {
+		return batch, err
+	}
+	err := run(batch)
+	if err == nil {
+		sizer.Succeeded(len(batch))
+		return nil, nil
+	}
+	if !isBatchTooLarge(err) && !isAccountError(err) {
+		return batch, err
+	}
+	if len(batch) == 1 {
+		failed(batch[0], err)
+		return nil, nil
+	}
+	sizer.Failed(len(batch), err)
+
+	half := len(batch) / 2
+	if rest, err := bisectBatch(ctx, sizer, batch[:half], run, failed); err != nil {
+		return append(append([]flow.Address{}, rest...), batch[half:]...), err
+	}
+	return bisectBatch(ctx, sizer, batch[half:], run, failed)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/onflow/flow-go-sdk"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func testAddresses(n int) []flow.Address {
+	addresses := make([]flow.Address, n)
+	for i := range addresses {
+		addresses[i] = flow.HexToAddress(fmt.Sprintf("%x", i+1))
+	}
+	return addresses
+}
+
+func TestSplitBatchesLearnsNodeSize(t *testing.T) {
+	// the node can only handle 10 addresses per script call
+	tooLarge := status.Error(codes.DeadlineExceeded, "script ran too long")
+	run := func(batch []flow.Address) error {
+		if len(batch) > 10 {
+			return tooLarge
+		}
+		return nil
+	}
+
+	var failed []flow.Address
+	sizer := newBatchSizer(64, 64)
+	splitBatches(context.Background(), sizer, testAddresses(100), run, func(addr flow.Address, _ error) {
+		failed = append(failed, addr)
+	})
+
+	if len(failed) != 0 {
+		t.Fatalf("Expected no failed addresses, got %d", len(failed))
+	}
+	if size := sizer.Size(); size > 10 || size < 5 {
+		t.Errorf("Expected the learned size to be between 5 and 10, got %d", size)
+	}
+}
+
+func TestSplitBatchesIsolatesFailingAddress(t *testing.T) {
+	addresses := testAddresses(20)
+	broken := addresses[13]
+	accountErr := status.Error(codes.InvalidArgument, "cannot get account keys")
+
+	processed := map[flow.Address]bool{}
+	run := func(batch []flow.Address) error {
+		for _, addr := range batch {
+			if addr == broken {
+				return accountErr
+			}
+		}
+		for _, addr := range batch {
+			processed[addr] = true
+		}
+		return nil
+	}
+
+	var failed []flow.Address
+	sizer := newBatchSizer(20, 20)
+	rest, err := splitBatches(context.Background(), sizer, addresses, run, func(addr flow.Address, err error) {
+		if !errors.Is(err, accountErr) {
+			t.Errorf("Unexpected error for %v: %v", addr, err)
+		}
+		failed = append(failed, addr)
+	})
+
+	if err != nil || len(rest) != 0 {
+		t.Fatalf("Expected every address to be processed, got %v for %d addresses", err, len(rest))
+	}
+	if len(failed) != 1 || failed[0] != broken {
+		t.Fatalf("Expected only %v to fail, got %v", broken, failed)
+	}
+	if len(processed) != len(addresses)-1 {
+		t.Errorf("Expected %d processed addresses, got %d", len(addresses)-1, len(processed))
+	}
+	if size := sizer.Size(); size != 20 {
+		t.Errorf("Expected errors of a single account to keep the batch size, got %d", size)
+	}
+}
+
+func TestSplitBatchesStopsOnNodeError(t *testing.T) {
+	addresses := testAddresses(20)
+	outage := status.Error(codes.Unavailable, "connection refused")
+
+	calls := 0
+	run := func(batch []flow.Address) error {
+		calls++
+		if calls > 1 {
+			return outage
+		}
+		return nil
+	}
+
+	sizer := newBatchSizer(5, 5)
+	rest, err := splitBatches(context.Background(), sizer, addresses, run, func(addr flow.Address, err error) {
+		t.Errorf("Expected no address to fail on its own, got %v", addr)
+	})
+
+	if !errors.Is(err, outage) {
+		t.Fatalf("Expected the outage to be returned, got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("Expected the failing batch not to be split, got %d calls", calls)
+	}
+	if len(rest) != 15 || rest[0] != addresses[5] || rest[14] != addresses[19] {
+		t.Errorf("Expected the 15 addresses after the first batch back, got %v", rest)
+	}
+}
+
+func TestBatchSizerGrowsAfterSuccess(t *testing.T) {
+	sizer := newBatchSizer(100, 1000)
+	sizer.Failed(100, status.Error(codes.DeadlineExceeded, "timeout"))
+	if size := sizer.Size(); size != 50 {
+		t.Fatalf("Expected size 50 after a deadline, got %d", size)
+	}
+
+	sizer.Failed(50, status.Error(codes.ResourceExhausted, "rate limit reached"))
+	if size := sizer.Size(); size != 50 {
+		t.Fatalf("Expected rate limits to keep the size, got %d", size)
+	}
+
+	for i := 0; i < growAfterSuccesses; i++ {
+		sizer.Succeeded(50)
+	}
+	if size := sizer.Size(); size <= 50 {
+		t.Errorf("Expected the size to grow after %d successes, got %d", growAfterSuccesses, size)
+	}
+
+	for i := 0; i < 100*growAfterSuccesses; i++ {
+		sizer.Succeeded(sizer.Size())
+	}
+	if size := sizer.Size(); size != 1000 {
+		t.Errorf("Expected the size to be capped at 1000, got %d", size)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"example/flow-key-indexer/model"
+	"example/flow-key-indexer/pkg/config"
+	"example/flow-key-indexer/pkg/pg"
+
+	"github.com/onflow/crypto"
+	"github.com/onflow/flow-go-sdk"
+	"github.com/onflow/flow-go/ledger/common/convert"
+	"github.com/onflow/flow-go/ledger/complete/wal"
+	flowgo "github.com/onflow/flow-go/model/flow"
+	"github.com/rs/zerolog/log"
+)
+
+// checkpointSigAlgos maps the signing algorithms of the execution state to
+// the Cadence raw values stored in publickeyindexer, hashing algorithms
+// have the same values in both.
+var checkpointSigAlgos = map[crypto.SigningAlgorithm]int{
+	crypto.ECDSAP256:      1,
+	crypto.ECDSASecp256k1: 2,
+	crypto.BLSBLS12381:    3,
+}
+
+// checkpointKey converts a register of an execution state checkpoint to a
+// key row read at height, ok is false for registers that hold no account key.
+func checkpointKey(register flowgo.RegisterID, value []byte, height uint64) (key model.PublicKeyAccountIndexer, ok bool, err error) {
+	if register.Owner == "" || !strings.HasPrefix(register.Key, flowgo.PublicKeyKeyPrefix) {
+		return key, false, nil
+	}
+	index, err := strconv.ParseUint(strings.TrimPrefix(register.Key, flowgo.PublicKeyKeyPrefix), 10, 32)
+	if err != nil {
+		return key, false, fmt.Errorf("invalid key register %q", register.Key)
+	}
+	address := flowgo.BytesToAddress([]byte(register.Owner))
+	publicKey, err := flowgo.DecodeAccountPublicKey(value, uint32(index))
+	if err != nil {
+		return key, false, fmt.Errorf("could not decode key %d of %s: %w", index, address.HexWithPrefix(), err)
+	}
+	sigAlgo, known := checkpointSigAlgos[publicKey.SignAlgo]
+	if !known {
+		return key, false, fmt.Errorf("unknown signing algorithm %v of key %d of %s", publicKey.SignAlgo, index, address.HexWithPrefix())
+	}
+
+	return model.PublicKeyAccountIndexer{
+		Account:       address.HexWithPrefix(),
+		KeyId:         int(index),
+		PublicKey:     hex.EncodeToString(publicKey.PublicKey.Encode()),
+		Weight:        publicKey.Weight,
+		SigAlgo:       sigAlgo,
+		HashAlgo:      int(publicKey.HashAlgo),
+		IsRevoked:     publicKey.Revoked,
+		UpdatedHeight: height,
+	}, true, nil
+}
+
+// readCheckpointKeys passes every account key of a single trie V6 checkpoint
+// to each as read at height and returns the number of keys it could not decode.
+func readCheckpointKeys(path string, height uint64, each func(model.PublicKeyAccountIndexer) error) (int, error) {
+	dir, fileName := filepath.Split(path)
+	rootHashes, err := wal.ReadTriesRootHash(log.Logger, dir, fileName)
+	if err != nil {
+		return 0, err
+	}
+	if len(rootHashes) != 1 {
+		return 0, fmt.Errorf("checkpoint has %d tries, expected one", len(rootHashes))
+	}
+
+	leaves := make(chan *wal.LeafNode, importBatchSize)
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- wal.OpenAndReadLeafNodesFromCheckpointV6(leaves, dir, fileName, rootHashes[0], log.Logger)
+	}()
+	// the reader cannot be cancelled, drain the leaves left after an error so
+	// it finishes instead of blocking on the channel forever
+	defer func() {
+		for range leaves {
+		}
+	}()
+	var broken int
+	for leaf := range leaves {
+		ledgerKey, err := leaf.Payload.Key()
+		if err != nil {
+			return broken, err
+		}
+		register, err := convert.LedgerKeyToRegisterID(ledgerKey)
+		if err != nil {
+			return broken, err
+		}
+		key, ok, err := checkpointKey(register, leaf.Payload.Value(), height)
+		if err != nil {
+			log.Warn().Err(err).Msg("Skipping account key")
+			broken++
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if err := each(key); err != nil {
+			return broken, err
+		}
+	}
+	return broken, <-readErr
+}
+
+// bootstrapFromCheckpoint copies every account key of a checkpoint into db
+// and moves the incremental cursor to height, the block the checkpoint was
+// taken at. Keys are filtered like the bulk script does.
+func bootstrapFromCheckpoint(ctx context.Context, db *pg.Store, params config.Params, path string, height uint64) (int, error) {
+	var count, skipped int
+	chainID := flow.ChainID(params.ChainId)
+	batch := make([]model.PublicKeyAccountIndexer, 0, importBatchSize)
+	save := func() error {
+		if _, err := savePublicKeys(ctx, db, batch); err != nil {
+			return err
+		}
+		count += len(batch)
+		batch = batch[:0]
+		log.Info().Msgf("Bootstrapped %d keys", count)
+		return nil
+	}
+
+	broken, err := readCheckpointKeys(path, height, func(key model.PublicKeyAccountIndexer) error {
+		if address := flow.HexToAddress(key.Account); !address.IsValid(chainID) {
+			return fmt.Errorf("account %s of the checkpoint is not on %s", key.Account, params.ChainId)
+		}
+		if (params.IgnoreZeroWeight && key.Weight == 0) || (params.IgnoreRevoked && key.IsRevoked) {
+			skipped++
+			return nil
+		}
+		batch = append(batch, key)
+		if len(batch) < importBatchSize {
+			return nil
+		}
+		return save()
+	})
+	if err == nil && len(batch) > 0 {
+		err = save()
+	}
+	if err != nil {
+		return count, err
+	}
+	log.Info().Msgf("Bootstrapped %d keys, skipped %d zero weight or revoked and %d undecodable keys", count, skipped, broken)
+
+	if err := db.UpdateLoadedBlockHeight(height); err != nil {
+		return count, err
+	}
+	db.UpdateDistinctCount()
+	return count, nil
+}
+
+// bootstrapFromCheckpointCommand handles the bootstrap-from-checkpoint
+// subcommand, it loads the keys of an execution state checkpoint on disk
+// without contacting an access node.
+func bootstrapFromCheckpointCommand(flags *flag.FlagSet) func(config.Params, []string) error {
+	height := flags.Uint64("height", 0, "block height the checkpoint was taken at")
+	return func(p config.Params, args []string) error {
+		if len(args) != 1 || *height == 0 {
+			return errors.New("usage: bootstrap-from-checkpoint -height <block height> <checkpoint file>")
+		}
+		return runBootstrapFromCheckpoint(p, args[0], *height)
+	}
+}
+
+func runBootstrapFromCheckpoint(p config.Params, path string, height uint64) error {
+	db := pg.NewStore(p.PostgresConfig(), log.Logger)
+	if err := db.Start(false); err != nil {
+		return err
+	}
+	count, err := bootstrapFromCheckpoint(context.Background(), db, p, path, height)
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("Loaded %d keys, the incremental loader resumes from block %d", count, height)
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"example/flow-key-indexer/model"
+	"fmt"
+	"testing"
+
+	"github.com/onflow/crypto"
+	"github.com/onflow/crypto/hash"
+	"github.com/onflow/flow-go/ledger"
+	"github.com/onflow/flow-go/ledger/common/convert"
+	"github.com/onflow/flow-go/ledger/common/pathfinder"
+	"github.com/onflow/flow-go/ledger/complete/mtrie/trie"
+	"github.com/onflow/flow-go/ledger/complete/wal"
+	flowgo "github.com/onflow/flow-go/model/flow"
+	"github.com/rs/zerolog"
+)
+
+func TestReadCheckpointKeys(t *testing.T) {
+	seed := make([]byte, crypto.KeyGenSeedMinLen)
+	privateKey, err := crypto.GeneratePrivateKey(crypto.ECDSASecp256k1, seed)
+	if err != nil {
+		t.Fatalf("Failed to generate a key: %v", err)
+	}
+	publicKey := privateKey.PublicKey()
+	value, err := flowgo.EncodeAccountPublicKey(flowgo.AccountPublicKey{
+		PublicKey: publicKey,
+		SignAlgo:  crypto.ECDSASecp256k1,
+		HashAlgo:  hash.Keccak_256,
+		Weight:    500,
+		Revoked:   true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode the key: %v", err)
+	}
+
+	address := flowgo.HexToAddress("0x0000000000000c01")
+	registers := map[flowgo.RegisterID][]byte{
+		flowgo.PublicKeyRegisterID(address, 3):  value,
+		flowgo.AccountStatusRegisterID(address): {0, 0, 0},
+		flowgo.PublicKeyRegisterID(address, 4):  []byte("not a key"),
+		flowgo.UUIDRegisterID(0):                {1},
+	}
+	// the leaf reader only reads the 16 subtries of a checkpoint, filler registers
+	// keep the key registers from being stored above them
+	for i := 0; i < 1000; i++ {
+		registers[flowgo.NewRegisterID(address, fmt.Sprintf("filler_%d", i))] = []byte{1}
+	}
+	var paths []ledger.Path
+	var payloads []ledger.Payload
+	for register, value := range registers {
+		key := convert.RegisterIDToLedgerKey(register)
+		path, err := pathfinder.KeyToPath(key, 1)
+		if err != nil {
+			t.Fatalf("Failed to get the path of %v: %v", register, err)
+		}
+		paths = append(paths, path)
+		payloads = append(payloads, *ledger.NewPayload(key, value))
+	}
+	mtrie, _, err := trie.NewTrieWithUpdatedRegisters(trie.NewEmptyMTrie(), paths, payloads, true)
+	if err != nil {
+		t.Fatalf("Failed to build the trie: %v", err)
+	}
+	dir := t.TempDir()
+	if err := wal.StoreCheckpointV6SingleThread([]*trie.MTrie{mtrie}, dir, "checkpoint.00000001", zerolog.Nop()); err != nil {
+		t.Fatalf("Failed to store the checkpoint: %v", err)
+	}
+
+	var keys []model.PublicKeyAccountIndexer
+	broken, err := readCheckpointKeys(dir+"/checkpoint.00000001", 1234, func(key model.PublicKeyAccountIndexer) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to read the checkpoint: %v", err)
+	}
+	want := model.PublicKeyAccountIndexer{
+		Account:       "0x0000000000000c01",
+		KeyId:         3,
+		PublicKey:     hex.EncodeToString(publicKey.Encode()),
+		Weight:        500,
+		SigAlgo:       2,
+		HashAlgo:      6,
+		IsRevoked:     true,
+		UpdatedHeight: 1234,
+	}
+	if broken != 1 || len(keys) != 1 || keys[0] != want {
+		t.Errorf("Expected %+v and one broken key, got %+v, %d broken", want, keys, broken)
+	}
+
+	stop := errors.New("stop")
+	_, err = readCheckpointKeys(dir+"/checkpoint.00000001", 1234, func(model.PublicKeyAccountIndexer) error {
+		return stop
+	})
+	if !errors.Is(err, stop) {
+		t.Errorf("Expected the error of the callback, got %v", err)
+	}
+}
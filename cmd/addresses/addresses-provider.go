@@ -107,8 +107,24 @@ func (p *AddressProvider) initLastAddress(ctx context.Context, startIndex uint)
 		return false, err
 	}
 
-	// We assume address #2 exists
-	lastAddressIndex, err := p.getLastAddress(startIndex, startIndex*2, false, addressExistsAtIndex)
+	// the search needs an existing lower bound, on a chain with fewer accounts
+	// than startIndex it searches below it from the service account at index 1
+	lowerIndex, upperIndex := startIndex, startIndex*2
+	startExists, err := addressExistsAtIndex(startIndex)
+	if err != nil {
+		return 0, err
+	}
+	if !startExists {
+		p.log.Info().Msgf("No account at index %d, searching below it", startIndex)
+		lowerIndex, upperIndex = 1, startIndex
+	}
+	upperExists := false
+	if startExists {
+		if upperExists, err = addressExistsAtIndex(upperIndex); err != nil {
+			return 0, err
+		}
+	}
+	lastAddressIndex, err := p.getLastAddress(lowerIndex, upperIndex, upperExists, addressExistsAtIndex)
 	if err != nil {
 		return 0, err
 	}
@@ -178,7 +194,7 @@ func (p *AddressProvider) getNextAddress() (address flow.Address, isOutOfBounds
 	address = p.indexToAddress(p.currentIndex)
 
 	// Give some progress information every so often
-	if p.currentIndex%(p.lastAddressIndex/10) == 0 {
+	if p.lastAddressIndex >= 10 && p.currentIndex%(p.lastAddressIndex/10) == 0 {
 		p.log.Debug().Msgf("Bulk Processed %v %% accounts", p.currentIndex/(p.lastAddressIndex/10)*10)
 	}
 
@@ -200,6 +216,7 @@ var brokenAddresses = map[flow.Address]struct{}{
 
 // GenerateAddresses generates individual addresses and sends them to the provided channel
 func (p *AddressProvider) GenerateAddresses(ctx context.Context, addressChan chan<- flow.Address) {
+	defer close(addressChan)
 	for {
 		addr, oob := p.getNextAddress()
 		if oob {
@@ -217,11 +234,11 @@ func (p *AddressProvider) GenerateAddresses(ctx context.Context, addressChan cha
 			// Address sent successfully
 		}
 	}
-	close(addressChan)
 }
 
 // GenerateAddressBatches generates batches of addresses and sends them to the provided channel
 func (p *AddressProvider) GenerateAddressBatches(ctx context.Context, addressChan chan<- []flow.Address, batchSize int) {
+	defer close(addressChan)
 	batchChan := make(chan flow.Address, batchSize)
 	go p.GenerateAddresses(ctx, batchChan)
 
@@ -239,7 +256,9 @@ func (p *AddressProvider) GenerateAddressBatches(ctx context.Context, addressCha
 	}
 
 	if len(batch) > 0 {
-		addressChan <- batch
+		select {
+		case <-ctx.Done():
+		case addressChan <- batch:
+		}
 	}
-	close(addressChan)
 }
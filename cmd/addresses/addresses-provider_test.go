@@ -0,0 +1,59 @@
+package addresses
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/onflow/cadence"
+	"github.com/onflow/flow-go-sdk"
+	"github.com/onflow/flow-go-sdk/access"
+	"github.com/rs/zerolog"
+)
+
+// chainClient serves a chain whose accounts are the first count addresses
+type chainClient struct {
+	access.Client
+	accounts map[flow.Address]bool
+}
+
+func newChainClient(chain flow.ChainID, count uint) chainClient {
+	generator := flow.NewAddressGenerator(chain)
+	accounts := make(map[flow.Address]bool, count)
+	for i := uint(1); i <= count; i++ {
+		generator.SetIndex(i)
+		accounts[generator.Address()] = true
+	}
+	return chainClient{accounts: accounts}
+}
+
+func (c chainClient) ExecuteScriptAtLatestBlock(ctx context.Context, script []byte, arguments []cadence.Value) (cadence.Value, error) {
+	if !c.accounts[flow.Address(arguments[0].(cadence.Address))] {
+		return nil, errors.New(endOfAccountsError)
+	}
+	return cadence.NewUInt64(100), nil
+}
+
+func TestNewAddressProviderFindsLastAccount(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		count      uint
+		startIndex uint
+	}{
+		{"below the start index", 37, 3000000},
+		{"above the start index", 7000, 1000},
+		{"beyond twice the start index", 9000, 1000},
+		{"at the start index", 1000, 1000},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newChainClient(flow.Emulator, tc.count)
+			provider, err := NewAddressProvider(context.Background(), zerolog.Nop(), flow.Emulator, client, 0, tc.startIndex)
+			if err != nil {
+				t.Fatalf("Failed to find the last account: %v", err)
+			}
+			if provider.lastAddressIndex != tc.count {
+				t.Errorf("Expected the last account at %d, got %d", tc.count, provider.lastAddressIndex)
+			}
+		})
+	}
+}
@@ -22,9 +22,9 @@ import (
 	"context"
 	_ "embed"
 	"example/flow-key-indexer/model"
+	"example/flow-key-indexer/pkg/config"
 	"example/flow-key-indexer/pkg/pg"
-	"strings"
-	"time"
+	"fmt"
 
 	"github.com/onflow/cadence"
 	"github.com/onflow/flow-go-sdk"
@@ -46,12 +46,12 @@ type PublicKey struct {
 
 type DataLoader struct {
 	DB             pg.Store
-	config         Params
+	config         config.Params
 	fa             FlowAdapter
 	incAddressChan [][]flow.Address
 }
 
-func NewDataLoader(DB pg.Store, fa FlowAdapter, p Params) *DataLoader {
+func NewDataLoader(DB pg.Store, fa FlowAdapter, p config.Params) *DataLoader {
 	s := DataLoader{}
 	s.incAddressChan = [][]flow.Address{}
 	s.DB = DB
@@ -63,29 +63,82 @@ func NewDataLoader(DB pg.Store, fa FlowAdapter, p Params) *DataLoader {
 //go:embed cadence/get_keys.cdc
 var GetAccountKeys string
 
+//go:embed cadence/get_keys_range.cdc
+var GetAccountKeysRange string
+
+// scriptAccount is the per account summary returned next to the keys by the scripts
+type scriptAccount struct {
+	// KeyCount is the number of keys on the account, indexed or not
+	KeyCount int
+	// NextKeyIndex is the first key index the script did not read
+	NextKeyIndex int
+	// Truncated is set when the key cap stopped the script before the last key
+	Truncated bool
+}
+
+// scriptResult is the outcome of running one of the key scripts on a batch of accounts
+type scriptResult struct {
+	Keys     []model.PublicKeyAccountIndexer
+	Accounts map[flow.Address]scriptAccount
+	Height   uint64
+}
+
 func ProcessAddressWithScript(
 	ctx context.Context,
-	conf Params,
+	conf config.Params,
 	addresses []flow.Address,
 	log zerolog.Logger,
 	flowClient access.Client,
-	fetchSlowDown int,
-) ([]model.PublicKeyAccountIndexer, error) {
+) (scriptResult, error) {
 	script := []byte(GetAccountKeys)
 	accountsCadenceValues := convertAddresses(addresses)
 	arguments := []cadence.Value{cadence.NewArray(accountsCadenceValues), cadence.NewInt(conf.MaxAcctKeys), cadence.NewBool(conf.IgnoreZeroWeight), cadence.NewBool(conf.IgnoreRevoked)}
-	result, err := retryScriptUntilSuccess(ctx, log, script, arguments, flowClient, time.Duration(fetchSlowDown)*time.Millisecond)
+	return runKeysScript(ctx, log, script, arguments, flowClient)
+}
+
+// ProcessAddressKeyRange reads the keys with index startIndex up to endIndex of
+// one account, used to page through accounts truncated by MaxAcctKeys.
+func ProcessAddressKeyRange(
+	ctx context.Context,
+	conf config.Params,
+	address flow.Address,
+	startIndex int,
+	endIndex int,
+	log zerolog.Logger,
+	flowClient access.Client,
+) (scriptResult, error) {
+	script := []byte(GetAccountKeysRange)
+	arguments := []cadence.Value{cadence.NewAddress(address), cadence.NewInt(startIndex), cadence.NewInt(endIndex), cadence.NewBool(conf.IgnoreZeroWeight), cadence.NewBool(conf.IgnoreRevoked)}
+	return runKeysScript(ctx, log, script, arguments, flowClient)
+}
+
+func runKeysScript(
+	ctx context.Context,
+	log zerolog.Logger,
+	script []byte,
+	arguments []cadence.Value,
+	flowClient access.Client,
+) (scriptResult, error) {
+	// pin the script to a sealed height so the keys and the recorded height match
+	height := getSealedHeight(ctx, flowClient)
+	if height == 0 {
+		return scriptResult{}, fmt.Errorf("could not get a sealed block height to run the script at")
+	}
+	result, err := retryScriptUntilSuccess(ctx, script, arguments, height, flowClient)
 
 	if err != nil {
 		log.Error().Err(err).Msg("Script: Failed to get account keys")
-		return nil, err
+		return scriptResult{Height: height}, err
 	}
 
-	keys, err := getAccountKeysFromCadence(result)
+	keys, accounts, err := getAccountKeysFromCadence(result)
 	if err != nil {
 		log.Error().Err(err).Msg("Script: Failed to get account keys")
 	}
-	return keys, err
+	for i := range keys {
+		keys[i].UpdatedHeight = height
+	}
+	return scriptResult{Keys: keys, Accounts: accounts, Height: height}, err
 }
 
 func convertAddresses(addresses []flow.Address) []cadence.Value {
@@ -96,24 +149,52 @@ func convertAddresses(addresses []flow.Address) []cadence.Value {
 	return accounts
 }
 
-func (s *DataLoader) RunIncAddressesLoader(addressChan chan []flow.Address, blockHeight uint64, endBlockHeight uint64) (uint64, error) {
-	accountAddresses, synchedBlockHeight, err := s.fa.GetAddressesFromBlockEvents(s.config.AllFlowUrls, blockHeight, endBlockHeight)
+// RunIncAddressesLoader queues the accounts with key events in the block range.
+// The range only counts as loaded once the addresses are stored in the queue.
+func (s *DataLoader) RunIncAddressesLoader(blockHeight uint64, endBlockHeight uint64) (uint64, error) {
+	eventHeights, synchedBlockHeight, err := s.fa.GetAddressesFromBlockEvents(blockHeight, endBlockHeight)
 	if err != nil {
 		return blockHeight, err
 	}
 
-	if len(accountAddresses) > 0 {
-		addrs := uniqueToFlowAddress(accountAddresses)
-		log.Debug().Msgf("Inc addressChan: Before adding to channel, %d addresses, at %v", len(accountAddresses), synchedBlockHeight)
-
-		addressChan <- addrs
+	if len(eventHeights) > 0 {
+		addrs, err := s.skipRefreshedAccounts(eventHeights)
+		if err != nil {
+			return blockHeight, err
+		}
+		if err := s.DB.EnqueueAddresses(context.Background(), queueAddresses(addrs), pg.PriorityEvent); err != nil {
+			return blockHeight, err
+		}
 
-		log.Debug().Msgf("Inc addressChan: After found %d addresses, at %v", len(accountAddresses), synchedBlockHeight)
+		log.Debug().Msgf("Inc queued %d addresses, %d already refreshed, at %v", len(addrs), len(eventHeights)-len(addrs), synchedBlockHeight)
 	}
 
 	return synchedBlockHeight, err
 }
 
+// skipRefreshedAccounts drops the accounts that were already read at or after
+// the height of their last key event, a backfill at that height has seen the change.
+func (s *DataLoader) skipRefreshedAccounts(eventHeights map[string]uint64) ([]flow.Address, error) {
+	addresses := make([]string, 0, len(eventHeights))
+	for address := range eventHeights {
+		addresses = append(addresses, address)
+	}
+	refreshed, err := s.DB.GetAccountRefreshHeights(addresses)
+	if err != nil {
+		return nil, err
+	}
+
+	list := []flow.Address{}
+	for address, eventHeight := range eventHeights {
+		flowAddress := flow.HexToAddress(address)
+		if height, ok := refreshed[flowAddress.HexWithPrefix()]; ok && height >= eventHeight {
+			continue
+		}
+		list = append(list, flowAddress)
+	}
+	return list, nil
+}
+
 func uniqueToFlowAddress(addresses []string) []flow.Address {
 	keys := make(map[string]bool)
 	list := []flow.Address{}
@@ -127,67 +208,29 @@ func uniqueToFlowAddress(addresses []string) []flow.Address {
 	return list
 }
 
-// retries running the cadence script until we get a successful response back,
-// returning an array, along with a boolean representing whether we can continue
-// or are finished processing.
+// retryScriptUntilSuccess runs the cadence script at the given height,
+// retrying with the shared access node retry policy.
 func retryScriptUntilSuccess(
 	ctx context.Context,
-	log zerolog.Logger,
 	script []byte,
 	arguments []cadence.Value,
+	height uint64,
 	flowClient access.Client,
-	pause time.Duration,
 ) (cadence.Value, error) {
-	var err error
-	var result cadence.Value
-	attempts := 0
-	maxAttemps := 5
-
-	for {
-		result, err = flowClient.ExecuteScriptAtLatestBlock(
-			ctx,
-			script,
-			arguments,
-		)
-
-		if err == nil {
-			break
-		}
-		attempts = attempts + 1
-		log.Error().Err(err).Msgf("Script: %d attempt, %v", attempts, arguments)
-
-		if attempts > maxAttemps || strings.Contains(err.Error(), "connection termination") {
-			// give up and don't retry
-			break
-		}
-
-		time.Sleep(pause)
-
-		if strings.Contains(err.Error(), "ResourceExhausted") {
-			// really slow down when node is ResourceExhausted
-			continue
-		}
-		if strings.Contains(err.Error(), "InvalidArgument") {
-			// really slow down when node is ResourceExhausted
-			continue
-		}
-		if strings.Contains(err.Error(), "DeadlineExceeded") {
-			// pass error back to caller, script ran too long
-			break
-		}
-	}
-
-	return result, err
+	return retryCall(ctx, defaultRetryPolicy, "Script", func(ctx context.Context) (cadence.Value, error) {
+		return flowClient.ExecuteScriptAtBlockHeight(ctx, height, script, arguments)
+	})
 }
 
-func getAccountKeysFromCadence(value cadence.Value) ([]model.PublicKeyAccountIndexer, error) {
+func getAccountKeysFromCadence(value cadence.Value) ([]model.PublicKeyAccountIndexer, map[flow.Address]scriptAccount, error) {
 	allAccountsKeys := []model.PublicKeyAccountIndexer{}
+	accounts := map[flow.Address]scriptAccount{}
 
 	// Safe type assertion for the top-level dictionary
 	dict, ok := value.(cadence.Dictionary)
 	if !ok {
 		log.Warn().Msgf("Script result is not a Dictionary, got type: %T", value)
-		return allAccountsKeys, nil
+		return allAccountsKeys, accounts, nil
 	}
 
 	for _, allKeys := range dict.Pairs {
@@ -199,11 +242,27 @@ func getAccountKeysFromCadence(value cadence.Value) ([]model.PublicKeyAccountInd
 		accountAddress := address.String()
 		keys := []model.PublicKeyAccountIndexer{}
 
-		keysDict, keysOk := allKeys.Value.(cadence.Dictionary)
-		if !keysOk {
-			log.Warn().Msgf("Keys value for address %s is not a Dictionary, got type: %T", accountAddress, allKeys.Value)
+		accountStruct, accountOk := allKeys.Value.(cadence.Struct)
+		if !accountOk {
+			log.Warn().Msgf("Keys value for address %s is not a Struct, got type: %T", accountAddress, allKeys.Value)
 			continue
 		}
+		accountFields := accountStruct.FieldsMappedByName()
+
+		keysDict, keysOk := accountFields["keys"].(cadence.Dictionary)
+		keyCountVal, countOk := accountFields["keyCount"].(cadence.Int)
+		nextKeyIndexVal, nextOk := accountFields["nextKeyIndex"].(cadence.Int)
+		truncatedVal, truncatedOk := accountFields["truncated"].(cadence.Bool)
+		if !keysOk || !countOk || !nextOk || !truncatedOk {
+			log.Error().Msgf("Field type mismatch for address %s. Types: keys=%T, keyCount=%T, nextKeyIndex=%T, truncated=%T",
+				accountAddress, accountFields["keys"], accountFields["keyCount"], accountFields["nextKeyIndex"], accountFields["truncated"])
+			continue
+		}
+		accounts[flow.Address(address)] = scriptAccount{
+			KeyCount:     keyCountVal.Int(),
+			NextKeyIndex: nextKeyIndexVal.Int(),
+			Truncated:    bool(truncatedVal),
+		}
 
 		for _, nameCodePair := range keysDict.Pairs {
 			rawStruct, structOk := nameCodePair.Value.(cadence.Struct)
@@ -253,5 +312,5 @@ func getAccountKeysFromCadence(value cadence.Value) ([]model.PublicKeyAccountInd
 		allAccountsKeys = append(allAccountsKeys, keys...)
 	}
 
-	return allAccountsKeys, nil
+	return allAccountsKeys, accounts, nil
 }
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"example/flow-key-indexer/model"
+	"example/flow-key-indexer/pkg/config"
+	"example/flow-key-indexer/pkg/pg"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	snapshotCSV     = "csv"
+	snapshotNDJSON  = "ndjson"
+	snapshotParquet = "parquet"
+
+	snapshotFormatName = "keyindexer-snapshot"
+	snapshotVersion    = 2
+	// snapshotParquetKey is the Parquet key value metadata holding the header
+	snapshotParquetKey = "keyindexer.snapshot"
+	// parquetRowGroupSize is the number of keys buffered per Parquet row group
+	parquetRowGroupSize = 100000
+	parquetWriteBatch   = 1000
+)
+
+// snapshotContentTypes are the supported export formats and their media types
+var snapshotContentTypes = map[string]string{
+	snapshotCSV:     "text/csv",
+	snapshotNDJSON:  "application/x-ndjson",
+	snapshotParquet: "application/vnd.apache.parquet",
+}
+
+// snapshotHeader describes a snapshot. CSV snapshots start with it as a JSON
+// comment line, NDJSON snapshots as their first line and Parquet snapshots
+// keep it in the file metadata. PendingAccounts had key events up to Height
+// that were not fetched yet, version 1 snapshots do not list them.
+type snapshotHeader struct {
+	Format          string    `json:"format"`
+	Version         int       `json:"version"`
+	ChainID         string    `json:"chainId"`
+	Height          uint64    `json:"height"`
+	CreatedAt       time.Time `json:"createdAt"`
+	PendingAccounts []string  `json:"pendingAccounts,omitempty"`
+}
+
+// snapshotKey is one key row of a snapshot
+type snapshotKey struct {
+	Account       string `json:"account" parquet:"account"`
+	KeyId         int    `json:"keyId" parquet:"key_id"`
+	PublicKey     string `json:"publicKey" parquet:"public_key"`
+	Weight        int    `json:"weight" parquet:"weight"`
+	SigAlgo       int    `json:"sigAlgo" parquet:"sig_algo"`
+	HashAlgo      int    `json:"hashAlgo" parquet:"hash_algo"`
+	IsRevoked     bool   `json:"isRevoked" parquet:"is_revoked"`
+	UpdatedHeight uint64 `json:"updatedHeight" parquet:"updated_height"`
+	Fingerprint   string `json:"fingerprint" parquet:"fingerprint"`
+	EVMAddress    string `json:"evmAddress" parquet:"evm_address"`
+}
+
+// snapshotCSVColumns is the CSV header, in snapshotKey field order
+var snapshotCSVColumns = []string{"account", "keyId", "publicKey", "weight", "sigAlgo", "hashAlgo", "isRevoked", "updatedHeight", "fingerprint", "evmAddress"}
+
+func toSnapshotKey(pk model.PublicKeyAccountIndexer) snapshotKey {
+	return snapshotKey{
+		Account:       pk.Account,
+		KeyId:         pk.KeyId,
+		PublicKey:     pk.PublicKey,
+		Weight:        pk.Weight,
+		SigAlgo:       pk.SigAlgo,
+		HashAlgo:      pk.HashAlgo,
+		IsRevoked:     pk.IsRevoked,
+		UpdatedHeight: pk.UpdatedHeight,
+		Fingerprint:   pk.Fingerprint,
+		EVMAddress:    pk.EVMAddress,
+	}
+}
+
+type snapshotWriter interface {
+	Write(key snapshotKey) error
+	Close() error
+}
+
+func newSnapshotWriter(format string, w io.Writer, header snapshotHeader) (snapshotWriter, error) {
+	switch format {
+	case snapshotCSV:
+		return newCSVSnapshotWriter(w, header)
+	case snapshotNDJSON:
+		enc := json.NewEncoder(w)
+		return ndjsonSnapshotWriter{enc}, enc.Encode(header)
+	case snapshotParquet:
+		return newParquetSnapshotWriter(w, header)
+	default:
+		return nil, fmt.Errorf("unknown snapshot format %q, expected csv, ndjson or parquet", format)
+	}
+}
+
+type csvSnapshotWriter struct {
+	w *csv.Writer
+}
+
+func newCSVSnapshotWriter(w io.Writer, header snapshotHeader) (csvSnapshotWriter, error) {
+	meta, err := json.Marshal(header)
+	if err != nil {
+		return csvSnapshotWriter{}, err
+	}
+	if _, err := fmt.Fprintf(w, "# %s\n", meta); err != nil {
+		return csvSnapshotWriter{}, err
+	}
+	c := csvSnapshotWriter{csv.NewWriter(w)}
+	return c, c.w.Write(snapshotCSVColumns)
+}
+
+func (c csvSnapshotWriter) Write(key snapshotKey) error {
+	return c.w.Write([]string{
+		key.Account,
+		strconv.Itoa(key.KeyId),
+		key.PublicKey,
+		strconv.Itoa(key.Weight),
+		strconv.Itoa(key.SigAlgo),
+		strconv.Itoa(key.HashAlgo),
+		strconv.FormatBool(key.IsRevoked),
+		strconv.FormatUint(key.UpdatedHeight, 10),
+		key.Fingerprint,
+		key.EVMAddress,
+	})
+}
+
+func (c csvSnapshotWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type ndjsonSnapshotWriter struct {
+	enc *json.Encoder
+}
+
+func (n ndjsonSnapshotWriter) Write(key snapshotKey) error {
+	return n.enc.Encode(key)
+}
+
+func (n ndjsonSnapshotWriter) Close() error {
+	return nil
+}
+
+type parquetSnapshotWriter struct {
+	w     *parquet.GenericWriter[snapshotKey]
+	batch []snapshotKey
+}
+
+func newParquetSnapshotWriter(w io.Writer, header snapshotHeader) (*parquetSnapshotWriter, error) {
+	meta, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	return &parquetSnapshotWriter{
+		w: parquet.NewGenericWriter[snapshotKey](w,
+			parquet.KeyValueMetadata(snapshotParquetKey, string(meta)),
+			parquet.MaxRowsPerRowGroup(parquetRowGroupSize)),
+		batch: make([]snapshotKey, 0, parquetWriteBatch),
+	}, nil
+}
+
+func (p *parquetSnapshotWriter) Write(key snapshotKey) error {
+	p.batch = append(p.batch, key)
+	if len(p.batch) < cap(p.batch) {
+		return nil
+	}
+	return p.flush()
+}
+
+func (p *parquetSnapshotWriter) flush() error {
+	_, err := p.w.Write(p.batch)
+	p.batch = p.batch[:0]
+	return err
+}
+
+func (p *parquetSnapshotWriter) Close() error {
+	if err := p.flush(); err != nil {
+		return err
+	}
+	return p.w.Close()
+}
+
+// exportSnapshot writes the keys matching filter to w in format. started is
+// called with the snapshot height before anything is written.
+func exportSnapshot(ctx context.Context, db pg.Store, chainID string, format string, filter pg.ExportFilter, w io.Writer, started func(height uint64)) (int, error) {
+	if _, ok := snapshotContentTypes[format]; !ok {
+		return 0, fmt.Errorf("unknown snapshot format %q, expected csv, ndjson or parquet", format)
+	}
+	snapshot, err := db.OpenKeySnapshot(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	defer snapshot.Close()
+	started(snapshot.Height)
+
+	buf := bufio.NewWriter(w)
+	header := snapshotHeader{
+		Format:    snapshotFormatName,
+		Version:   snapshotVersion,
+		ChainID:   chainID,
+		Height:    snapshot.Height,
+		CreatedAt: time.Now().UTC(),
+
+		PendingAccounts: snapshot.Pending,
+	}
+	out, err := newSnapshotWriter(format, buf, header)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	for {
+		key, ok, err := snapshot.Next()
+		if err != nil {
+			return count, err
+		}
+		if !ok {
+			break
+		}
+		if err := out.Write(toSnapshotKey(key)); err != nil {
+			return count, err
+		}
+		count++
+	}
+	if err := out.Close(); err != nil {
+		return count, err
+	}
+	return count, buf.Flush()
+}
+
+// exportCommand handles the export subcommand, it writes a snapshot of the
+// index to a file or stdout.
+func exportCommand(flags *flag.FlagSet) func(config.Params, []string) error {
+	format := flags.String("format", snapshotCSV, "snapshot format: csv, ndjson or parquet")
+	out := flags.String("out", "-", "output file, - for stdout")
+	sigAlgo := flags.Int("sigalgo", 0, "only export keys with this signature algorithm")
+	since := flags.Uint64("since", 0, "only export keys read at or after this block height")
+	return func(p config.Params, args []string) error {
+		if len(args) > 0 {
+			return fmt.Errorf("unexpected arguments %v", args)
+		}
+		return runExport(p, *format, *out, pg.ExportFilter{SigAlgo: *sigAlgo, SinceHeight: *since})
+	}
+}
+
+func runExport(p config.Params, format string, out string, filter pg.ExportFilter) error {
+	db := pg.NewStore(p.PostgresConfig(), log.Logger)
+	if err := db.StartReadOnly(); err != nil {
+		return err
+	}
+
+	w := io.Writer(os.Stdout)
+	var f *os.File
+	if out != "-" {
+		var err error
+		if f, err = os.Create(out); err != nil {
+			return err
+		}
+		w = f
+	}
+
+	count, err := exportSnapshot(context.Background(), *db, p.ChainId, format, filter, w, func(height uint64) {
+		log.Info().Msgf("Exporting keys at block height %d", height)
+	})
+	if f != nil {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("Exported %d keys", count)
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"example/flow-key-indexer/model"
+	"example/flow-key-indexer/pkg/config"
+	"example/flow-key-indexer/pkg/pg"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+func TestSnapshotWriters(t *testing.T) {
+	header := snapshotHeader{Format: snapshotFormatName, Version: snapshotVersion, ChainID: "flow-testnet", Height: 42, CreatedAt: time.Unix(0, 0).UTC()}
+	keys := []snapshotKey{
+		{Account: "0x0000000000000f01", KeyId: 0, PublicKey: "f1f1", Weight: 1000, SigAlgo: 1, HashAlgo: 3, UpdatedHeight: 40, Fingerprint: "aa"},
+		{Account: "0x0000000000000f02", KeyId: 1, PublicKey: "f2f2", Weight: 500, SigAlgo: 2, HashAlgo: 1, IsRevoked: true, EVMAddress: "bb"},
+	}
+	write := func(format string) []byte {
+		var buf bytes.Buffer
+		w, err := newSnapshotWriter(format, &buf, header)
+		if err != nil {
+			t.Fatalf("Failed to create %s writer: %v", format, err)
+		}
+		for _, key := range keys {
+			if err := w.Write(key); err != nil {
+				t.Fatalf("Failed to write %s: %v", format, err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Failed to close %s writer: %v", format, err)
+		}
+		return buf.Bytes()
+	}
+
+	meta, _ := json.Marshal(header)
+	wantCSV := "# " + string(meta) + "\n" +
+		"account,keyId,publicKey,weight,sigAlgo,hashAlgo,isRevoked,updatedHeight,fingerprint,evmAddress\n" +
+		"0x0000000000000f01,0,f1f1,1000,1,3,false,40,aa,\n" +
+		"0x0000000000000f02,1,f2f2,500,2,1,true,0,,bb\n"
+	if got := string(write(snapshotCSV)); got != wantCSV {
+		t.Errorf("Unexpected CSV snapshot:\n%s", got)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(write(snapshotNDJSON))), "\n")
+	if len(lines) != 3 || lines[0] != string(meta) {
+		t.Fatalf("Unexpected NDJSON snapshot %v", lines)
+	}
+	var second snapshotKey
+	if err := json.Unmarshal([]byte(lines[2]), &second); err != nil || second != keys[1] {
+		t.Errorf("Unexpected NDJSON key %s, %v", lines[2], err)
+	}
+
+	data := write(snapshotParquet)
+	file, err := parquet.OpenFile(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("Failed to open the Parquet snapshot: %v", err)
+	}
+	if value, ok := file.Lookup(snapshotParquetKey); !ok || value != string(meta) {
+		t.Errorf("Unexpected Parquet metadata %q", value)
+	}
+	reader := parquet.NewGenericReader[snapshotKey](bytes.NewReader(data))
+	rows := make([]snapshotKey, 3)
+	n, err := reader.Read(rows)
+	if err != nil && err != io.EOF {
+		t.Fatalf("Failed to read the Parquet snapshot: %v", err)
+	}
+	if n != 2 || rows[0] != keys[0] || rows[1] != keys[1] {
+		t.Errorf("Unexpected Parquet rows %+v", rows[:n])
+	}
+
+	if _, err := newSnapshotWriter("xml", io.Discard, header); err == nil {
+		t.Errorf("Expected an unknown format error")
+	}
+}
+
+func TestExportSnapshot(t *testing.T) {
+	db := newTestStore(t)
+
+	ctx := context.Background()
+	keys := []model.PublicKeyAccountIndexer{
+		{Account: "0x0000000000000f01", KeyId: 0, PublicKey: "f1f1f1f1f1f1f1f1f1f1f1f1", Weight: 1000, SigAlgo: 1, HashAlgo: 3, UpdatedHeight: 100},
+		{Account: "0x0000000000000f02", KeyId: 0, PublicKey: "f2f2f2f2f2f2f2f2f2f2f2f2", Weight: 1000, SigAlgo: 2, HashAlgo: 3, UpdatedHeight: 100},
+		{Account: "0x0000000000000f03", KeyId: 0, PublicKey: "f3f3f3f3f3f3f3f3f3f3f3f3", Weight: 1000, SigAlgo: 2, HashAlgo: 3, UpdatedHeight: 200},
+	}
+	if _, err := savePublicKeys(ctx, db, keys); err != nil {
+		t.Fatalf("Failed to save keys: %v", err)
+	}
+	db.UpdateLoadedBlockHeight(250)
+	if err := db.EnqueueAddresses(ctx, []string{"0x0000000000000f04"}, pg.PriorityEvent); err != nil {
+		t.Fatalf("Failed to queue an address: %v", err)
+	}
+	if err := db.EnqueueAddresses(ctx, []string{"0x0000000000000f05"}, pg.PriorityBackfill); err != nil {
+		t.Fatalf("Failed to queue an address: %v", err)
+	}
+
+	var buf bytes.Buffer
+	var height uint64
+	filter := pg.ExportFilter{SigAlgo: 2, SinceHeight: 150}
+	count, err := exportSnapshot(ctx, *db, "flow-testnet", snapshotNDJSON, filter, &buf, func(h uint64) { height = h })
+	if err != nil {
+		t.Fatalf("Failed to export: %v", err)
+	}
+	if count != 1 || height != 250 {
+		t.Fatalf("Expected one key at height 250, got %d at %d", count, height)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	var header snapshotHeader
+	var key snapshotKey
+	if len(lines) != 2 || json.Unmarshal([]byte(lines[0]), &header) != nil || json.Unmarshal([]byte(lines[1]), &key) != nil {
+		t.Fatalf("Unexpected snapshot %v", lines)
+	}
+	if header.ChainID != "flow-testnet" || header.Height != 250 || key.Account != "0x0000000000000f03" || key.Fingerprint == "" {
+		t.Errorf("Unexpected snapshot %+v %+v", header, key)
+	}
+	if !slices.Contains(header.PendingAccounts, "0x0000000000000f04") || slices.Contains(header.PendingAccounts, "0x0000000000000f05") {
+		t.Errorf("Expected only the accounts waiting for their key events in the header, got %v", header.PendingAccounts)
+	}
+}
+
+func TestExportRequiresBearerToken(t *testing.T) {
+	rest := &Rest{config: config.Params{ExportToken: "secret"}}
+	for _, header := range []string{"", "secret", "Basic secret", "Bearer wrong", "bearer secret"} {
+		r := httptest.NewRequest(http.MethodGet, "/export", nil)
+		if header != "" {
+			r.Header.Set("Authorization", header)
+		}
+		w := httptest.NewRecorder()
+		rest.getExport(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected Authorization %q to be refused, got %d", header, w.Code)
+		}
+	}
+}
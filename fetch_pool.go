@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"example/flow-key-indexer/model"
+	"example/flow-key-indexer/pkg/pg"
+
+	"github.com/onflow/flow-go-sdk"
+	"github.com/onflow/flow-go-sdk/access"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// fetchFlushKeys is the number of keys collected before they are stored
+	fetchFlushKeys = 1000
+	// fetchFlushInterval is the longest collected keys wait to be stored
+	fetchFlushInterval = time.Second
+)
+
+type fetchResult struct {
+	keys    []model.PublicKeyAccountIndexer
+	account model.AccountRecord
+	claim   pg.QueuedAddress
+}
+
+// fetchState tracks an address from the moment it is queued until it is fetched
+type fetchState struct {
+	height uint64
+	// generation is the latest queue generation claimed for the address
+	generation int64
+	fetching   bool
+	// again is set when the address was submitted at a newer height while it was being fetched
+	again bool
+}
+
+// accountFetchPool fetches accounts with a fixed number of workers. Addresses
+// already queued or being fetched are not queued twice: submitting a queued
+// one again only moves the height it is read at forward, submitting one that
+// is being fetched at a newer height fetches it once more afterwards. Results
+// are stored in batches.
+type accountFetchPool struct {
+	log            zerolog.Logger
+	client         access.Client
+	jobs           chan flow.Address
+	results        chan fetchResult
+	insertHandler  func(context.Context, []model.PublicKeyAccountIndexer) error
+	accountHandler func(context.Context, []model.AccountRecord) error
+	doneHandler    func(context.Context, []pg.QueuedAddress) error
+	failHandler    func(context.Context, []pg.QueuedAddress, error) error
+
+	mu       sync.Mutex
+	inFlight map[flow.Address]*fetchState
+}
+
+func newAccountFetchPool(
+	ctx context.Context,
+	log zerolog.Logger,
+	client access.Client,
+	workers int,
+	queueSize int,
+	insertHandler func(context.Context, []model.PublicKeyAccountIndexer) error,
+	accountHandler func(context.Context, []model.AccountRecord) error,
+	doneHandler func(context.Context, []pg.QueuedAddress) error,
+	failHandler func(context.Context, []pg.QueuedAddress, error) error,
+) *accountFetchPool {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	p := &accountFetchPool{
+		log:            log,
+		client:         client,
+		jobs:           make(chan flow.Address, queueSize),
+		results:        make(chan fetchResult, workers),
+		insertHandler:  insertHandler,
+		accountHandler: accountHandler,
+		doneHandler:    doneHandler,
+		failHandler:    failHandler,
+		inFlight:       map[flow.Address]*fetchState{},
+	}
+	for i := 0; i < workers; i++ {
+		go p.work(ctx)
+	}
+	go p.collect(ctx)
+	return p
+}
+
+// Submit queues the claimed addresses to be read at the latest sealed
+// height. It blocks while the queue is full.
+func (p *accountFetchPool) Submit(ctx context.Context, claims []pg.QueuedAddress) {
+	height := getSealedHeight(ctx, p.client)
+	for _, claim := range claims {
+		addr := flow.HexToAddress(claim.Account)
+		if !p.claim(addr, height, claim.Generation) {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case p.jobs <- addr:
+		}
+	}
+}
+
+// claim records addr to be fetched at height for the queue generation,
+// reports whether it has to be queued.
+func (p *accountFetchPool) claim(addr flow.Address, height uint64, generation int64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	state, ok := p.inFlight[addr]
+	if !ok {
+		p.inFlight[addr] = &fetchState{height: height, generation: generation}
+		return true
+	}
+	if generation > state.generation {
+		state.generation = generation
+	}
+	if height > state.height {
+		state.height = height
+		state.again = state.fetching
+	}
+	return false
+}
+
+// start marks addr as being fetched and returns the height to read it at and
+// the queue claim the fetch completes.
+func (p *accountFetchPool) start(addr flow.Address) (uint64, pg.QueuedAddress) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	state := p.inFlight[addr]
+	state.fetching = true
+	return state.height, pg.QueuedAddress{Account: addr.HexWithPrefix(), Generation: state.generation}
+}
+
+// finish releases addr, reports whether it has to be fetched again.
+func (p *accountFetchPool) finish(addr flow.Address) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	state := p.inFlight[addr]
+	if state.again {
+		state.fetching, state.again = false, false
+		return true
+	}
+	delete(p.inFlight, addr)
+	return false
+}
+
+// QueueDepth returns the number of addresses queued or being fetched.
+func (p *accountFetchPool) QueueDepth() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.inFlight)
+}
+
+func (p *accountFetchPool) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case addr := <-p.jobs:
+			height, claim := p.start(addr)
+			keys, account := fetchAccount(ctx, p.log, p.client, addr, height)
+			if p.finish(addr) {
+				// queue from a goroutine, the workers must not block on a full queue
+				go func(addr flow.Address) {
+					select {
+					case <-ctx.Done():
+					case p.jobs <- addr:
+					}
+				}(addr)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case p.results <- fetchResult{keys: keys, account: account, claim: claim}:
+			}
+		}
+	}
+}
+
+// collect stores the fetched keys in batches. Addresses leave the queue once
+// their keys are committed, failed fetches stay queued with their error.
+func (p *accountFetchPool) collect(ctx context.Context) {
+	ticker := time.NewTicker(fetchFlushInterval)
+	defer ticker.Stop()
+
+	var keys []model.PublicKeyAccountIndexer
+	var accounts []model.AccountRecord
+	var claims []pg.QueuedAddress
+	flush := func() {
+		if len(accounts) == 0 {
+			return
+		}
+		var done []pg.QueuedAddress
+		failed := map[string][]pg.QueuedAddress{}
+		for i, account := range accounts {
+			if account.Status == model.AccountStatusError {
+				failed[account.LastError] = append(failed[account.LastError], claims[i])
+				continue
+			}
+			done = append(done, claims[i])
+		}
+
+		if len(keys) > 0 {
+			if err := p.insertHandler(ctx, keys); err != nil {
+				p.log.Error().Err(err).Msgf("Batch API Failed save keys, %v addresses stay queued", len(done))
+				failed[err.Error()] = append(failed[err.Error()], done...)
+				done = nil
+			} else {
+				p.log.Info().Msgf("Batch API Saved %v keys of %v addresses, %d queued", len(keys), len(accounts), p.QueueDepth())
+			}
+		}
+		if err := p.accountHandler(ctx, accounts); err != nil {
+			p.log.Error().Err(err).Msgf("Batch API Failed to record %v accounts", len(accounts))
+		}
+		if len(done) > 0 {
+			if err := p.doneHandler(ctx, done); err != nil {
+				p.log.Error().Err(err).Msgf("Batch API Failed to remove %v processed addresses", len(done))
+			}
+		}
+		for cause, addresses := range failed {
+			if err := p.failHandler(ctx, addresses, errors.New(cause)); err != nil {
+				p.log.Error().Err(err).Msgf("Batch API Failed to record %v failed addresses", len(addresses))
+			}
+		}
+		keys, accounts, claims = nil, nil, nil
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case r := <-p.results:
+			keys = append(keys, r.keys...)
+			accounts = append(accounts, r.account)
+			claims = append(claims, r.claim)
+			if len(keys) >= fetchFlushKeys {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"example/flow-key-indexer/model"
+	"example/flow-key-indexer/pkg/pg"
+
+	"github.com/onflow/flow-go-sdk"
+	"github.com/onflow/flow-go-sdk/access"
+	"github.com/rs/zerolog"
+)
+
+// fakeAccountClient serves keyless accounts slowly and tracks concurrent calls
+type fakeAccountClient struct {
+	access.Client
+	mu      sync.Mutex
+	fetched map[flow.Address]int
+	active  atomic.Int32
+	maxSeen atomic.Int32
+}
+
+func (c *fakeAccountClient) GetLatestBlockHeader(ctx context.Context, isSealed bool) (*flow.BlockHeader, error) {
+	return &flow.BlockHeader{Height: 100}, nil
+}
+
+func (c *fakeAccountClient) GetAccountAtBlockHeight(ctx context.Context, address flow.Address, height uint64) (*flow.Account, error) {
+	active := c.active.Add(1)
+	defer c.active.Add(-1)
+	for {
+		seen := c.maxSeen.Load()
+		if active <= seen || c.maxSeen.CompareAndSwap(seen, active) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	c.mu.Lock()
+	c.fetched[address]++
+	c.mu.Unlock()
+	return &flow.Account{Address: address, Keys: []*flow.AccountKey{}}, nil
+}
+
+func TestAccountFetchPool(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := &fakeAccountClient{fetched: map[flow.Address]int{}}
+	var mu sync.Mutex
+	var recorded []model.AccountRecord
+	accountHandler := func(ctx context.Context, accounts []model.AccountRecord) error {
+		mu.Lock()
+		defer mu.Unlock()
+		recorded = append(recorded, accounts...)
+		return nil
+	}
+	insertHandler := func(ctx context.Context, keys []model.PublicKeyAccountIndexer) error { return nil }
+	var done []pg.QueuedAddress
+	doneHandler := func(ctx context.Context, addresses []pg.QueuedAddress) error {
+		mu.Lock()
+		defer mu.Unlock()
+		done = append(done, addresses...)
+		return nil
+	}
+	failHandler := func(ctx context.Context, addresses []pg.QueuedAddress, err error) error {
+		t.Errorf("Unexpected failure of %v: %v", addresses, err)
+		return nil
+	}
+
+	var addresses []pg.QueuedAddress
+	for _, addr := range testAddresses(40) {
+		addresses = append(addresses, pg.QueuedAddress{Account: addr.HexWithPrefix(), Generation: 1})
+	}
+	pool := newAccountFetchPool(ctx, zerolog.Nop(), client, 4, 100, insertHandler, accountHandler, doneHandler, failHandler)
+
+	// the same addresses submitted twice before any is fetched are queued once
+	pool.Submit(ctx, addresses)
+	pool.Submit(ctx, addresses)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(done)
+		mu.Unlock()
+		if n >= len(addresses) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(recorded) != len(addresses) || len(done) != len(addresses) {
+		t.Fatalf("Expected %d recorded and removed accounts, got %d and %d", len(addresses), len(recorded), len(done))
+	}
+	for _, r := range recorded {
+		if r.Status != model.AccountStatusKeyless || r.LastRefreshedHeight != 100 {
+			t.Errorf("Unexpected record %+v", r)
+		}
+	}
+	if max := client.maxSeen.Load(); max > 4 {
+		t.Errorf("Expected at most 4 concurrent fetches, got %d", max)
+	}
+	if depth := pool.QueueDepth(); depth != 0 {
+		t.Errorf("Expected an empty queue, got %d", depth)
+	}
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"math/rand"
 	"strings"
+	"time"
 
 	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc/credentials/insecure"
@@ -12,15 +14,106 @@ import (
 	"github.com/onflow/flow-go-sdk/access"
 	"github.com/onflow/flow-go-sdk/access/grpc"
 	rpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// RetryPolicy decides whether and when a failed access node call is retried.
+// Delays grow exponentially from BaseDelay up to MaxDelay with jitter, and no
+// more than Budget is spent waiting in total.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Budget      time.Duration
+}
+
+// defaultRetryPolicy is used for all access node calls
+var defaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 6,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    30 * time.Second,
+	Budget:      2 * time.Minute,
+}
+
+// isRetryable reports whether a call failing with err may succeed when repeated.
+// Invalid scripts and unknown accounts fail the same way every time and are
+// returned to the caller right away. A call running into its deadline on a
+// busy node is retried as long as ctx, the caller's context, is still live.
+func isRetryable(ctx context.Context, err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.Aborted, codes.Internal, codes.Unknown:
+		return true
+	case codes.DeadlineExceeded:
+		return ctx.Err() == nil
+	default:
+		return false
+	}
+}
+
+// delay returns the jittered wait before the given retry, attempt starting at 1.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	d := p.BaseDelay << (attempt - 1)
+	if d > p.MaxDelay || d <= 0 {
+		d = p.MaxDelay
+	}
+	// wait between half and the full delay so concurrent callers spread out
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryCall runs call until it succeeds, fails with an error that is not
+// retryable, runs out of attempts or budget, or ctx is done.
+func retryCall[T any](ctx context.Context, policy RetryPolicy, name string, call func(context.Context) (T, error)) (T, error) {
+	var waited time.Duration
+	for attempt := 1; ; attempt++ {
+		result, err := call(ctx)
+		if err == nil || !isRetryable(ctx, err) || attempt >= policy.MaxAttempts {
+			return result, err
+		}
+
+		wait := policy.delay(attempt)
+		if waited+wait > policy.Budget {
+			log.Warn().Err(err).Msgf("%s: retry budget of %s spent after %d attempts", name, policy.Budget, attempt)
+			return result, err
+		}
+		waited += wait
+		log.Warn().Err(err).Msgf("%s: attempt %d failed with %s, retrying in %s", name, attempt, status.Code(err), wait)
+
+		select {
+		case <-ctx.Done():
+			return result, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// retryingClient retries the script and network calls of the address search
+// with the shared access node retry policy.
+type retryingClient struct {
+	access.Client
+}
+
+func (c retryingClient) GetNetworkParameters(ctx context.Context) (*flow.NetworkParameters, error) {
+	return retryCall(ctx, defaultRetryPolicy, "Network", func(ctx context.Context) (*flow.NetworkParameters, error) {
+		return c.Client.GetNetworkParameters(ctx)
+	})
+}
+
+func (c retryingClient) ExecuteScriptAtLatestBlock(ctx context.Context, script []byte, arguments []cadence.Value) (cadence.Value, error) {
+	return retryCall(ctx, defaultRetryPolicy, "Script", func(ctx context.Context) (cadence.Value, error) {
+		return c.Client.ExecuteScriptAtLatestBlock(ctx, script, arguments)
+	})
+}
+
 type FlowAdapter struct {
 	Client  access.Client
 	Context context.Context
 	URL     string
 }
 
-func NewFlowClient(url string) *FlowAdapter {
+// NewFlowClient connects to the access node at url, all calls made through
+// the adapter's client wait on the node's rate limiter.
+func NewFlowClient(url string, limiter *nodeLimiter) *FlowAdapter {
 	adapter := FlowAdapter{}
 	adapter.Context = context.Background()
 	// any reason to pass this as an arg instead?
@@ -47,7 +140,7 @@ func NewFlowClient(url string) *FlowAdapter {
 	if err != nil {
 		log.Panic().Msgf("failed to connect to %s", adapter.URL)
 	}
-	adapter.Client = FlowClient
+	adapter.Client = newRateLimitedClient(FlowClient, limiter)
 	return &adapter
 }
 
@@ -64,7 +157,20 @@ func (fa *FlowAdapter) GetCurrentBlockHeight() (uint64, error) {
 	return block.Height, nil
 }
 
-func (fa *FlowAdapter) GetAddressesFromBlockEvents(flowUrls []string, startBlockHeight uint64, endBlockHeight uint64) ([]string, uint64, error) {
+// getSealedHeight returns the latest sealed block height, or 0 when it cannot be
+// determined. Data read at the latest block is at least as new as this height.
+func getSealedHeight(ctx context.Context, client access.Client) uint64 {
+	header, err := client.GetLatestBlockHeader(ctx, true)
+	if err != nil || header == nil {
+		log.Warn().Err(err).Msg("Could not get latest sealed block height")
+		return 0
+	}
+	return header.Height
+}
+
+// GetAddressesFromBlockEvents returns the accounts with key events in the range
+// together with the height of their last key event.
+func (fa *FlowAdapter) GetAddressesFromBlockEvents(startBlockHeight uint64, endBlockHeight uint64) (map[string]uint64, uint64, error) {
 	eventTypes := []string{"flow.AccountKeyAdded", "flow.AccountKeyRemoved"}
 
 	var queryEvents []grpc.EventRangeQuery
@@ -77,7 +183,7 @@ func (fa *FlowAdapter) GetAddressesFromBlockEvents(flowUrls []string, startBlock
 		})
 	}
 
-	addrs, err := fa.GetEventAddresses(flowUrls, queryEvents)
+	addrs, err := fa.GetEventAddresses(queryEvents)
 	if err != nil {
 		log.Error().Err(err).Msg("Could not get event addresses")
 		return addrs, endBlockHeight, err
@@ -86,9 +192,11 @@ func (fa *FlowAdapter) GetAddressesFromBlockEvents(flowUrls []string, startBlock
 	return addrs, endBlockHeight, nil
 }
 
-func RunAddressQuery(client *grpc.BaseClient, context context.Context, query grpc.EventRangeQuery) ([]string, error) {
-	var allAccountAddresses []string
-	events, err := client.GetEventsForHeightRange(context, query)
+func RunAddressQuery(client access.Client, ctx context.Context, query grpc.EventRangeQuery) (map[string]uint64, error) {
+	allAccountAddresses := map[string]uint64{}
+	events, err := retryCall(ctx, defaultRetryPolicy, "Events", func(ctx context.Context) ([]flow.BlockEvents, error) {
+		return client.GetEventsForHeightRange(ctx, query.Type, query.StartHeight, query.EndHeight)
+	})
 	log.Debug().Msgf("events %v", len(events))
 	if err != nil {
 		log.Warn().Err(err).Msgf("Error events in block range %d %d", query.StartHeight, query.EndHeight)
@@ -96,33 +204,36 @@ func RunAddressQuery(client *grpc.BaseClient, context context.Context, query grp
 	}
 	for _, event := range events {
 		for _, evt := range event.Events {
-			var address string
 			if evt.Type == "flow.AccountKeyAdded" || evt.Type == "flow.AccountKeyRemoved" {
-				address = evt.Value.FieldsMappedByName()["address"].(cadence.Address).String()
-				allAccountAddresses = append(allAccountAddresses, address)
+				address := evt.Value.FieldsMappedByName()["address"].(cadence.Address).String()
+				mergeEventHeight(allAccountAddresses, address, event.Height)
 			}
 		}
 	}
 	return allAccountAddresses, nil
 }
 
-func (fa *FlowAdapter) GetEventAddresses(flowUrls []string, queries []grpc.EventRangeQuery) ([]string, error) {
-	allPkAddrs := []string{} // Initialize the slice directly
+func mergeEventHeight(heights map[string]uint64, address string, height uint64) {
+	if height > heights[address] {
+		heights[address] = height
+	}
+}
 
-	// Use the first URL to create a single client
-	client := getFlowClient(flowUrls[0])
-	defer client.Close()
+func (fa *FlowAdapter) GetEventAddresses(queries []grpc.EventRangeQuery) (map[string]uint64, error) {
+	allPkAddrs := map[string]uint64{} // Initialize the map directly
 
 	for _, query := range queries {
 		log.Debug().Msgf("Querying %v event blocks: %d %d, range %d", query.Type, query.StartHeight, query.EndHeight, query.EndHeight-query.StartHeight)
 
-		addrs, err := RunAddressQuery(client, fa.Context, query)
+		addrs, err := RunAddressQuery(fa.Client, fa.Context, query)
 		if err != nil {
 			log.Error().Err(err).Msg("Error getting event addresses")
 			return allPkAddrs, err // Return the error immediately with processed addresses
 		}
 
-		allPkAddrs = append(allPkAddrs, addrs...)
+		for address, height := range addrs {
+			mergeEventHeight(allPkAddrs, address, height)
+		}
 	}
 
 	log.Debug().Msgf("Flow: Event Found Total addresses: %d", len(allPkAddrs))
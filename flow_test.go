@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRetryCall(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 4, BaseDelay: time.Millisecond, MaxDelay: 4 * time.Millisecond, Budget: time.Second}
+
+	tests := []struct {
+		name     string
+		errs     []error
+		attempts int
+		wantErr  codes.Code
+	}{
+		{
+			name:     "success",
+			errs:     []error{nil},
+			attempts: 1,
+			wantErr:  codes.OK,
+		},
+		{
+			name:     "unavailable then success",
+			errs:     []error{status.Error(codes.Unavailable, "down"), status.Error(codes.ResourceExhausted, "rate limited"), nil},
+			attempts: 3,
+			wantErr:  codes.OK,
+		},
+		{
+			name:     "invalid argument is not retried",
+			errs:     []error{status.Error(codes.InvalidArgument, "bad script")},
+			attempts: 1,
+			wantErr:  codes.InvalidArgument,
+		},
+		{
+			name:     "deadline of the call is retried",
+			errs:     []error{status.Error(codes.DeadlineExceeded, "too slow"), nil},
+			attempts: 2,
+			wantErr:  codes.OK,
+		},
+		{
+			name:     "attempts run out",
+			errs:     []error{status.Error(codes.Unavailable, "down")},
+			attempts: 4,
+			wantErr:  codes.Unavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			_, err := retryCall(context.Background(), policy, "Test", func(ctx context.Context) (int, error) {
+				err := tt.errs[min(attempts, len(tt.errs)-1)]
+				attempts++
+				return attempts, err
+			})
+			if attempts != tt.attempts {
+				t.Errorf("Expected %d attempts, got %d", tt.attempts, attempts)
+			}
+			if status.Code(err) != tt.wantErr {
+				t.Errorf("Expected %s, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestRetryCallStopsOnContextAndBudget(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "down")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	slow := RetryPolicy{MaxAttempts: 10, BaseDelay: time.Hour, MaxDelay: time.Hour, Budget: 10 * time.Hour}
+	_, err := retryCall(ctx, slow, "Test", func(ctx context.Context) (int, error) {
+		return 0, unavailable
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+
+	expired, cancelExpired := context.WithTimeout(context.Background(), 0)
+	defer cancelExpired()
+	attempts := 0
+	_, err = retryCall(expired, slow, "Test", func(ctx context.Context) (int, error) {
+		attempts++
+		return 0, status.Error(codes.DeadlineExceeded, "too slow")
+	})
+	if attempts != 1 || status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("Expected no retry once the caller's deadline passed, got %d attempts and %v", attempts, err)
+	}
+
+	attempts = 0
+	noBudget := RetryPolicy{MaxAttempts: 10, BaseDelay: time.Hour, MaxDelay: time.Hour, Budget: time.Minute}
+	_, err = retryCall(context.Background(), noBudget, "Test", func(ctx context.Context) (int, error) {
+		attempts++
+		return 0, unavailable
+	})
+	if attempts != 1 || status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected a single attempt once the budget is spent, got %d attempts and %v", attempts, err)
+	}
+}
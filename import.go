@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"example/flow-key-indexer/model"
+	"example/flow-key-indexer/pkg/config"
+	"example/flow-key-indexer/pkg/pg"
+
+	"github.com/rs/zerolog/log"
+)
+
+// importBatchSize is the number of snapshot keys copied per transaction
+const importBatchSize = 50000
+
+// snapshotTarget is the indexer a snapshot is imported into
+type snapshotTarget struct {
+	ChainID string
+	// LatestHeight is the latest block of the chain, 0 skips the age check
+	LatestHeight uint64
+	// MaxCatchUpBlocks is how far behind LatestHeight a snapshot can be for the
+	// incremental loader to read the key events from its height on
+	MaxCatchUpBlocks int
+	// Merge allows importing into an index that already holds keys
+	Merge bool
+}
+
+type snapshotReader interface {
+	// Next reads the next key, ok is false at the end of the snapshot
+	Next() (key snapshotKey, ok bool, err error)
+}
+
+// openSnapshot reads the header of a snapshot and returns a reader of its keys.
+func openSnapshot(format string, r io.Reader) (snapshotHeader, snapshotReader, error) {
+	var header snapshotHeader
+	switch format {
+	case snapshotCSV:
+		buf := bufio.NewReader(r)
+		line, err := buf.ReadString('\n')
+		if err != nil {
+			return header, nil, fmt.Errorf("could not read the snapshot header: %w", err)
+		}
+		if !strings.HasPrefix(line, "# ") {
+			return header, nil, errors.New("snapshot has no header line")
+		}
+		if err := json.Unmarshal([]byte(line[2:]), &header); err != nil {
+			return header, nil, fmt.Errorf("invalid snapshot header: %w", err)
+		}
+		c := csv.NewReader(buf)
+		c.FieldsPerRecord = len(snapshotCSVColumns)
+		columns, err := c.Read()
+		if err != nil {
+			return header, nil, fmt.Errorf("could not read the snapshot columns: %w", err)
+		}
+		if !slices.Equal(columns, snapshotCSVColumns) {
+			return header, nil, fmt.Errorf("unexpected snapshot columns %v", columns)
+		}
+		return header, csvSnapshotReader{c}, nil
+	case snapshotNDJSON:
+		dec := json.NewDecoder(bufio.NewReader(r))
+		if err := dec.Decode(&header); err != nil {
+			return header, nil, fmt.Errorf("invalid snapshot header: %w", err)
+		}
+		return header, ndjsonSnapshotReader{dec}, nil
+	default:
+		return header, nil, fmt.Errorf("unknown snapshot format %q, expected csv or ndjson", format)
+	}
+}
+
+// checkSnapshotHeader makes sure the snapshot was exported by an indexer of
+// the target chain, recently enough for the incremental loader to catch up.
+func checkSnapshotHeader(header snapshotHeader, target snapshotTarget) error {
+	if header.Format != snapshotFormatName || header.Version < 1 || header.Version > snapshotVersion {
+		return fmt.Errorf("unsupported snapshot %s version %d", header.Format, header.Version)
+	}
+	if header.ChainID != target.ChainID {
+		return fmt.Errorf("snapshot of chain %q cannot be imported into %q", header.ChainID, target.ChainID)
+	}
+	if header.Height == 0 {
+		return errors.New("snapshot has no block height")
+	}
+	if target.LatestHeight == 0 {
+		return nil
+	}
+	if header.Height > target.LatestHeight {
+		return fmt.Errorf("snapshot at block %d is ahead of the latest block %d", header.Height, target.LatestHeight)
+	}
+	if age := target.LatestHeight - header.Height; age > uint64(target.MaxCatchUpBlocks) {
+		return fmt.Errorf("snapshot is %d blocks old, more than %s_MAXCATCHUPBLOCKS (%d): the incremental loader would skip the key changes in between",
+			age, config.EnvPrefix, target.MaxCatchUpBlocks)
+	}
+	return nil
+}
+
+type csvSnapshotReader struct {
+	r *csv.Reader
+}
+
+func (c csvSnapshotReader) Next() (snapshotKey, bool, error) {
+	record, err := c.r.Read()
+	if err == io.EOF {
+		return snapshotKey{}, false, nil
+	}
+	if err != nil {
+		return snapshotKey{}, false, err
+	}
+	line, _ := c.r.FieldPos(0)
+	invalid := func(column string, err error) (snapshotKey, bool, error) {
+		return snapshotKey{}, false, fmt.Errorf("line %d: invalid %s: %w", line, column, err)
+	}
+
+	key := snapshotKey{
+		Account:     record[0],
+		PublicKey:   record[2],
+		Fingerprint: record[8],
+		EVMAddress:  record[9],
+	}
+	if key.KeyId, err = strconv.Atoi(record[1]); err != nil {
+		return invalid("keyId", err)
+	}
+	if key.Weight, err = strconv.Atoi(record[3]); err != nil {
+		return invalid("weight", err)
+	}
+	if key.SigAlgo, err = strconv.Atoi(record[4]); err != nil {
+		return invalid("sigAlgo", err)
+	}
+	if key.HashAlgo, err = strconv.Atoi(record[5]); err != nil {
+		return invalid("hashAlgo", err)
+	}
+	if key.IsRevoked, err = strconv.ParseBool(record[6]); err != nil {
+		return invalid("isRevoked", err)
+	}
+	if key.UpdatedHeight, err = strconv.ParseUint(record[7], 10, 64); err != nil {
+		return invalid("updatedHeight", err)
+	}
+	return key, true, nil
+}
+
+type ndjsonSnapshotReader struct {
+	dec *json.Decoder
+}
+
+func (n ndjsonSnapshotReader) Next() (snapshotKey, bool, error) {
+	var key snapshotKey
+	err := n.dec.Decode(&key)
+	if err == io.EOF {
+		return key, false, nil
+	}
+	return key, err == nil, err
+}
+
+func fromSnapshotKey(key snapshotKey) model.PublicKeyAccountIndexer {
+	return model.PublicKeyAccountIndexer{
+		Account:       key.Account,
+		KeyId:         key.KeyId,
+		PublicKey:     key.PublicKey,
+		Weight:        key.Weight,
+		SigAlgo:       key.SigAlgo,
+		HashAlgo:      key.HashAlgo,
+		IsRevoked:     key.IsRevoked,
+		UpdatedHeight: key.UpdatedHeight,
+		Fingerprint:   key.Fingerprint,
+		EVMAddress:    key.EVMAddress,
+	}
+}
+
+// importSnapshot copies the keys of a snapshot into db, records their
+// accounts in the registry, queues the accounts that were waiting for their
+// key events again and moves the incremental cursor to the snapshot height.
+// An index that already holds keys is refused unless the target merges.
+func importSnapshot(ctx context.Context, db *pg.Store, target snapshotTarget, format string, r io.Reader) (snapshotHeader, int, error) {
+	header, snapshot, err := openSnapshot(format, r)
+	if err != nil {
+		return header, 0, err
+	}
+	if err := checkSnapshotHeader(header, target); err != nil {
+		return header, 0, err
+	}
+	if !target.Merge {
+		hasKeys, err := db.HasPublicKeys(ctx)
+		if err != nil {
+			return header, 0, err
+		}
+		if hasKeys {
+			return header, 0, errors.New("the index already holds keys, a snapshot is imported into an empty database unless -merge is given")
+		}
+	}
+	log.Info().Msgf("Importing a %s snapshot at block height %d", header.ChainID, header.Height)
+
+	var count int
+	batch := make([]model.PublicKeyAccountIndexer, 0, importBatchSize)
+	save := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if _, err := savePublicKeys(ctx, db, batch); err != nil {
+			return err
+		}
+		count += len(batch)
+		batch = batch[:0]
+		log.Info().Msgf("Imported %d keys", count)
+		return nil
+	}
+	for {
+		key, ok, err := snapshot.Next()
+		if err != nil {
+			return header, count, err
+		}
+		if !ok {
+			break
+		}
+		batch = append(batch, fromSnapshotKey(key))
+		if len(batch) == importBatchSize {
+			if err := save(); err != nil {
+				return header, count, err
+			}
+		}
+	}
+	if err := save(); err != nil {
+		return header, count, err
+	}
+
+	registered, err := db.RegisterKeyAccounts(ctx)
+	if err != nil {
+		return header, count, err
+	}
+	log.Info().Msgf("Registered %d imported accounts", registered)
+
+	// their keys in the snapshot may predate key events up to its height
+	if err := db.EnqueueAddresses(ctx, header.PendingAccounts, pg.PriorityEvent); err != nil {
+		return header, count, err
+	}
+	if len(header.PendingAccounts) > 0 {
+		log.Info().Msgf("Queued %d accounts with key events not fetched when the snapshot was taken", len(header.PendingAccounts))
+	}
+	if err := db.UpdateLoadedBlockHeight(header.Height); err != nil {
+		return header, count, err
+	}
+	db.UpdateDistinctCount()
+	return header, count, nil
+}
+
+// importCommand handles the import subcommand, it loads a snapshot file
+// written by the export of another indexer.
+func importCommand(flags *flag.FlagSet) func(config.Params, []string) error {
+	format := flags.String("format", "", "snapshot format: csv or ndjson, taken from the file extension by default")
+	allowStale := flags.Bool("allow-stale", false, "import a snapshot older than the incremental loader can catch up from")
+	merge := flags.Bool("merge", false, "import into a database that already holds keys, the cursor still moves to the snapshot height")
+	return func(p config.Params, args []string) error {
+		if len(args) != 1 {
+			return errors.New("usage: import [-format csv|ndjson] [-allow-stale] [-merge] <file>")
+		}
+		if *format == "" {
+			*format = strings.TrimPrefix(filepath.Ext(args[0]), ".")
+		}
+		return runImport(p, *format, args[0], *allowStale, *merge)
+	}
+}
+
+func runImport(p config.Params, format string, path string, allowStale bool, merge bool) error {
+	target := snapshotTarget{ChainID: p.ChainId, MaxCatchUpBlocks: p.MaxCatchUpBlocks, Merge: merge}
+	if allowStale {
+		log.Warn().Msg("Importing without checking the snapshot age, the key changes between the snapshot and the latest block may be lost")
+	} else {
+		flowClient := NewFlowClient(strings.TrimSpace(p.FlowUrl1), newNodeLimiter(p.FlowRequestsPerSec, p.FlowRequestBurst))
+		if err := p.CheckAccessNode(context.Background(), flowClient.Client); err != nil {
+			return err
+		}
+		latest, err := flowClient.GetCurrentBlockHeight()
+		if err != nil {
+			return fmt.Errorf("could not get the latest block: %w", err)
+		}
+		target.LatestHeight = latest
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	db := pg.NewStore(p.PostgresConfig(), log.Logger)
+	if err := db.Start(false); err != nil {
+		return err
+	}
+	header, count, err := importSnapshot(context.Background(), db, target, format, f)
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("Imported %d keys, the incremental loader resumes from block %d", count, header.Height)
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"example/flow-key-indexer/pkg/pg"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	header := snapshotHeader{Format: snapshotFormatName, Version: snapshotVersion, ChainID: "flow-testnet", Height: 42, CreatedAt: time.Unix(0, 0).UTC(), PendingAccounts: []string{"0x0000000000000a03"}}
+	keys := []snapshotKey{
+		{Account: "0x0000000000000a01", KeyId: 0, PublicKey: "a1a1", Weight: 1000, SigAlgo: 1, HashAlgo: 3, UpdatedHeight: 40, Fingerprint: "aa"},
+		{Account: "0x0000000000000a02", KeyId: 1, PublicKey: "a2a2", Weight: 500, SigAlgo: 2, HashAlgo: 1, IsRevoked: true, EVMAddress: "bb"},
+	}
+
+	for _, format := range []string{snapshotCSV, snapshotNDJSON} {
+		t.Run(format, func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := newSnapshotWriter(format, &buf, header)
+			if err != nil {
+				t.Fatalf("Failed to create the writer: %v", err)
+			}
+			for _, key := range keys {
+				if err := w.Write(key); err != nil {
+					t.Fatalf("Failed to write: %v", err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Failed to close the writer: %v", err)
+			}
+
+			read, snapshot, err := openSnapshot(format, &buf)
+			if err != nil {
+				t.Fatalf("Failed to open the snapshot: %v", err)
+			}
+			if !reflect.DeepEqual(read, header) {
+				t.Errorf("Expected header %+v, got %+v", header, read)
+			}
+			for _, want := range keys {
+				key, ok, err := snapshot.Next()
+				if err != nil || !ok || key != want {
+					t.Fatalf("Expected %+v, got %+v, %v, %v", want, key, ok, err)
+				}
+			}
+			if _, ok, err := snapshot.Next(); ok || err != nil {
+				t.Errorf("Expected the end of the snapshot, got %v, %v", ok, err)
+			}
+		})
+	}
+
+	if err := checkSnapshotHeader(header, snapshotTarget{ChainID: "flow-testnet"}); err != nil {
+		t.Errorf("Expected a valid header, got %v", err)
+	}
+	if err := checkSnapshotHeader(header, snapshotTarget{ChainID: "flow-mainnet"}); err == nil {
+		t.Errorf("Expected a chain ID mismatch")
+	}
+	if err := checkSnapshotHeader(header, snapshotTarget{ChainID: "flow-testnet", LatestHeight: 142, MaxCatchUpBlocks: 100}); err != nil {
+		t.Errorf("Expected a snapshot within the catch up range, got %v", err)
+	}
+	if err := checkSnapshotHeader(header, snapshotTarget{ChainID: "flow-testnet", LatestHeight: 143, MaxCatchUpBlocks: 100}); err == nil {
+		t.Errorf("Expected a snapshot too old to catch up from to be refused")
+	}
+	if err := checkSnapshotHeader(header, snapshotTarget{ChainID: "flow-testnet", LatestHeight: 41, MaxCatchUpBlocks: 100}); err == nil {
+		t.Errorf("Expected a snapshot ahead of the chain to be refused")
+	}
+	if _, _, err := openSnapshot(snapshotCSV, strings.NewReader("account,keyId\n")); err == nil {
+		t.Errorf("Expected a missing header error")
+	}
+}
+
+func TestImportSnapshot(t *testing.T) {
+	db := newTestStore(t)
+
+	snapshot := `{"format":"keyindexer-snapshot","version":2,"chainId":"flow-testnet","height":5000,"createdAt":"2024-01-01T00:00:00Z","pendingAccounts":["0x0000000000000a09"]}
+{"account":"0x0000000000000a01","keyId":0,"publicKey":"a1a1a1a1a1a1a1a1a1a1a1a1","weight":1000,"sigAlgo":1,"hashAlgo":3,"isRevoked":false,"updatedHeight":4900,"fingerprint":"","evmAddress":""}
+{"account":"0x0000000000000a01","keyId":1,"publicKey":"a2a2a2a2a2a2a2a2a2a2a2a2","weight":500,"sigAlgo":1,"hashAlgo":3,"isRevoked":true,"updatedHeight":4950,"fingerprint":"","evmAddress":""}
+`
+	ctx := context.Background()
+	if _, _, err := importSnapshot(ctx, db, snapshotTarget{ChainID: "flow-mainnet"}, snapshotNDJSON, strings.NewReader(snapshot)); err == nil {
+		t.Fatalf("Expected a snapshot of another chain to be refused")
+	}
+	stale := snapshotTarget{ChainID: "flow-testnet", LatestHeight: 200000, MaxCatchUpBlocks: 100000}
+	if _, _, err := importSnapshot(ctx, db, stale, snapshotNDJSON, strings.NewReader(snapshot)); err == nil {
+		t.Fatalf("Expected a snapshot too old to catch up from to be refused")
+	}
+
+	// the other tests leave keys behind, the import has to merge
+	target := snapshotTarget{ChainID: "flow-testnet", LatestHeight: 6000, MaxCatchUpBlocks: 100000, Merge: true}
+	header, count, err := importSnapshot(ctx, db, target, snapshotNDJSON, strings.NewReader(snapshot))
+	if err != nil {
+		t.Fatalf("Failed to import: %v", err)
+	}
+	target.Merge = false
+	if _, _, err := importSnapshot(ctx, db, target, snapshotNDJSON, strings.NewReader(snapshot)); err == nil {
+		t.Errorf("Expected an import into an index with keys to be refused")
+	}
+	if account, err := db.GetAccount("0x0000000000000a01"); err != nil || account.KeyCount < 2 || account.LastRefreshedHeight < 4950 {
+		t.Errorf("Expected the imported account to be registered, got %+v, %v", account, err)
+	}
+	if header.Height != 5000 || count != 2 {
+		t.Errorf("Expected 2 keys at height 5000, got %d at %d", count, header.Height)
+	}
+	if height, _ := db.GetLoadedBlockHeight(); height != 5000 {
+		t.Errorf("Expected the cursor at 5000, got %d", height)
+	}
+
+	pending, err := db.ClaimAddresses(ctx, pg.PriorityEvent, 1000, time.Minute)
+	if err != nil || !slices.ContainsFunc(pending, func(q pg.QueuedAddress) bool { return q.Account == "0x0000000000000a09" }) {
+		t.Errorf("Expected the pending account of the snapshot to be queued, got %v, %v", pending, err)
+	}
+
+	keys, err := db.GetPublicKeysByAccount("0x0000000000000a01")
+	if err != nil || len(keys) != 2 || !keys[1].IsRevoked || keys[1].UpdatedHeight != 4950 || keys[0].Fingerprint == "" {
+		t.Errorf("Unexpected imported keys %+v, %v", keys, err)
+	}
+}
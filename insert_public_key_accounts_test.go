@@ -2,51 +2,32 @@ package main
 
 import (
 	"context"
-	"example/flow-key-indexer/pkg/pg"
-	logger "log"
 	"testing"
 
 	"example/flow-key-indexer/model"
-
-	"github.com/axiomzen/envconfig"
-	"github.com/rs/zerolog/log"
 )
 
 func TestDuplicatedKeysInBatches(t *testing.T) {
-	var p Params
-	err := envconfig.Process("KEYIDX", &p)
-	if err != nil {
-		logger.Fatal(err.Error())
-	}
-
-	dbConfig := pg.DatabaseConfig{
-		Host:     p.PostgreSQLHost,
-		Password: p.PostgreSQLPassword,
-		Name:     p.PostgreSQLDatabase,
-		User:     p.PostgreSQLUsername,
-		Port:     int(p.PostgreSQLPort),
-	}
-	db := pg.NewStore(dbConfig, log.Logger)
-	_ = db.Start(true)
+	db := newTestStore(t)
 
 	// Batch 1: Insert unique keys
 	batch1 := []model.PublicKeyAccountIndexer{
 		{
-			Account:   "Account1",
+			Account:   "0x0000000000000001",
 			KeyId:     0,
-			PublicKey: "publicKey1",
+			PublicKey: "0a01",
 			Weight:    1000,
 		},
 		{
-			Account:   "Account2",
+			Account:   "0x0000000000000002",
 			KeyId:     0,
-			PublicKey: "publicKey2",
+			PublicKey: "0a02",
 			Weight:    1000,
 		},
 		{
-			Account:   "Account3",
+			Account:   "0x0000000000000003",
 			KeyId:     0,
-			PublicKey: "publicKey3",
+			PublicKey: "0a03",
 			Weight:    1000,
 		},
 	}
@@ -54,16 +35,16 @@ func TestDuplicatedKeysInBatches(t *testing.T) {
 	// Batch 2: Insert duplicates with different SigAlgo and HashAlgo to trigger ON CONFLICT
 	batch2 := []model.PublicKeyAccountIndexer{
 		{
-			Account:   "Account1",
+			Account:   "0x0000000000000001",
 			KeyId:     0,
-			PublicKey: "publicKey1",
+			PublicKey: "0a01",
 			SigAlgo:   1,
 			HashAlgo:  1,
 		},
 		{
-			Account:   "Account2",
+			Account:   "0x0000000000000002",
 			KeyId:     0,
-			PublicKey: "publicKey2",
+			PublicKey: "0a02",
 			SigAlgo:   1,
 			HashAlgo:  1,
 		},
@@ -72,7 +53,7 @@ func TestDuplicatedKeysInBatches(t *testing.T) {
 	ctx := context.Background()
 
 	// Insert Batch 1
-	err = db.InsertPublicKeyAccounts(ctx, batch1)
+	err := db.InsertPublicKeyAccounts(ctx, batch1)
 	if err != nil {
 		t.Fatalf("Failed to insert batch 1 of public key accounts: %v", err)
 	}
@@ -84,15 +65,15 @@ func TestDuplicatedKeysInBatches(t *testing.T) {
 	}
 
 	// Verify inserted data
-	checkKey1, err := db.GetAccountsByPublicKey("publicKey1")
+	checkKey1, err := db.GetAccountsByPublicKey("0a01")
 	if err != nil {
 		t.Fatalf("Failed to get accounts for publicKey1: %v", err)
 	}
-	checkKey2, err := db.GetAccountsByPublicKey("publicKey2")
+	checkKey2, err := db.GetAccountsByPublicKey("0a02")
 	if err != nil {
 		t.Fatalf("Failed to get accounts for publicKey2: %v", err)
 	}
-	checkKey3, err := db.GetAccountsByPublicKey("publicKey3")
+	checkKey3, err := db.GetAccountsByPublicKey("0a03")
 	if err != nil {
 		t.Fatalf("Failed to get accounts for publicKey3: %v", err)
 	}
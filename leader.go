@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// leaderRetryInterval is how often a standby replica tries to take over a job
+const leaderRetryInterval = 30 * time.Second
+
+// runAsLeader runs job while this replica holds the advisory lock key and
+// keeps trying to take it over while another replica holds it. The job's
+// context is cancelled when the lock is lost, and the lock is released when
+// the job returns on its own so another replica can take over.
+func (a *App) runAsLeader(ctx context.Context, key int64, name string, job func(context.Context)) {
+	for {
+		leadership, err := a.DB.TryLeadership(ctx, key)
+		if err != nil {
+			log.Error().Err(err).Msgf("Could not try to lead %s", name)
+		}
+		if leadership != nil {
+			log.Info().Msgf("Leading %s", name)
+			jobCtx, cancel := context.WithCancel(ctx)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				// stops holding the lock when the job gives up
+				defer cancel()
+				job(jobCtx)
+			}()
+
+			err := leadership.Hold(jobCtx)
+			cancel()
+			<-done
+			leadership.Release()
+			if ctx.Err() != nil {
+				return
+			}
+			log.Warn().Err(err).Msgf("Stopped leading %s", name)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(leaderRetryInterval):
+		}
+	}
+}
@@ -1,46 +1,231 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"os"
+	"strings"
 
-	"github.com/axiomzen/envconfig"
-	"github.com/joho/godotenv"
+	"github.com/onflow/flow-go-sdk"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
 	"example/flow-key-indexer/cmd/addresses"
+	"example/flow-key-indexer/pkg/config"
+	"example/flow-key-indexer/pkg/pg"
+	"example/flow-key-indexer/utils"
 )
 
+// command is a subcommand of the indexer. setup adds the command's own flags
+// and returns the function running it with the configuration and the
+// remaining arguments.
+type command struct {
+	name    string
+	args    string
+	summary string
+	setup   func(flags *flag.FlagSet) func(p config.Params, args []string) error
+}
+
+// defaultCommand runs when no command is given
+const defaultCommand = "serve"
+
+var commands = []command{
+	{"serve", "", "Run the indexer and its REST service in the configured mode", serveCommand},
+	{"backfill", "", "Run the indexer in backfill mode, short for serve -mode backfill", backfillCommand},
+	{"get-addresses", "", "Queue every account address of the chain for backfill", getAddressesCommand},
+	{"reindex-account", "<address>...", "Queue accounts to have their keys fetched again", reindexAccountCommand},
+	{"lookup", "<public key>", "Print the accounts holding a public key", lookupCommand},
+	{"status", "", "Print the key count, the loaded block height and the queue depths", statusCommand},
+	{"migrate", "up|down [steps]|force <version>|version", "Apply, roll back or inspect the database migrations", migrateCommand},
+	{"export", "", "Write a snapshot of the keys, see Snapshots in the README", exportCommand},
+	{"import", "<file>", "Load a CSV or NDJSON snapshot into an empty database", importCommand},
+	{"bootstrap-from-checkpoint", "<checkpoint file>", "Load the keys of an execution state checkpoint", bootstrapFromCheckpointCommand},
+}
+
 func main() {
-	//  go run . -get-addresses
-	getAddressesFlag := flag.Bool("get-addresses", false, "Run GetAddresses function")
-	flag.Parse()
+	name, args := defaultCommand, os.Args[1:]
+	if len(args) > 0 {
+		switch {
+		case args[0] == "-h" || args[0] == "-help" || args[0] == "--help":
+			printUsage(os.Stdout)
+			return
+		case args[0] == "help":
+			if len(args) == 1 {
+				printUsage(os.Stdout)
+				return
+			}
+			name, args = args[1], []string{"-help"}
+		case args[0] == "-get-addresses" || args[0] == "--get-addresses":
+			// the flag that ran get-addresses before there were commands
+			name, args = "get-addresses", args[1:]
+		case !strings.HasPrefix(args[0], "-"):
+			name, args = args[0], args[1:]
+		}
+	}
+
+	cmd, ok := findCommand(name)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+		printUsage(os.Stderr)
+		os.Exit(2)
+	}
 
-	if *getAddressesFlag {
-		fmt.Println("Running GetAddresses...")
-		addresses.GetAddresses()
+	flags := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	run := cmd.setup(flags)
+	flags.Usage = func() {
+		w := flags.Output()
+		fmt.Fprintf(w, "Usage: %s %s [flags] %s\n\n%s\n", os.Args[0], cmd.name, cmd.args, cmd.summary)
+		config.PrintFlags(w, flags)
+	}
+	p, err := config.Load(flags, args)
+	if errors.Is(err, flag.ErrHelp) {
 		return
 	}
+	if err != nil {
+		log.Fatal().Err(err).Msg("Could not load the configuration")
+	}
+	setLogLevel(p)
 
-	a := App{}
+	if err := run(p, flags.Args()); err != nil {
+		log.Fatal().Err(err).Msgf("%s failed", cmd.name)
+	}
+}
 
-	if err := godotenv.Load("./.env"); err != nil {
-		log.Fatal().Err(err).Msg("Error loading .env file")
+func findCommand(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
 	}
+	return command{}, false
+}
 
-	var p Params
-	err := envconfig.Process("KEYIDX", &p)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Error processing environment variables")
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s [command] [flags] [arguments]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-26s %s\n", cmd.name, cmd.summary)
 	}
+	fmt.Fprintf(w, "\n%s runs when no command is given. Every command takes the configuration\n", defaultCommand)
+	fmt.Fprintf(w, "as %s_ environment variables, from a .env file or as flags, see %s help <command>.\n", config.EnvPrefix, os.Args[0])
+}
 
+func setLogLevel(p config.Params) {
 	lvl, err := zerolog.ParseLevel(p.LogLevel)
 	if err == nil {
 		zerolog.SetGlobalLevel(lvl)
 		log.Info().Msgf("Set log level to %s", lvl.String())
 	}
+}
+
+func serveCommand(flags *flag.FlagSet) func(config.Params, []string) error {
+	return func(p config.Params, args []string) error {
+		if len(args) > 0 {
+			return fmt.Errorf("unexpected arguments %v", args)
+		}
+		a := App{}
+		a.Initialize(p)
+		a.Run()
+		return nil
+	}
+}
+
+func backfillCommand(flags *flag.FlagSet) func(config.Params, []string) error {
+	serve := serveCommand(flags)
+	return func(p config.Params, args []string) error {
+		p.Mode = config.ModeBackfill
+		return serve(p, args)
+	}
+}
+
+func getAddressesCommand(flags *flag.FlagSet) func(config.Params, []string) error {
+	return func(p config.Params, args []string) error {
+		if len(args) > 0 {
+			return fmt.Errorf("unexpected arguments %v", args)
+		}
+		flowClient := NewFlowClient(strings.TrimSpace(p.FlowUrl1), newNodeLimiter(p.FlowRequestsPerSec, p.FlowRequestBurst))
+		return addresses.GetAddresses(context.Background(), log.Logger, p, retryingClient{flowClient.Client})
+	}
+}
+
+func reindexAccountCommand(flags *flag.FlagSet) func(config.Params, []string) error {
+	backfill := flags.Bool("backfill", false, "queue with the backfill priority instead of ahead of it")
+	return func(p config.Params, args []string) error {
+		if len(args) == 0 {
+			return errors.New("usage: reindex-account [-backfill] <address>...")
+		}
+		for _, address := range args {
+			if _, err := utils.AccountToBytes(address); err != nil {
+				return fmt.Errorf("invalid address %q: %w", address, err)
+			}
+			if account := flow.HexToAddress(address); !account.IsValid(flow.ChainID(p.ChainId)) {
+				return fmt.Errorf("address %s is not an account of %s", address, p.ChainId)
+			}
+		}
+
+		db := pg.NewStore(p.PostgresConfig(), log.Logger)
+		if err := db.Start(false); err != nil {
+			return err
+		}
+		// event priority addresses are fetched by the ingest workers, backfill
+		// ones by the backfill workers
+		priority := pg.PriorityEvent
+		if *backfill {
+			priority = pg.PriorityBackfill
+		}
+		if err := db.EnqueueAddresses(context.Background(), args, priority); err != nil {
+			return err
+		}
+		log.Info().Msgf("Queued %d accounts with priority %d", len(args), priority)
+		return nil
+	}
+}
+
+func lookupCommand(flags *flag.FlagSet) func(config.Params, []string) error {
+	return func(p config.Params, args []string) error {
+		if len(args) != 1 {
+			return errors.New("usage: lookup <public key>")
+		}
+		db := pg.NewStore(p.PostgresConfig(), log.Logger)
+		if err := db.StartReadOnly(); err != nil {
+			return err
+		}
+		keys, err := db.GetAccountsByPublicKey(strings.ToLower(utils.Strip0xPrefix(args[0])))
+		if err != nil {
+			return err
+		}
+		return printJSON(keys)
+	}
+}
+
+func statusCommand(flags *flag.FlagSet) func(config.Params, []string) error {
+	return func(p config.Params, args []string) error {
+		db := pg.NewStore(p.PostgresConfig(), log.Logger)
+		if err := db.StartReadOnly(); err != nil {
+			return err
+		}
+		stats := db.Stats()
+		metrics := indexerMetrics{PublicKeyCount: stats.Count, LoadedToBlock: stats.LoadedToBlock}
+		var err error
+		if metrics.EventQueueDepth, err = db.QueueDepth(pg.PriorityEvent); err != nil {
+			return err
+		}
+		if metrics.BackfillQueueDepth, err = db.QueueDepth(pg.PriorityBackfill); err != nil {
+			return err
+		}
+		return printJSON(metrics)
+	}
+}
+
+func migrateCommand(flags *flag.FlagSet) func(config.Params, []string) error {
+	return runMigrate
+}
 
-	a.Initialize(p)
-	a.Run()
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
 }
@@ -0,0 +1,58 @@
+package model
+
+import "time"
+
+// Account status values stored in the accounts registry
+const (
+	AccountStatusOK = "ok"
+	// AccountStatusKeyless accounts have no indexed keys
+	AccountStatusKeyless = "keyless"
+	// AccountStatusOverCap accounts have more keys than MaxAcctKeys
+	AccountStatusOverCap = "over_cap"
+	// AccountStatusBroken accounts are known to fail on the access nodes and are skipped
+	AccountStatusBroken = "broken"
+	// AccountStatusError accounts failed on their last refresh
+	AccountStatusError = "error"
+)
+
+// AccountRecord is the registry entry of an account, updated on every refresh
+type AccountRecord struct {
+	Address             string    `json:"address"`
+	Status              string    `json:"status"`
+	KeyCount            int       `json:"keyCount"`
+	LastRefreshedHeight uint64    `json:"lastRefreshedHeight"`
+	LastRefreshedAt     time.Time `json:"lastRefreshedAt"`
+	LastError           string    `json:"lastError,omitempty"`
+}
+
+// TruncatedAccount is an account with more keys than MaxAcctKeys, its keys
+// from NextKeyIndex on are still to be fetched until CompletedAt is set
+type TruncatedAccount struct {
+	Address        string     `json:"address"`
+	KeyCount       int        `json:"keyCount"`
+	NextKeyIndex   int        `json:"nextKeyIndex"`
+	DetectedHeight uint64     `json:"detectedHeight"`
+	DetectedAt     time.Time  `json:"detectedAt"`
+	CompletedAt    *time.Time `json:"completedAt,omitempty"`
+	Attempts       int        `json:"attempts"`
+	LastError      string     `json:"lastError,omitempty"`
+}
+
+// ClusterAccount is an account reached from the start of a cluster walk,
+// Depth is the number of shared keys between them
+type ClusterAccount struct {
+	Address string `json:"address"`
+	Depth   int    `json:"depth"`
+}
+
+// AccountCluster are the accounts connected to Address by shared unrevoked
+// keys, Complete is false when the walk stopped at its depth or size limit
+type AccountCluster struct {
+	Address  string           `json:"address"`
+	Accounts []ClusterAccount `json:"accounts"`
+	Complete bool             `json:"complete"`
+	// ClusterID and ClusterSize are set when the account belongs to a
+	// precomputed large cluster
+	ClusterID   string `json:"clusterId,omitempty"`
+	ClusterSize int    `json:"clusterSize,omitempty"`
+}
@@ -1,5 +1,7 @@
 package model
 
+import "time"
+
 type AccountKey struct {
 	Account   string `json:"address"`
 	KeyId     int    `json:"keyId"`
@@ -9,11 +11,22 @@ type AccountKey struct {
 	IsRevoked bool   `json:"isRevoked"`
 	Signing   string `json:"signing"`
 	Hashing   string `json:"hashing"`
+	// PublicKey is set where the key is not implied by the response
+	PublicKey string `json:"publicKey,omitempty"`
 }
 
 type PublicKeyIndexer struct {
-	PublicKey string       `json:"publicKey"`
-	Accounts  []AccountKey `json:"accounts"`
+	PublicKey   string `json:"publicKey"`
+	Fingerprint string `json:"fingerprint"`
+	// EVMAddress is set for ECDSA_secp256k1 keys
+	EVMAddress string       `json:"evmAddress,omitempty"`
+	Accounts   []AccountKey `json:"accounts"`
+}
+
+// EVMAddressAccounts are the keys deriving an EVM address and their accounts
+type EVMAddressAccounts struct {
+	EVMAddress string             `json:"evmAddress"`
+	Keys       []PublicKeyIndexer `json:"keys"`
 }
 
 type PublicKeyAccountIndexer struct {
@@ -24,6 +37,13 @@ type PublicKeyAccountIndexer struct {
 	SigAlgo   int    `json:"sigAlgo" gorm:"column:sigalgo"`
 	HashAlgo  int    `json:"hashAlgo" gorm:"column:hashalgo"`
 	IsRevoked bool   `json:"isRevoked" gorm:"column:isrevoked"`
+	// UpdatedHeight is the block height the key data was read at, 0 when unknown
+	UpdatedHeight uint64 `json:"updatedHeight" gorm:"column:updated_height"`
+	// Fingerprint is the hex key fingerprint, filled in when the key is stored
+	Fingerprint string `json:"fingerprint" gorm:"column:fingerprint"`
+	// EVMAddress is the hex address derived from ECDSA_secp256k1 keys
+	EVMAddress string    `json:"evmAddress,omitempty" gorm:"column:evm_address"`
+	UpdatedAt  time.Time `json:"updatedAt" gorm:"column:updated_at;<-:false"`
 }
 
 func (PublicKeyAccountIndexer) TableName() string {
@@ -44,3 +64,19 @@ type PublicKeyStatus struct {
 	CurrentBlock  int `json:"currentBlockHeight"`
 	LoadedToBlock int `json:"LoadToBlockHeight"`
 }
+
+// AccountThreshold summarizes whether a set of keys can sign for an account,
+// Weight is the usable weight of the given keys on the account, revoked keys
+// count for nothing
+type AccountThreshold struct {
+	Account        string       `json:"address"`
+	Threshold      int          `json:"threshold"`
+	Weight         int          `json:"weight"`
+	MeetsThreshold bool         `json:"meetsThreshold"`
+	Keys           []AccountKey `json:"keys"`
+	// NeededKeys are the fewest other unrevoked keys that complete the
+	// threshold, all of them when the account cannot reach it
+	NeededKeys []AccountKey `json:"neededKeys"`
+	// Reachable is false when all unrevoked keys together stay below the threshold
+	Reachable bool `json:"reachable"`
+}
@@ -0,0 +1,156 @@
+package config
+
+import (
+	"strings"
+	"time"
+
+	"example/flow-key-indexer/pkg/pg"
+)
+
+// Params is the configuration shared by the service and its commands, read
+// from KEYIDX_ environment variables and flags, see Load.
+type Params struct {
+	LogLevel               string   `default:"info" desc:"zerolog log level: debug, info, warn, error"`
+	Port                   string   `default:"8080" desc:"port the REST service listens on"`
+	FlowUrl1               string   `default:"access.mainnet.nodes.onflow.org:9000" desc:"access node endpoint, has to serve the network of chainid"`
+	FlowUrl2               string   `desc:"additional access node endpoint"`
+	FlowUrl3               string   `desc:"additional access node endpoint"`
+	FlowUrl4               string   `desc:"additional access node endpoint"`
+	AllFlowUrls            []string `ignored:"true"`
+	ChainId                string   `default:"flow-mainnet" desc:"target chain: flow-mainnet, flow-testnet or flow-emulator"`
+	MaxAcctKeys            int      `default:"1000" desc:"keys read per account by the bulk script, accounts with more are fetched in pages"`
+	TruncatedKeysPageSize  int      `default:"1000" desc:"key indexes read per script call for truncated accounts"`
+	BatchSize              int      `default:"50000" desc:"maximum accounts per batch sent to the cadence script"`
+	ScriptBatchSize        int      `default:"1000" desc:"starting accounts per script call, adapts up to batchsize"`
+	IgnoreZeroWeight       bool     `default:"true" desc:"skip keys with zero weight"`
+	IgnoreRevoked          bool     `default:"false" desc:"skip revoked keys"`
+	WaitNumBlocks          int      `default:"200" desc:"blocks to wait before an incremental load"`
+	BlockPolIntervalSec    int      `default:"180" desc:"seconds between checks of the current block height"`
+	SyncDataPolIntervalMin int      `default:"1" desc:"minutes between sync data operations"`
+	SyncDataStartIndex     int      `default:"3000000" desc:"address index get-addresses starts searching for the last account from, it searches below when no account exists at it"`
+	MaxBlockRange          int      `default:"600" desc:"blocks read per incremental load"`
+	MaxCatchUpBlocks       int      `default:"100000" desc:"blocks behind the stored cursor the incremental loader still catches up from"`
+	FlowRequestsPerSec     float64  `default:"10" desc:"maximum requests per second to the access node, 0 disables the limit"`
+	FlowRequestBurst       int      `default:"10" desc:"requests sent at once before the rate limit applies"`
+	PurgeOnStart           bool     `default:"false" desc:"clear the database on start"`
+	EnableSyncData         bool     `default:"true" desc:"run the bulk backfill"`
+	EnableIncremental      bool     `default:"true" desc:"follow key events"`
+	Mode                   string   `default:"all" desc:"role of the process: api, ingest, backfill or all"`
+	HighPriorityWorkers    int      `default:"8" desc:"accounts with key events fetched concurrently"`
+	HighPriorityQueueSize  int      `default:"10000" desc:"accounts waiting to be fetched before the incremental loader is held back"`
+	ClusterIntervalMin     int      `default:"1440" desc:"minutes between recomputing account clusters, 0 disables it"`
+	MinClusterSize         int      `default:"10" desc:"accounts a cluster needs to be stored with an id"`
+	ExportToken            string   `desc:"bearer token of GET /export, the endpoint is off without it"`
+
+	GetAddressesBatchSize int           `default:"1000" desc:"addresses get-addresses queues per insert"`
+	GetAddressesPause     time.Duration `default:"600ms" desc:"pause before each request of the get-addresses search for the last account"`
+
+	PostgreSQLHost              string        `default:"localhost" desc:"database host"`
+	PostgreSQLPort              uint16        `default:"5432" desc:"database port"`
+	PostgreSQLUsername          string        `default:"postgres" desc:"database user"`
+	PostgreSQLPassword          string        `required:"false" desc:"database password"`
+	PostgreSQLDatabase          string        `default:"keyindexer" desc:"database name"`
+	PostgreSQLSSL               bool          `default:"false" desc:"connect with sslmode=require, sslmode is disable otherwise"`
+	PostgreSQLSSLMode           string        `required:"false" desc:"disable, require, verify-ca or verify-full, overrides postgresqlssl"`
+	PostgreSQLSSLRootCert       string        `required:"false" desc:"CA certificate file used to verify the server"`
+	PostgreSQLSSLCert           string        `required:"false" desc:"client certificate file"`
+	PostgreSQLSSLKey            string        `required:"false" desc:"client key file"`
+	PostgreSQLLogQueries        bool          `default:"false" desc:"log every SQL statement"`
+	PostgreSQLSetLogger         bool          `default:"false" desc:"log the pgx driver connections, queries and errors"`
+	PostgreSQLRetryNumTimes     uint16        `default:"30" desc:"connection attempts at start before giving up"`
+	PostgreSQLRetrySleepTime    time.Duration `default:"1s" desc:"pause between connection attempts"`
+	PostgreSQLPoolSize          int           `default:"20" desc:"connections shared by queries and COPY loads"`
+	PostgreSQLApplicationName   string        `default:"keyindexer" desc:"application name reported to the server"`
+	PostgreSQLReplicaDSNs       []string      `required:"false" desc:"comma separated connection urls of read replicas"`
+	PostgreSQLMaxReplicaLag     time.Duration `default:"30s" desc:"lag after which a replica is skipped for reads"`
+	PostgresLoggerPrefix        string        `default:"keyindexer" desc:"prefix of the database log lines"`
+	PostgresPrometheusSubSystem string        `default:"keyindexer" desc:"prometheus subsystem of the database metrics"`
+}
+
+// Process modes, each replica runs one of them
+const (
+	// ModeAPI serves the REST api from the database, it needs no access node
+	// and can point at a read replica
+	ModeAPI = "api"
+	// ModeIngest follows key events and fetches the accounts they touched
+	ModeIngest = "ingest"
+	// ModeBackfill loads the queued addresses and the keys of truncated accounts
+	ModeBackfill = "backfill"
+	// ModeAll runs everything in one process
+	ModeAll = "all"
+)
+
+// ServesAPI tells if the process serves the REST api
+func (p Params) ServesAPI() bool {
+	return p.Mode == ModeAPI || p.Mode == ModeAll
+}
+
+// RunsIngest tells if the process follows key events
+func (p Params) RunsIngest() bool {
+	return (p.Mode == ModeIngest || p.Mode == ModeAll) && p.EnableIncremental
+}
+
+// RunsBackfill tells if the process loads the queued addresses
+func (p Params) RunsBackfill() bool {
+	return (p.Mode == ModeBackfill || p.Mode == ModeAll) && p.EnableSyncData
+}
+
+// flowUrls lists the configured access node endpoints.
+func flowUrls(params Params) []string {
+	var all []string
+	all = processUrl(params.FlowUrl1, all)
+	all = processUrl(params.FlowUrl2, all)
+	all = processUrl(params.FlowUrl3, all)
+	all = processUrl(params.FlowUrl4, all)
+	return all
+}
+
+func processUrl(url string, collection []string) []string {
+	newUrl := strings.TrimSpace(url)
+	if newUrl != "" {
+		collection = append(collection, newUrl)
+	}
+	return collection
+}
+
+// PostgresConfig is the database configuration of the store and the migrator.
+func (p Params) PostgresConfig() pg.DatabaseConfig {
+	return pg.DatabaseConfig{
+		Host:     p.PostgreSQLHost,
+		Password: p.PostgreSQLPassword,
+		Name:     p.PostgreSQLDatabase,
+		User:     p.PostgreSQLUsername,
+		Port:     int(p.PostgreSQLPort),
+
+		SSLMode:     postgresSSLMode(p),
+		SSLRootCert: p.PostgreSQLSSLRootCert,
+		SSLCert:     p.PostgreSQLSSLCert,
+		SSLKey:      p.PostgreSQLSSLKey,
+
+		ReplicaDSNs:   p.PostgreSQLReplicaDSNs,
+		MaxReplicaLag: p.PostgreSQLMaxReplicaLag,
+		Config: pg.Config{
+			ConnectPGOptions: pg.ConnectPGOptions{
+				RetryNumTimes:  p.PostgreSQLRetryNumTimes,
+				RetrySleepTime: p.PostgreSQLRetrySleepTime,
+			},
+			SetInternalPGLogger: p.PostgreSQLSetLogger,
+			LogQueries:          p.PostgreSQLLogQueries,
+			PGApplicationName:   p.PostgreSQLApplicationName,
+			PGLoggerPrefix:      p.PostgresLoggerPrefix,
+			PGPoolSize:          p.PostgreSQLPoolSize,
+		},
+	}
+}
+
+// postgresSSLMode returns the configured ssl mode, PostgreSQLSSL picks
+// require or disable when none is set.
+func postgresSSLMode(conf Params) string {
+	if conf.PostgreSQLSSLMode != "" {
+		return conf.PostgreSQLSSLMode
+	}
+	if conf.PostgreSQLSSL {
+		return "require"
+	}
+	return "disable"
+}
@@ -0,0 +1,189 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/axiomzen/envconfig"
+	"github.com/joho/godotenv"
+)
+
+const (
+	// EnvPrefix prefixes the environment variable of every Params field
+	EnvPrefix = "KEYIDX"
+	// envFile is read when it exists, variables set in the environment win over it
+	envFile = ".env"
+)
+
+// Load reads the configuration of a command: the defaults of Params, the .env
+// file, the environment and last the command line. flags holds the command's
+// own flags, a flag per Params field is added next to them. The configuration
+// is validated once read.
+func Load(flags *flag.FlagSet, args []string) (Params, error) {
+	var p Params
+	if err := godotenv.Load(envFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return p, fmt.Errorf("could not read %s: %w", envFile, err)
+	}
+	if err := envconfig.Process(EnvPrefix, &p); err != nil {
+		return p, err
+	}
+	AddFlags(flags, &p)
+	if err := flags.Parse(args); err != nil {
+		return p, err
+	}
+	p.AllFlowUrls = flowUrls(p)
+	return p, p.Validate()
+}
+
+// paramFlag is the command line flag of a configuration field, named after
+// its environment variable without the prefix, -postgresqlhost sets
+// KEYIDX_POSTGRESQLHOST.
+type paramFlag struct {
+	field reflect.StructField
+	value reflect.Value
+}
+
+// AddFlags adds a flag for every configuration field of spec, which points at
+// a struct. The flags write into spec when parsed.
+func AddFlags(flags *flag.FlagSet, spec interface{}) {
+	value := reflect.ValueOf(spec).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if field.Tag.Get("ignored") == "true" || !field.IsExported() {
+			continue
+		}
+		flags.Var(&paramFlag{field: field, value: value.Field(i)}, strings.ToLower(field.Name), field.Tag.Get("desc"))
+	}
+}
+
+func (f *paramFlag) String() string {
+	if !f.value.IsValid() {
+		return ""
+	}
+	if f.value.Kind() == reflect.Slice {
+		return strings.Join(f.value.Interface().([]string), ",")
+	}
+	return fmt.Sprint(f.value.Interface())
+}
+
+// Set parses the value the way envconfig parses the environment variable.
+func (f *paramFlag) Set(s string) error {
+	switch f.value.Kind() {
+	case reflect.String:
+		f.value.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.value.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if f.value.Type() == reflect.TypeOf(time.Duration(0)) {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return err
+			}
+			f.value.SetInt(int64(d))
+			return nil
+		}
+		n, err := strconv.ParseInt(s, 0, f.value.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.value.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 0, f.value.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.value.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, f.value.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.value.SetFloat(n)
+	case reflect.Slice:
+		var items []string
+		if s != "" {
+			items = strings.Split(s, ",")
+		}
+		f.value.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", f.value.Type())
+	}
+	return nil
+}
+
+// IsBoolFlag lets boolean fields be set with a bare -flag.
+func (f *paramFlag) IsBoolFlag() bool {
+	return f.value.IsValid() && f.value.Kind() == reflect.Bool
+}
+
+// typeName is the placeholder of the flag value shown by the usage.
+func (f *paramFlag) typeName() string {
+	switch {
+	case f.value.Type() == reflect.TypeOf(time.Duration(0)):
+		return "duration"
+	case f.value.Kind() == reflect.Slice:
+		return "list"
+	case f.value.Kind() == reflect.Bool:
+		return ""
+	case f.value.Kind() == reflect.Float32, f.value.Kind() == reflect.Float64:
+		return "float"
+	case f.value.Kind() == reflect.String:
+		return "string"
+	default:
+		return "int"
+	}
+}
+
+// PrintFlags writes the usage of the command's own flags followed by the
+// configuration flags, with their environment variable and default.
+func PrintFlags(w io.Writer, flags *flag.FlagSet) {
+	var own, params []*flag.Flag
+	flags.VisitAll(func(f *flag.Flag) {
+		if _, ok := f.Value.(*paramFlag); ok {
+			params = append(params, f)
+		} else {
+			own = append(own, f)
+		}
+	})
+
+	if len(own) > 0 {
+		fmt.Fprintln(w, "\nFlags:")
+		for _, f := range own {
+			name, usage := flag.UnquoteUsage(f)
+			printFlag(w, f.Name, name, usage)
+		}
+	}
+	fmt.Fprintln(w, "\nConfiguration, flags override the environment and the .env file:")
+	for _, f := range params {
+		param := f.Value.(*paramFlag)
+		usage := f.Usage
+		if usage != "" {
+			usage += " "
+		}
+		usage += "(" + EnvPrefix + "_" + strings.ToUpper(param.field.Name)
+		if def, ok := param.field.Tag.Lookup("default"); ok {
+			usage += ", default " + strconv.Quote(def)
+		}
+		usage += ")"
+		printFlag(w, f.Name, param.typeName(), usage)
+	}
+}
+
+func printFlag(w io.Writer, name string, typeName string, usage string) {
+	line := "  -" + name
+	if typeName != "" {
+		line += " " + typeName
+	}
+	fmt.Fprintf(w, "%s\n    \t%s\n", line, strings.ReplaceAll(usage, "\n", "\n    \t"))
+}
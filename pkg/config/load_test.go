@@ -0,0 +1,81 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/axiomzen/envconfig"
+)
+
+func TestParamFlagsOverrideEnvironment(t *testing.T) {
+	t.Setenv("KEYIDX_PORT", "9000")
+	t.Setenv("KEYIDX_BATCHSIZE", "10")
+	t.Setenv("KEYIDX_IGNOREZEROWEIGHT", "true")
+
+	var p Params
+	if err := envconfig.Process(EnvPrefix, &p); err != nil {
+		t.Fatal(err)
+	}
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	AddFlags(flags, &p)
+	err := flags.Parse([]string{
+		"-batchsize", "7",
+		"-ignorezeroweight=false",
+		"-purgeonstart",
+		"-flowrequestspersec", "2.5",
+		"-postgresqlport", "6543",
+		"-postgresqlretrysleeptime", "2s",
+		"-postgresqlreplicadsns", "postgres://a,postgres://b",
+		"lookup-argument",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Port != "9000" {
+		t.Errorf("Expected the environment to set the port, got %q", p.Port)
+	}
+	if p.BatchSize != 7 || p.IgnoreZeroWeight || !p.PurgeOnStart {
+		t.Errorf("Expected the flags to override the environment, got %+v", p)
+	}
+	if p.FlowRequestsPerSec != 2.5 || p.PostgreSQLPort != 6543 || p.PostgreSQLRetrySleepTime != 2*time.Second {
+		t.Errorf("Expected numbers and durations to be parsed, got %+v", p)
+	}
+	if len(p.PostgreSQLReplicaDSNs) != 2 || p.PostgreSQLReplicaDSNs[1] != "postgres://b" {
+		t.Errorf("Expected a comma separated list, got %v", p.PostgreSQLReplicaDSNs)
+	}
+	if flags.NArg() != 1 || flags.Arg(0) != "lookup-argument" {
+		t.Errorf("Expected the arguments after the flags to be kept, got %v", flags.Args())
+	}
+
+	if err := flags.Set("postgresqlport", "port"); err == nil {
+		t.Error("Expected an invalid port to be rejected")
+	}
+	if flags.Lookup("allflowurls") != nil {
+		t.Error("Expected ignored fields to have no flag")
+	}
+}
+
+func TestPrintFlags(t *testing.T) {
+	var p Params
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.String("format", "csv", "snapshot format")
+	AddFlags(flags, &p)
+
+	var out bytes.Buffer
+	PrintFlags(&out, flags)
+	usage := out.String()
+	for _, want := range []string{
+		"-format string\n    \tsnapshot format",
+		"-chainid string\n    \ttarget chain: flow-mainnet, flow-testnet or flow-emulator (KEYIDX_CHAINID, default \"flow-mainnet\")",
+		"-purgeonstart\n",
+		"-postgresqlretrysleeptime duration",
+	} {
+		if !strings.Contains(usage, want) {
+			t.Errorf("Expected the usage to contain %q, got\n%s", want, usage)
+		}
+	}
+}
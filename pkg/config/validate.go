@@ -0,0 +1,109 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/onflow/flow-go-sdk"
+	"github.com/onflow/flow-go-sdk/access"
+	"github.com/rs/zerolog"
+)
+
+// chainIDs are the networks the indexer can follow
+var chainIDs = []flow.ChainID{flow.Mainnet, flow.Testnet, flow.Emulator}
+
+var sslModes = []string{"disable", "require", "verify-ca", "verify-full"}
+
+// Validate checks the configuration before anything is started, the error
+// names every invalid setting by its environment variable.
+func (p Params) Validate() error {
+	var errs []error
+	invalid := func(field string, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s_%s %s", EnvPrefix, strings.ToUpper(field), fmt.Sprintf(format, args...)))
+	}
+	positive := func(field string, value int) {
+		if value <= 0 {
+			invalid(field, "has to be positive, got %d", value)
+		}
+	}
+
+	if _, err := zerolog.ParseLevel(p.LogLevel); err != nil {
+		invalid("LogLevel", "is not a log level: %q", p.LogLevel)
+	}
+	if !slices.Contains(chainIDs, flow.ChainID(p.ChainId)) {
+		invalid("ChainId", "has to be one of %v, got %q", chainIDs, p.ChainId)
+	}
+	switch p.Mode {
+	case ModeAPI, ModeIngest, ModeBackfill, ModeAll:
+	default:
+		invalid("Mode", "has to be %s, %s, %s or %s, got %q", ModeAPI, ModeIngest, ModeBackfill, ModeAll, p.Mode)
+	}
+	if p.Mode != ModeAPI && len(p.AllFlowUrls) == 0 {
+		invalid("FlowUrl1", "has to be set in %s mode", p.Mode)
+	}
+	if p.Port == "" {
+		invalid("Port", "has to be set")
+	}
+
+	positive("MaxAcctKeys", p.MaxAcctKeys)
+	positive("TruncatedKeysPageSize", p.TruncatedKeysPageSize)
+	positive("BatchSize", p.BatchSize)
+	positive("ScriptBatchSize", p.ScriptBatchSize)
+	positive("BlockPolIntervalSec", p.BlockPolIntervalSec)
+	positive("SyncDataPolIntervalMin", p.SyncDataPolIntervalMin)
+	positive("SyncDataStartIndex", p.SyncDataStartIndex)
+	positive("GetAddressesBatchSize", p.GetAddressesBatchSize)
+	if p.GetAddressesPause < 0 {
+		invalid("GetAddressesPause", "cannot be negative, got %s", p.GetAddressesPause)
+	}
+	positive("MaxBlockRange", p.MaxBlockRange)
+	positive("HighPriorityWorkers", p.HighPriorityWorkers)
+	positive("HighPriorityQueueSize", p.HighPriorityQueueSize)
+	positive("PostgreSQLPoolSize", p.PostgreSQLPoolSize)
+	if p.WaitNumBlocks < 0 {
+		invalid("WaitNumBlocks", "cannot be negative, got %d", p.WaitNumBlocks)
+	}
+	if p.MaxCatchUpBlocks < 0 {
+		invalid("MaxCatchUpBlocks", "cannot be negative, got %d", p.MaxCatchUpBlocks)
+	}
+	if p.FlowRequestsPerSec < 0 {
+		invalid("FlowRequestsPerSec", "cannot be negative, got %v", p.FlowRequestsPerSec)
+	}
+	if p.FlowRequestsPerSec > 0 && p.FlowRequestBurst <= 0 {
+		invalid("FlowRequestBurst", "has to be positive when requests are rate limited, got %d", p.FlowRequestBurst)
+	}
+	if p.ClusterIntervalMin < 0 {
+		invalid("ClusterIntervalMin", "cannot be negative, got %d", p.ClusterIntervalMin)
+	}
+	if p.MinClusterSize < 2 {
+		invalid("MinClusterSize", "has to be at least 2, got %d", p.MinClusterSize)
+	}
+
+	if p.PostgreSQLSSLMode != "" && !slices.Contains(sslModes, p.PostgreSQLSSLMode) {
+		invalid("PostgreSQLSSLMode", "has to be one of %v, got %q", sslModes, p.PostgreSQLSSLMode)
+	}
+	if (p.PostgreSQLSSLCert == "") != (p.PostgreSQLSSLKey == "") {
+		invalid("PostgreSQLSSLKey", "and %s_POSTGRESQLSSLCERT have to be set together", EnvPrefix)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// CheckAccessNode verifies that the access node serves the configured chain,
+// an indexer pointed at the wrong network would store keys of other accounts.
+func (p Params) CheckAccessNode(ctx context.Context, client access.Client) error {
+	params, err := client.GetNetworkParameters(ctx)
+	if err != nil {
+		return fmt.Errorf("could not get the network of the access node: %w", err)
+	}
+	if params.ChainID != flow.ChainID(p.ChainId) {
+		return fmt.Errorf("the access node serves %s but %s_CHAINID is %s", params.ChainID, EnvPrefix, p.ChainId)
+	}
+	return nil
+}
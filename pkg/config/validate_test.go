@@ -0,0 +1,89 @@
+package config
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/axiomzen/envconfig"
+	"github.com/onflow/flow-go-sdk"
+	"github.com/onflow/flow-go-sdk/access"
+)
+
+// defaultParams holds the defaults of Params, read with a prefix no variable
+// of the environment has.
+func defaultParams(t *testing.T) Params {
+	var p Params
+	if err := envconfig.Process("KEYIDX_VALIDATE_TEST", &p); err != nil {
+		t.Fatal(err)
+	}
+	p.AllFlowUrls = flowUrls(p)
+	return p
+}
+
+func TestValidate(t *testing.T) {
+	p := defaultParams(t)
+	if err := p.Validate(); err != nil {
+		t.Fatalf("Expected the defaults to be valid, got %v", err)
+	}
+
+	p.ChainId = "flow-mainet"
+	p.Mode = "everything"
+	p.BatchSize = 0
+	p.PostgreSQLSSLCert = "client.crt"
+	err := p.Validate()
+	if err == nil {
+		t.Fatal("Expected an invalid configuration")
+	}
+	for _, want := range []string{"KEYIDX_CHAINID", "KEYIDX_MODE", "KEYIDX_BATCHSIZE", "KEYIDX_POSTGRESQLSSLKEY"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected the error to name %s, got %v", want, err)
+		}
+	}
+
+	p = defaultParams(t)
+	p.FlowUrl1 = ""
+	p.AllFlowUrls = flowUrls(p)
+	if err := p.Validate(); err == nil || !strings.Contains(err.Error(), "KEYIDX_FLOWURL1") {
+		t.Errorf("Expected an access node to be required, got %v", err)
+	}
+	p.Mode = ModeAPI
+	if err := p.Validate(); err != nil {
+		t.Errorf("Expected the api mode to need no access node, got %v", err)
+	}
+}
+
+type networkClient struct {
+	access.Client
+	chain flow.ChainID
+}
+
+func (c networkClient) GetNetworkParameters(context.Context) (*flow.NetworkParameters, error) {
+	return &flow.NetworkParameters{ChainID: c.chain}, nil
+}
+
+func TestCheckAccessNode(t *testing.T) {
+	p := defaultParams(t)
+	if err := p.CheckAccessNode(context.Background(), networkClient{chain: flow.Mainnet}); err != nil {
+		t.Errorf("Expected a mainnet node to match, got %v", err)
+	}
+	err := p.CheckAccessNode(context.Background(), networkClient{chain: flow.Testnet})
+	if err == nil || !strings.Contains(err.Error(), "flow-testnet") {
+		t.Errorf("Expected a testnet node to be rejected, got %v", err)
+	}
+}
+
+func TestPostgresSSLMode(t *testing.T) {
+	p := defaultParams(t)
+	if mode := p.PostgresConfig().SSLMode; mode != "disable" {
+		t.Errorf("Expected TLS to be off by default, got sslmode %q", mode)
+	}
+	p.PostgreSQLSSL = true
+	if mode := p.PostgresConfig().SSLMode; mode != "require" {
+		t.Errorf("Expected sslmode require, got %q", mode)
+	}
+	p.PostgreSQLSSLMode = "verify-full"
+	if mode := p.PostgresConfig().SSLMode; mode != "verify-full" {
+		t.Errorf("Expected the ssl mode to override postgresqlssl, got %q", mode)
+	}
+}
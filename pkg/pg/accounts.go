@@ -0,0 +1,172 @@
+package pg
+
+import (
+	"context"
+	"encoding/hex"
+	"time"
+
+	"example/flow-key-indexer/model"
+	"example/flow-key-indexer/utils"
+
+	"gorm.io/gorm/clause"
+)
+
+// accountRow is the typed accounts table row behind model.AccountRecord.
+type accountRow struct {
+	Address             []byte    `gorm:"column:address;primaryKey"`
+	Status              string    `gorm:"column:status"`
+	KeyCount            int       `gorm:"column:key_count"`
+	LastRefreshedHeight uint64    `gorm:"column:last_refreshed_height"`
+	LastRefreshedAt     time.Time `gorm:"column:last_refreshed_at"`
+	LastError           *string   `gorm:"column:last_error"`
+}
+
+func (accountRow) TableName() string {
+	return "accounts"
+}
+
+// registerKeyAccountsSQL adds the accounts of the stored keys that are not in
+// the registry yet, as refreshed at the height of their newest key.
+const registerKeyAccountsSQL = `
+	INSERT INTO accounts (address, status, key_count, last_refreshed_height, last_refreshed_at)
+	SELECT account, 'ok', count(*), max(updated_height), coalesce(max(updated_at), now())
+	FROM publickeyindexer
+	GROUP BY account
+	ON CONFLICT (address) DO NOTHING;`
+
+// RegisterKeyAccounts records the accounts of keys loaded without a refresh,
+// such as imported ones, in the registry and returns how many were added.
+func (s Store) RegisterKeyAccounts(ctx context.Context) (int64, error) {
+	result := s.db.WithContext(ctx).Exec(registerKeyAccountsSQL)
+	return result.RowsAffected, result.Error
+}
+
+// keepOnError keeps the stored value of column when the new record is a
+// failed refresh.
+func keepOnError(column string) clause.Assignment {
+	return clause.Assignment{
+		Column: clause.Column{Name: column},
+		Value: clause.Expr{SQL: "CASE WHEN EXCLUDED.status = ? THEN accounts." + column + " ELSE EXCLUDED." + column + " END",
+			Vars: []interface{}{model.AccountStatusError}},
+	}
+}
+
+// UpsertAccounts records the outcome of refreshing accounts. A record read at
+// a lower height than the stored one does not overwrite it. A failed refresh
+// only sets the status and error, the account keeps the key count and height
+// of its last successful refresh.
+func (s Store) UpsertAccounts(ctx context.Context, records []model.AccountRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	rows := make([]accountRow, 0, len(records))
+	seen := make(map[string]int, len(records))
+	for _, r := range records {
+		address, err := utils.AccountToBytes(r.Address)
+		if err != nil {
+			s.logger.Warn().Err(err).Msg("Skipping account record")
+			continue
+		}
+		row := accountRow{
+			Address:             address,
+			Status:              r.Status,
+			KeyCount:            r.KeyCount,
+			LastRefreshedHeight: r.LastRefreshedHeight,
+			LastRefreshedAt:     r.LastRefreshedAt,
+		}
+		if r.Status == model.AccountStatusError {
+			row.LastRefreshedHeight = 0
+		}
+		if row.LastRefreshedAt.IsZero() {
+			row.LastRefreshedAt = time.Now()
+		}
+		if r.LastError != "" {
+			lastError := r.LastError
+			row.LastError = &lastError
+		}
+		// one row per address, ON CONFLICT cannot touch a row twice
+		if i, ok := seen[string(address)]; ok {
+			rows[i] = row
+			continue
+		}
+		seen[string(address)] = len(rows)
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	return s.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "address"}},
+		DoUpdates: append(clause.AssignmentColumns([]string{"status", "last_error"}),
+			keepOnError("key_count"),
+			keepOnError("last_refreshed_height"),
+			keepOnError("last_refreshed_at"),
+		),
+		Where: clause.Where{Exprs: []clause.Expression{
+			clause.Expr{SQL: "EXCLUDED.status = ? OR accounts.last_refreshed_height <= EXCLUDED.last_refreshed_height",
+				Vars: []interface{}{model.AccountStatusError}},
+		}},
+	}).CreateInBatches(rows, stagingBatchSize).Error
+}
+
+// GetAccount returns the registry entry of an account, ErrNoRows when unknown.
+func (s Store) GetAccount(address string) (model.AccountRecord, error) {
+	accountBytes, err := utils.AccountToBytes(address)
+	if err != nil {
+		return model.AccountRecord{}, ErrInvalidAccount
+	}
+
+	var rows []accountRow
+	if err := s.db.Where("address = ?", accountBytes).Limit(1).Find(&rows).Error; err != nil {
+		return model.AccountRecord{}, err
+	}
+	if len(rows) == 0 {
+		return model.AccountRecord{}, ErrNoRows
+	}
+	return rows[0].toRecord(), nil
+}
+
+// GetAccountRefreshHeights returns the height each of the addresses was last
+// read at, keyed by 0x prefixed address. Accounts whose last refresh failed
+// are left out.
+func (s Store) GetAccountRefreshHeights(addresses []string) (map[string]uint64, error) {
+	heights := make(map[string]uint64, len(addresses))
+	accountBytes := make([][]byte, 0, len(addresses))
+	for _, address := range addresses {
+		b, err := utils.AccountToBytes(address)
+		if err != nil {
+			s.logger.Warn().Err(err).Msgf("Skipping invalid account %s", address)
+			continue
+		}
+		accountBytes = append(accountBytes, b)
+	}
+	if len(accountBytes) == 0 {
+		return heights, nil
+	}
+
+	var rows []accountRow
+	err := s.db.
+		Select("address", "last_refreshed_height").
+		Where("address IN ? AND status <> ?", accountBytes, model.AccountStatusError).
+		Find(&rows).Error
+	for _, r := range rows {
+		heights[utils.Add0xPrefix(hex.EncodeToString(r.Address))] = r.LastRefreshedHeight
+	}
+	return heights, err
+}
+
+func (r accountRow) toRecord() model.AccountRecord {
+	record := model.AccountRecord{
+		Address:             utils.Add0xPrefix(hex.EncodeToString(r.Address)),
+		Status:              r.Status,
+		KeyCount:            r.KeyCount,
+		LastRefreshedHeight: r.LastRefreshedHeight,
+		LastRefreshedAt:     r.LastRefreshedAt,
+	}
+	if r.LastError != nil {
+		record.LastError = *r.LastError
+	}
+	return record
+}
@@ -0,0 +1,219 @@
+package pg
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"sort"
+
+	"example/flow-key-indexer/model"
+	"example/flow-key-indexer/utils"
+
+	"github.com/jackc/pgx/v5"
+	"gorm.io/gorm"
+)
+
+// relatedAccountsSQL lists the accounts sharing an unrevoked key with any of
+// the accounts in ?, the accounts themselves included.
+const relatedAccountsSQL = `
+	SELECT DISTINCT b.account
+	FROM publickeyindexer a
+	JOIN publickeyindexer b ON b.publickey = a.publickey AND NOT b.isrevoked
+	WHERE a.account IN ? AND NOT a.isrevoked
+	LIMIT ?`
+
+// sharedKeysSQL streams the accounts of every unrevoked key held by more
+// than one account, grouped by key.
+const sharedKeysSQL = `
+	SELECT publickey, account
+	FROM publickeyindexer
+	WHERE NOT isrevoked AND publickey IN (
+		SELECT publickey FROM publickeyindexer
+		WHERE NOT isrevoked
+		GROUP BY publickey
+		HAVING count(DISTINCT account) > 1)
+	ORDER BY publickey`
+
+// accountClusterRow is the account_clusters table row.
+type accountClusterRow struct {
+	Account     []byte `gorm:"column:account;primaryKey"`
+	ClusterID   []byte `gorm:"column:cluster_id"`
+	ClusterSize int    `gorm:"column:cluster_size"`
+}
+
+func (accountClusterRow) TableName() string {
+	return "account_clusters"
+}
+
+// GetAccountCluster walks the accounts connected to account by shared
+// unrevoked keys breadth first, up to maxDepth keys away and maxSize accounts.
+func (s Store) GetAccountCluster(ctx context.Context, account string, maxDepth int, maxSize int) (model.AccountCluster, error) {
+	start, err := utils.AccountToBytes(account)
+	if err != nil {
+		return model.AccountCluster{}, ErrInvalidAccount
+	}
+	cluster := model.AccountCluster{
+		Address:  utils.Add0xPrefix(hex.EncodeToString(start)),
+		Accounts: []model.ClusterAccount{},
+		Complete: true,
+	}
+
+	seen := map[string]bool{string(start): true}
+	frontier := [][]byte{start}
+	// one level past maxDepth tells whether the walk is complete
+	for depth := 1; len(frontier) > 0 && depth <= maxDepth+1; depth++ {
+		var related []accountClusterRow
+		// every seen account can come back, the rest is capped by maxSize
+		err := s.reader().WithContext(ctx).Raw(relatedAccountsSQL, frontier, len(seen)+maxSize+1).Scan(&related).Error
+		if err != nil {
+			return model.AccountCluster{}, err
+		}
+		sort.Slice(related, func(i, j int) bool { return string(related[i].Account) < string(related[j].Account) })
+
+		frontier = nil
+		for _, r := range related {
+			address := r.Account
+			if seen[string(address)] {
+				continue
+			}
+			if depth > maxDepth || len(cluster.Accounts) == maxSize {
+				cluster.Complete = false
+				break
+			}
+			seen[string(address)] = true
+			frontier = append(frontier, address)
+			cluster.Accounts = append(cluster.Accounts, model.ClusterAccount{
+				Address: utils.Add0xPrefix(hex.EncodeToString(address)),
+				Depth:   depth,
+			})
+		}
+		if !cluster.Complete {
+			break
+		}
+	}
+
+	var row accountClusterRow
+	err = s.reader().WithContext(ctx).Where("account = ?", start).Take(&row).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return model.AccountCluster{}, err
+	}
+	if err == nil {
+		cluster.ClusterID = utils.Add0xPrefix(hex.EncodeToString(row.ClusterID))
+		cluster.ClusterSize = row.ClusterSize
+	}
+	return cluster, nil
+}
+
+// ComputeAccountClusters rewrites account_clusters with the connected
+// components of the shared key graph that have at least minSize accounts and
+// returns the number of clusters stored.
+func (s Store) ComputeAccountClusters(ctx context.Context, minSize int) (int, error) {
+	rows, err := s.db.pool.Query(ctx, sharedKeysSQL)
+	if err != nil {
+		return 0, err
+	}
+	components := newAccountUnion()
+	var lastKey []byte
+	var first uint64
+	for rows.Next() {
+		var key, account []byte
+		if err := rows.Scan(&key, &account); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		address := binary.BigEndian.Uint64(account)
+		if string(key) != string(lastKey) {
+			lastKey, first = key, address
+		}
+		components.union(first, address)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	members := make(map[uint64][]uint64)
+	for address := range components.parent {
+		root := components.find(address)
+		members[root] = append(members[root], address)
+	}
+	var clusters [][]uint64
+	var size int
+	for _, accounts := range members {
+		if len(accounts) >= minSize {
+			clusters = append(clusters, accounts)
+			size += len(accounts)
+		}
+	}
+	copyRows := make([][]any, 0, size)
+	for _, accounts := range clusters {
+		id := accounts[0]
+		for _, address := range accounts {
+			if address < id {
+				id = address
+			}
+		}
+		for _, address := range accounts {
+			copyRows = append(copyRows, []any{accountBytes(address), accountBytes(id), len(accounts)})
+		}
+	}
+
+	tx, err := s.db.pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, "DELETE FROM account_clusters"); err != nil {
+		return 0, err
+	}
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"account_clusters"}, []string{"account", "cluster_id", "cluster_size"}, pgx.CopyFromRows(copyRows))
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	s.logger.Info().Msgf("Stored %d account clusters of %d accounts", len(clusters), len(copyRows))
+	return len(clusters), nil
+}
+
+func accountBytes(address uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, address)
+	return b
+}
+
+// accountUnion is a union-find over account addresses.
+type accountUnion struct {
+	parent map[uint64]uint64
+}
+
+func newAccountUnion() accountUnion {
+	return accountUnion{parent: make(map[uint64]uint64)}
+}
+
+func (u accountUnion) find(address uint64) uint64 {
+	root, ok := u.parent[address]
+	if !ok {
+		u.parent[address] = address
+		return address
+	}
+	for root != u.parent[root] {
+		root = u.parent[root]
+	}
+	// compress the path to the root
+	for address != root {
+		next := u.parent[address]
+		u.parent[address] = root
+		address = next
+	}
+	return root
+}
+
+func (u accountUnion) union(a uint64, b uint64) {
+	rootA, rootB := u.find(a), u.find(b)
+	if rootA != rootB {
+		u.parent[rootB] = rootA
+	}
+}
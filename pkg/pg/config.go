@@ -1,7 +1,6 @@
 package pg
 
 import (
-	"crypto/tls"
 	"time"
 )
 
@@ -11,6 +10,19 @@ type DatabaseConfig struct {
 	Name     string
 	Host     string
 	Port     int
+	// SSLMode is a libpq sslmode: disable, require, verify-ca or verify-full.
+	// The certificate files are optional paths in PEM format.
+	SSLMode     string
+	SSLRootCert string
+	SSLCert     string
+	SSLKey      string
+	// ReplicaDSNs are read replicas serving the API reads
+	ReplicaDSNs []string
+	// MaxReplicaLag is how far a replica may fall behind before its reads go
+	// to the primary
+	MaxReplicaLag time.Duration
+
+	Config
 }
 
 // Config is the service configuration
@@ -20,6 +32,8 @@ type Config struct {
 	PGApplicationName   string
 	PGLoggerPrefix      string
 	PGPoolSize          int
+	// LogQueries logs every SQL statement run through GORM
+	LogQueries bool
 }
 
 // ConnectPGOptions attempts to connect to a pg instance;
@@ -28,9 +42,7 @@ type ConnectPGOptions struct {
 	ConnectionString string
 	RetrySleepTime   time.Duration
 	RetryNumTimes    uint16
-	// TLSConfig overrides any TLS config parsed from the connection string if not nil
-	TLSConfig       *tls.Config
-	ConnErrorLogger LogConErrorFunc
+	ConnErrorLogger  LogConErrorFunc
 }
 
 type LogConErrorFunc func(
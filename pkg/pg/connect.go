@@ -1,9 +1,14 @@
 package pg
 
 import (
+	"context"
 	"fmt"
+	"strings"
 	"time"
 
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/jackc/pgx/v5/tracelog"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"gorm.io/driver/postgres"
@@ -11,6 +16,9 @@ import (
 	"gorm.io/gorm/logger"
 )
 
+// defaultPoolSize is used when the configuration leaves the pool size unset
+const defaultPoolSize = 20
+
 // CustomLogger wraps zerolog and implements the Printf method required by GORM's logger interface.
 type CustomLogger struct {
 	Zerologger zerolog.Logger
@@ -21,23 +29,150 @@ func (cl CustomLogger) Printf(format string, v ...interface{}) {
 }
 
 func getDSN(conf DatabaseConfig) string {
+	if conf.ConnectionString != "" {
+		return conf.ConnectionString
+	}
 
+	sslMode := conf.SSLMode
+	if sslMode == "" {
+		sslMode = "disable"
+	}
 	dsn := fmt.Sprintf(
-		"host=%s user=%s password=%s dbname=%s port=%d sslmode=disable",
-		conf.Host,
-		conf.User,
-		conf.Password,
-		conf.Name,
+		"host=%s user=%s password=%s dbname=%s port=%d sslmode=%s",
+		dsnValue(conf.Host),
+		dsnValue(conf.User),
+		dsnValue(conf.Password),
+		dsnValue(conf.Name),
 		conf.Port,
+		dsnValue(sslMode),
 	)
+	for _, file := range []struct{ key, path string }{
+		{"sslrootcert", conf.SSLRootCert},
+		{"sslcert", conf.SSLCert},
+		{"sslkey", conf.SSLKey},
+	} {
+		if file.path != "" {
+			dsn += " " + file.key + "=" + dsnValue(file.path)
+		}
+	}
 
 	return dsn
 }
 
-// connectPG will attempt to connect to a Postgres database.
-func connectPG(conf DatabaseConfig) (*gorm.DB, error) {
+// dsnValue quotes a keyword/value connection string value when needed.
+func dsnValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, ` '\`) {
+		return value
+	}
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
+
+// withConnectRetry calls connect until it succeeds or the configured attempts
+// run out, reporting every failed attempt to the ConnErrorLogger.
+func withConnectRetry(conf DatabaseConfig, connect func() error) error {
+	attempts := int(conf.RetryNumTimes)
+	if attempts < 1 {
+		attempts = 1
+	}
+	logConnError := conf.ConnErrorLogger
+	if logConnError == nil {
+		logConnError = logConnectionError
+	}
+	ssl := conf.SSLMode != "" && conf.SSLMode != "disable"
+
+	start := time.Now()
+	var err error
+	for try := 1; try <= attempts; try++ {
+		if err = connect(); err == nil {
+			return nil
+		}
+		logConnError(try, time.Since(start), conf.Host, conf.Name, conf.User, ssl, err)
+		if try < attempts {
+			time.Sleep(conf.RetrySleepTime)
+		}
+	}
+	return err
+}
+
+// logConnectionError is the default LogConErrorFunc.
+func logConnectionError(numTries int, duration time.Duration, host string, db string, user string, ssl bool, err error) {
+	log.Warn().Err(err).
+		Int("attempt", numTries).
+		Dur("elapsed", duration).
+		Str("host", host).
+		Str("database", db).
+		Str("user", user).
+		Bool("ssl", ssl).
+		Msg("Could not connect to database")
+}
+
+// newPool opens the pgx pool for the database at dsn, sized and configured
+// from conf. GORM and COPY loads share it.
+func newPool(ctx context.Context, dsn string, conf DatabaseConfig) (*pgxpool.Pool, error) {
+	poolConfig, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse database connection string: %w", err)
+	}
+
+	poolConfig.MaxConns = defaultPoolSize
+	if conf.PGPoolSize > 0 {
+		poolConfig.MaxConns = int32(conf.PGPoolSize)
+	}
+	poolConfig.MaxConnLifetime = time.Hour        // Recycle connections every 1 hour
+	poolConfig.MaxConnIdleTime = 15 * time.Minute // Close idle connections after 15 minutes
+	if conf.PGApplicationName != "" {
+		poolConfig.ConnConfig.RuntimeParams["application_name"] = conf.PGApplicationName
+	}
+	if conf.SetInternalPGLogger {
+		poolConfig.ConnConfig.Tracer = &tracelog.TraceLog{
+			Logger:   pgxLogger(log.Logger.With().Str("component", conf.PGLoggerPrefix).Logger()),
+			LogLevel: tracelog.LogLevelInfo,
+		}
+	}
+
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		return nil, err
+	}
+	// the pool connects lazily, check the database can be reached
+	err = withConnectRetry(conf, func() error {
+		return pool.Ping(ctx)
+	})
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return pool, nil
+}
+
+// pgxLogger writes the pgx driver's logs to zerolog.
+func pgxLogger(logger zerolog.Logger) tracelog.Logger {
+	return tracelog.LoggerFunc(func(ctx context.Context, level tracelog.LogLevel, msg string, data map[string]any) {
+		var event *zerolog.Event
+		switch level {
+		case tracelog.LogLevelError:
+			event = logger.Error()
+		case tracelog.LogLevelWarn:
+			event = logger.Warn()
+		case tracelog.LogLevelInfo:
+			event = logger.Info()
+		default:
+			event = logger.Debug()
+		}
+		event.Fields(data).Msg(msg)
+	})
+}
+
+// connectPG will attempt to connect to the Postgres database at dsn, GORM
+// runs its queries on the returned pool.
+func connectPG(dsn string, conf DatabaseConfig) (*gorm.DB, *pgxpool.Pool, error) {
+	pool, err := newPool(context.Background(), dsn, conf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
 	cfg := postgres.Config{
-		DSN: getDSN(conf),
+		Conn: stdlib.OpenDBFromPool(pool),
 	}
 
 	dial := postgres.New(cfg)
@@ -47,12 +182,18 @@ func connectPG(conf DatabaseConfig) (*gorm.DB, error) {
 		Zerologger: log.Logger,
 	}
 
+	// Adjust the log level to suppress slow SQL logs unless queries are logged
+	logLevel := logger.Silent
+	if conf.LogQueries {
+		logLevel = logger.Info
+	}
+
 	// Set custom logger for GORM
 	newLogger := logger.New(
 		customLogger, // Use custom zerolog for logging
 		logger.Config{
-			SlowThreshold:             time.Second,   // Customize the slow query threshold
-			LogLevel:                  logger.Silent, // Adjust the log level to suppress slow SQL logs
+			SlowThreshold:             time.Second, // Customize the slow query threshold
+			LogLevel:                  logLevel,
 			IgnoreRecordNotFoundError: true,
 			Colorful:                  false,
 		},
@@ -62,20 +203,9 @@ func connectPG(conf DatabaseConfig) (*gorm.DB, error) {
 		Logger: newLogger,
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to database: %w", err)
+		pool.Close()
+		return nil, nil, fmt.Errorf("failed to connect to database: %w", err)
 	}
 
-	// Set up connection pooling
-	sqlDB, err := gormDB.DB()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get sql.DB from Gorm DB: %w", err)
-	}
-
-	// Configure connection pool settings
-	sqlDB.SetMaxIdleConns(20)                  // Adjust based on expected idle time and load
-	sqlDB.SetMaxOpenConns(100)                 // Adjust based on database server capacity and peak load
-	sqlDB.SetConnMaxLifetime(time.Hour)        // Recycle connections every 1 hour
-	sqlDB.SetConnMaxIdleTime(15 * time.Minute) // Close idle connections after 15 minutes
-
-	return gormDB, nil
+	return gormDB, pool, nil
 }
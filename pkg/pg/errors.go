@@ -14,6 +14,14 @@ var (
 	ErrMultiRows = errors.New("pg: many rows returned, one expected")
 	// ErrInvalidEnumValue typical error when the enum value is invalid
 	ErrInvalidEnumValue = errors.New("pg: invalid value for enum")
+	// ErrInvalidPublicKey is returned when a public key is not a hex string
+	ErrInvalidPublicKey = errors.New("pg: invalid public key, expected hex")
+	// ErrInvalidAccount is returned when an account is not a Flow address
+	ErrInvalidAccount = errors.New("pg: invalid account address")
+	// ErrInvalidSearch is returned when a key search is missing or too broad
+	ErrInvalidSearch = errors.New("pg: invalid key search")
+	// ErrInvalidEVMAddress is returned when an EVM address is not 20 hex bytes
+	ErrInvalidEVMAddress = errors.New("pg: invalid EVM address, expected 20 hex bytes")
 )
 
 func convertError(err error) error {
@@ -0,0 +1,94 @@
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"example/flow-key-indexer/model"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+)
+
+// ExportFilter narrows an export, zero values select every key.
+type ExportFilter struct {
+	SigAlgo int
+	// SinceHeight keeps the keys read at or after the height
+	SinceHeight uint64
+}
+
+// KeySnapshot streams the stored keys from a single repeatable read
+// transaction, Height is the loaded block height seen by that transaction.
+// The cursor only records that the accounts with key events up to Height were
+// queued, Pending are the ones still waiting in the queue: their keys in the
+// snapshot may be older than Height.
+type KeySnapshot struct {
+	Height  uint64
+	Pending []string
+	tx      *gorm.DB
+	rows    *sql.Rows
+}
+
+// OpenKeySnapshot starts a read only transaction on the primary and queries
+// the keys matching filter. The snapshot has to be closed. Replicas are not
+// used: a transaction held for a whole export on a hot standby is cancelled
+// by recovery conflicts once it outlasts max_standby_streaming_delay.
+func (s Store) OpenKeySnapshot(ctx context.Context, filter ExportFilter) (*KeySnapshot, error) {
+	tx := s.db.DB.WithContext(ctx).Begin(&sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	snapshot := &KeySnapshot{tx: tx}
+
+	err := tx.Raw("SELECT pendingBlockheight FROM publickeyindexer_stats").Scan(&snapshot.Height).Error
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	err = tx.Table("addressprocessing").Where("priority = ?", PriorityEvent).Order("account").Pluck("account", &snapshot.Pending).Error
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	query := tx.Table("publickeyindexer").Select(publicKeyReadColumns)
+	if filter.SigAlgo != 0 {
+		query = query.Where("sigalgo = ?", filter.SigAlgo)
+	}
+	if filter.SinceHeight != 0 {
+		query = query.Where("updated_height >= ?", filter.SinceHeight)
+	}
+	snapshot.rows, err = query.Rows()
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// Next reads the next key, ok is false once all keys are read.
+func (k *KeySnapshot) Next() (key model.PublicKeyAccountIndexer, ok bool, err error) {
+	if !k.rows.Next() {
+		return key, false, snapshotError(k.rows.Err())
+	}
+	err = k.tx.ScanRows(k.rows, &key)
+	return key, err == nil, snapshotError(err)
+}
+
+// snapshotError explains the cancellation of a snapshot read from a standby,
+// which happens when the database of a process is a read replica.
+func snapshotError(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "40001" {
+		return fmt.Errorf("the snapshot was cancelled by a conflict with recovery on a standby, export from the primary or raise max_standby_streaming_delay: %w", err)
+	}
+	return err
+}
+
+// Close releases the rows and ends the transaction.
+func (k *KeySnapshot) Close() error {
+	k.rows.Close()
+	return k.tx.Rollback().Error
+}
@@ -0,0 +1,77 @@
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Advisory lock keys of the jobs that only one replica may run at a time
+const (
+	// LockIncremental guards the incremental loader and the block cursor
+	LockIncremental int64 = 0x6b6579696478_01
+	// LockMaintenance guards the legacy drain and the stats refresh
+	LockMaintenance int64 = 0x6b6579696478_02
+	// LockTruncated guards the fetch of the keys of truncated accounts
+	LockTruncated int64 = 0x6b6579696478_03
+)
+
+// leaderCheckInterval is how often a leader verifies it still holds its lock
+const leaderCheckInterval = 10 * time.Second
+
+// Leadership is a session advisory lock held on a dedicated connection. The
+// lock is released by Postgres when the connection goes away, so a replica
+// that dies hands over leadership automatically.
+type Leadership struct {
+	conn *sql.Conn
+	key  int64
+}
+
+// TryLeadership takes the advisory lock key without waiting, it returns nil
+// when another replica holds it.
+func (s Store) TryLeadership(ctx context.Context, key int64) (*Leadership, error) {
+	sqlDB, err := s.db.DB.DB()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var acquired bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&acquired); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !acquired {
+		conn.Close()
+		return nil, nil
+	}
+	return &Leadership{conn: conn, key: key}, nil
+}
+
+// Hold blocks while the lock is held, it returns when the lock connection
+// fails or ctx is done.
+func (l *Leadership) Hold(ctx context.Context) error {
+	ticker := time.NewTicker(leaderCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := l.conn.PingContext(ctx); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Release gives up the lock and the connection holding it.
+func (l *Leadership) Release() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _ = l.conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", l.key)
+	l.conn.Close()
+}
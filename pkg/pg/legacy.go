@@ -0,0 +1,147 @@
+package pg
+
+import (
+	"context"
+	"time"
+
+	"example/flow-key-indexer/model"
+	"example/flow-key-indexer/utils"
+)
+
+// legacyTable holds the varchar rows renamed away by migration 0003. It only
+// exists until DrainLegacyKeys has converted all of them.
+const legacyTable = "publickeyindexer_legacy"
+
+// drainLegacySQL moves one batch from the legacy table into the typed table.
+// Rows that cannot be converted are dropped and reported by the counts, rows
+// already written by the running service win over legacy data. The "blank"
+// rows of accounts without keys are registered as keyless accounts instead.
+// An account's rows can span batches, so its key count is increased by the
+// keys each batch inserted rather than set by the first one.
+const drainLegacySQL = `
+	WITH moved AS (
+		DELETE FROM publickeyindexer_legacy
+		WHERE ctid IN (SELECT ctid FROM publickeyindexer_legacy LIMIT ?)
+		RETURNING account, keyid, publickey, weight, sigalgo, hashalgo, isrevoked, updated_height, updated_at
+	), valid AS (
+		SELECT * FROM moved
+		WHERE account ~ '^(0x){0,1}[0-9a-fA-F]{1,16}$'
+		AND (publickey = 'blank' OR publickey ~ '^(0x){0,1}([0-9a-fA-F]{2})+$')
+		AND keyid >= 0
+		AND coalesce(weight, 0) BETWEEN 0 AND 1000
+		AND coalesce(sigalgo, 0) BETWEEN 0 AND 3
+		AND coalesce(hashalgo, 0) BETWEEN 0 AND 6
+	), inserted AS (
+		INSERT INTO publickeyindexer (account, keyid, publickey, weight, sigalgo, hashalgo, isrevoked, updated_height, updated_at)
+		SELECT DISTINCT ON (account, keyid, publickey)
+			account, keyid, publickey, weight, sigalgo, hashalgo, isrevoked, updated_height, updated_at
+		FROM (
+			SELECT ` + stagedAccountSQL + ` AS account, keyid, ` + stagedPublicKeySQL + ` AS publickey,
+				coalesce(weight, 0) AS weight, coalesce(sigalgo, 0) AS sigalgo, coalesce(hashalgo, 0) AS hashalgo,
+				coalesce(isrevoked, FALSE) AS isrevoked, updated_height, updated_at
+			FROM valid
+			WHERE publickey <> 'blank'
+		) converted
+		ORDER BY account, keyid, publickey, updated_height DESC
+		ON CONFLICT (account, keyid, publickey) DO NOTHING
+		RETURNING account
+	), registered AS (
+		INSERT INTO accounts (address, status, key_count, last_refreshed_height, last_refreshed_at)
+		SELECT batch.address,
+			CASE WHEN batch.keyless THEN 'keyless' ELSE 'ok' END,
+			coalesce(added.key_count, 0),
+			batch.last_refreshed_height,
+			batch.last_refreshed_at
+		FROM (
+			SELECT ` + stagedAccountSQL + ` AS address,
+				bool_and(publickey = 'blank') AS keyless,
+				max(updated_height) AS last_refreshed_height,
+				max(updated_at) AS last_refreshed_at
+			FROM valid
+			GROUP BY 1
+		) batch
+		LEFT JOIN (
+			SELECT account AS address, count(*) AS key_count FROM inserted GROUP BY account
+		) added USING (address)
+		ON CONFLICT (address) DO UPDATE SET
+			key_count = accounts.key_count + EXCLUDED.key_count,
+			status = CASE
+				WHEN accounts.status = 'keyless' AND EXCLUDED.key_count > 0 THEN 'ok'
+				ELSE accounts.status
+			END
+	)
+	SELECT
+		(SELECT count(*) FROM moved) AS moved,
+		(SELECT count(*) FROM valid) AS valid,
+		(SELECT count(*) FROM inserted) AS inserted;`
+
+// detectLegacyTable records whether legacy rows still have to be drained.
+func (s *Store) detectLegacyTable() error {
+	var exists bool
+	err := s.db.Raw("SELECT to_regclass(?) IS NOT NULL", legacyTable).Scan(&exists).Error
+	if err != nil {
+		return err
+	}
+	s.legacyPending.Store(exists)
+	return nil
+}
+
+// DrainLegacyKeys converts the rows left in the legacy varchar table into the
+// typed table, batchSize rows at a time with a pause in between so the
+// service keeps serving, and drops the legacy table once it is empty.
+func (s *Store) DrainLegacyKeys(ctx context.Context, batchSize int, pause time.Duration) error {
+	if !s.legacyPending.Load() {
+		return nil
+	}
+	s.logger.Info().Msg("Converting legacy public key rows to typed columns")
+
+	var total, dropped int64
+	for {
+		var counts struct {
+			Moved    int64
+			Valid    int64
+			Inserted int64
+		}
+		err := s.db.WithContext(ctx).Raw(drainLegacySQL, batchSize).Scan(&counts).Error
+		if err != nil {
+			return err
+		}
+
+		total += counts.Moved
+		if invalid := counts.Moved - counts.Valid; invalid > 0 {
+			dropped += invalid
+			s.logger.Warn().Msgf("Dropped %d legacy rows that could not be converted", invalid)
+		}
+		s.logger.Debug().Msgf("Converted %d legacy rows, %d inserted", counts.Moved, counts.Inserted)
+
+		if counts.Moved == 0 {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pause):
+		}
+	}
+
+	if err := s.db.WithContext(ctx).Exec("DROP TABLE IF EXISTS " + legacyTable).Error; err != nil {
+		return err
+	}
+	s.legacyPending.Store(false)
+	s.logger.Info().Msgf("Legacy public key rows converted, %d rows moved, %d dropped", total, dropped)
+	return nil
+}
+
+// legacyAccountsByPublicKey returns rows for the key that were not drained yet.
+func (s Store) legacyAccountsByPublicKey(publicKey string) ([]model.PublicKeyAccountIndexer, error) {
+	var legacy []model.PublicKeyAccountIndexer
+	if !s.legacyPending.Load() {
+		return legacy, nil
+	}
+	err := s.reader().Table(legacyTable).Where("publickey = ?", publicKey).Find(&legacy).Error
+	for i := range legacy {
+		legacy[i].Account = utils.FixAccountLength(legacy[i].Account)
+	}
+	return legacy, err
+}
@@ -0,0 +1,150 @@
+package pg
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/golang-migrate/migrate"
+	"github.com/golang-migrate/migrate/database/postgres"
+	bindata "github.com/golang-migrate/migrate/source/go_bindata"
+	"github.com/rs/zerolog"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+const migrationsDir = "migrations"
+
+// Migrator applies the versioned schema migrations embedded in the binary.
+type Migrator struct {
+	m      *migrate.Migrate
+	logger zerolog.Logger
+}
+
+// migrateLogger adapts zerolog to the golang-migrate logger interface.
+type migrateLogger struct {
+	logger zerolog.Logger
+}
+
+func (l migrateLogger) Printf(format string, v ...interface{}) {
+	l.logger.Info().Msgf("Migrate "+format, v...)
+}
+
+func (l migrateLogger) Verbose() bool {
+	return l.logger.GetLevel() <= zerolog.DebugLevel
+}
+
+// NewMigrator opens a dedicated connection for running migrations, it is
+// closed again by Close.
+func NewMigrator(conf DatabaseConfig, logger zerolog.Logger) (*Migrator, error) {
+	entries, err := migrationFiles.ReadDir(migrationsDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read embedded migrations: %w", err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+
+	source, err := bindata.WithInstance(bindata.Resource(names, func(name string) ([]byte, error) {
+		return migrationFiles.ReadFile(path.Join(migrationsDir, name))
+	}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load embedded migrations: %w", err)
+	}
+
+	// lib/pq is registered as "postgres" by the migrate postgres driver
+	sqlDB, err := sql.Open("postgres", getDSN(conf))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open migration connection: %w", err)
+	}
+	if err := withConnectRetry(conf, sqlDB.Ping); err != nil {
+		sqlDB.Close()
+		return nil, fmt.Errorf("failed to open migration connection: %w", err)
+	}
+	driver, err := postgres.WithInstance(sqlDB, &postgres.Config{})
+	if err != nil {
+		sqlDB.Close()
+		return nil, fmt.Errorf("failed to create migration driver: %w", err)
+	}
+
+	m, err := migrate.NewWithInstance("go-bindata", source, "postgres", driver)
+	if err != nil {
+		driver.Close()
+		return nil, fmt.Errorf("failed to create migrator: %w", err)
+	}
+	m.Log = migrateLogger{logger: logger}
+
+	return &Migrator{m: m, logger: logger}, nil
+}
+
+// Up applies all pending migrations.
+func (mg *Migrator) Up() error {
+	err := mg.m.Up()
+	if errors.Is(err, migrate.ErrNoChange) {
+		mg.logger.Info().Msg("Database schema is up to date")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to apply migrations: %w", err)
+	}
+	mg.logMigrationVersion()
+	return nil
+}
+
+// Down rolls back the given number of migrations, all of them when steps is 0.
+func (mg *Migrator) Down(steps int) error {
+	var err error
+	if steps == 0 {
+		err = mg.m.Down()
+	} else {
+		err = mg.m.Steps(-steps)
+	}
+	if errors.Is(err, migrate.ErrNoChange) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to roll back migrations: %w", err)
+	}
+	mg.logMigrationVersion()
+	return nil
+}
+
+// Force sets the schema version without running migrations, used to recover
+// from a dirty state after a failed migration was fixed by hand.
+func (mg *Migrator) Force(version int) error {
+	if err := mg.m.Force(version); err != nil {
+		return fmt.Errorf("failed to force version %d: %w", version, err)
+	}
+	return nil
+}
+
+// Version returns the current schema version and whether the last migration failed.
+func (mg *Migrator) Version() (uint, bool, error) {
+	version, dirty, err := mg.m.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		return 0, false, nil
+	}
+	return version, dirty, err
+}
+
+// Close releases the migration connection.
+func (mg *Migrator) Close() error {
+	srcErr, dbErr := mg.m.Close()
+	if srcErr != nil {
+		return srcErr
+	}
+	return dbErr
+}
+
+func (mg *Migrator) logMigrationVersion() {
+	version, dirty, err := mg.Version()
+	if err != nil {
+		mg.logger.Error().Err(err).Msg("Could not read schema version")
+		return
+	}
+	mg.logger.Info().Msgf("Database schema at version %d, dirty %v", version, dirty)
+}
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS addressprocessing;
+DROP TABLE IF EXISTS publickeyindexer_stats;
+DROP TABLE IF EXISTS publickeyindexer;
@@ -0,0 +1,31 @@
+-- Baseline schema. Every statement is idempotent so deployments created
+-- before versioned migrations are adopted without changes.
+CREATE TABLE IF NOT EXISTS publickeyindexer (
+    publickey varchar,
+    account varchar,
+    keyid int,
+    weight int,
+    PRIMARY KEY (publickey, account, keyid)
+);
+
+ALTER TABLE publickeyindexer ADD COLUMN IF NOT EXISTS sigalgo int;
+ALTER TABLE publickeyindexer ADD COLUMN IF NOT EXISTS hashalgo int;
+ALTER TABLE publickeyindexer ADD COLUMN IF NOT EXISTS isrevoked boolean DEFAULT FALSE;
+UPDATE publickeyindexer SET isrevoked = FALSE WHERE isrevoked IS NULL;
+
+CREATE INDEX IF NOT EXISTS public_key_btree_idx ON publickeyindexer USING btree (publickey);
+CREATE INDEX IF NOT EXISTS idx_publickeyindexer_account ON publickeyindexer (account);
+
+CREATE TABLE IF NOT EXISTS publickeyindexer_stats (
+    pendingblockheight int,
+    updatedblockheight int,
+    uniquepublickeys int
+);
+
+INSERT INTO publickeyindexer_stats
+SELECT 0, 0, 0 FROM publickeyindexer_stats HAVING count(*) < 1;
+
+CREATE TABLE IF NOT EXISTS addressprocessing (
+    account varchar PRIMARY KEY,
+    created_at timestamp DEFAULT CURRENT_TIMESTAMP
+);
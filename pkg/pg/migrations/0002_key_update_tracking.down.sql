@@ -0,0 +1,2 @@
+ALTER TABLE publickeyindexer DROP COLUMN IF EXISTS updated_at;
+ALTER TABLE publickeyindexer DROP COLUMN IF EXISTS updated_height;
@@ -0,0 +1,3 @@
+-- Track when and at which block height a key row was last written.
+ALTER TABLE publickeyindexer ADD COLUMN IF NOT EXISTS updated_height bigint NOT NULL DEFAULT 0;
+ALTER TABLE publickeyindexer ADD COLUMN IF NOT EXISTS updated_at timestamptz NOT NULL DEFAULT now();
@@ -0,0 +1,46 @@
+-- Converts back to varchar columns in one pass, including rows that were not
+-- drained from the legacy table yet.
+CREATE TABLE publickeyindexer_text (
+    publickey varchar,
+    account varchar,
+    keyid int,
+    weight int,
+    sigalgo int,
+    hashalgo int,
+    isrevoked boolean DEFAULT FALSE,
+    updated_height bigint NOT NULL DEFAULT 0,
+    updated_at timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (publickey, account, keyid)
+);
+
+INSERT INTO publickeyindexer_text
+SELECT
+    CASE WHEN octet_length(publickey) = 0 THEN 'blank' ELSE encode(publickey, 'hex') END,
+    '0x' || encode(account, 'hex'),
+    keyid, weight, sigalgo, hashalgo, isrevoked, updated_height, updated_at
+FROM publickeyindexer;
+
+DO $$
+BEGIN
+    IF to_regclass('publickeyindexer_legacy') IS NOT NULL THEN
+        INSERT INTO publickeyindexer_text
+        SELECT publickey, account, keyid, weight, sigalgo, hashalgo, isrevoked, updated_height, updated_at
+        FROM publickeyindexer_legacy
+        ON CONFLICT DO NOTHING;
+        DROP TABLE publickeyindexer_legacy;
+    END IF;
+END $$;
+
+DROP TABLE publickeyindexer;
+ALTER TABLE publickeyindexer_text RENAME TO publickeyindexer;
+ALTER TABLE publickeyindexer RENAME CONSTRAINT publickeyindexer_text_pkey TO publickeyindexer_pkey;
+CREATE INDEX public_key_btree_idx ON publickeyindexer USING btree (publickey);
+CREATE INDEX idx_publickeyindexer_account ON publickeyindexer (account);
+
+ALTER TABLE publickeyindexer_stats
+    DROP CONSTRAINT publickeyindexer_stats_one_row,
+    DROP CONSTRAINT publickeyindexer_stats_pkey,
+    DROP COLUMN id,
+    ALTER COLUMN pendingblockheight TYPE int,
+    ALTER COLUMN updatedblockheight TYPE int,
+    ALTER COLUMN uniquepublickeys TYPE int;
@@ -0,0 +1,62 @@
+-- Block heights outgrow int, and the stats table must hold exactly one row.
+DELETE FROM publickeyindexer_stats
+WHERE ctid NOT IN (
+    SELECT ctid FROM publickeyindexer_stats
+    ORDER BY pendingblockheight DESC NULLS LAST
+    LIMIT 1
+);
+
+ALTER TABLE publickeyindexer_stats
+    ALTER COLUMN pendingblockheight TYPE bigint,
+    ALTER COLUMN updatedblockheight TYPE bigint,
+    ALTER COLUMN uniquepublickeys TYPE bigint,
+    ADD COLUMN id boolean NOT NULL DEFAULT TRUE;
+
+UPDATE publickeyindexer_stats SET
+    pendingblockheight = coalesce(pendingblockheight, 0),
+    updatedblockheight = coalesce(updatedblockheight, 0),
+    uniquepublickeys = coalesce(uniquepublickeys, 0);
+
+ALTER TABLE publickeyindexer_stats
+    ALTER COLUMN pendingblockheight SET NOT NULL,
+    ALTER COLUMN pendingblockheight SET DEFAULT 0,
+    ALTER COLUMN updatedblockheight SET NOT NULL,
+    ALTER COLUMN updatedblockheight SET DEFAULT 0,
+    ALTER COLUMN uniquepublickeys SET NOT NULL,
+    ALTER COLUMN uniquepublickeys SET DEFAULT 0,
+    ADD CONSTRAINT publickeyindexer_stats_pkey PRIMARY KEY (id),
+    ADD CONSTRAINT publickeyindexer_stats_one_row CHECK (id);
+
+INSERT INTO publickeyindexer_stats (id) VALUES (TRUE) ON CONFLICT (id) DO NOTHING;
+
+-- The varchar table is kept as publickeyindexer_legacy and drained into the
+-- typed table by the running service in small batches, so existing
+-- deployments keep serving while the data is converted.
+ALTER TABLE publickeyindexer RENAME TO publickeyindexer_legacy;
+ALTER TABLE publickeyindexer_legacy RENAME CONSTRAINT publickeyindexer_pkey TO publickeyindexer_legacy_pkey;
+ALTER INDEX IF EXISTS public_key_btree_idx RENAME TO publickeyindexer_legacy_publickey_idx;
+ALTER INDEX IF EXISTS idx_publickeyindexer_account RENAME TO publickeyindexer_legacy_account_idx;
+
+-- Keys are raw bytes, accounts are 8-byte Flow addresses. An empty key marks
+-- an account without keys. The primary key also serves lookups by key.
+CREATE TABLE publickeyindexer (
+    publickey bytea NOT NULL,
+    account bytea NOT NULL,
+    keyid int NOT NULL,
+    weight int NOT NULL DEFAULT 0,
+    sigalgo smallint NOT NULL DEFAULT 0,
+    hashalgo smallint NOT NULL DEFAULT 0,
+    isrevoked boolean NOT NULL DEFAULT FALSE,
+    updated_height bigint NOT NULL DEFAULT 0,
+    updated_at timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (publickey, account, keyid),
+    CONSTRAINT publickeyindexer_account_length CHECK (octet_length(account) = 8),
+    CONSTRAINT publickeyindexer_keyid_range CHECK (keyid >= 0),
+    CONSTRAINT publickeyindexer_weight_range CHECK (weight BETWEEN 0 AND 1000),
+    -- 0 is unknown, then ECDSA_P256, ECDSA_secp256k1, BLS_BLS12_381
+    CONSTRAINT publickeyindexer_sigalgo_enum CHECK (sigalgo BETWEEN 0 AND 3),
+    -- 0 is unknown, then SHA2_256, SHA2_384, SHA3_256, SHA3_384, KMAC128_BLS_BLS12_381, KECCAK_256
+    CONSTRAINT publickeyindexer_hashalgo_enum CHECK (hashalgo BETWEEN 0 AND 6)
+);
+
+CREATE INDEX idx_publickeyindexer_account ON publickeyindexer (account);
@@ -0,0 +1,9 @@
+ALTER TABLE publickeyindexer DROP CONSTRAINT IF EXISTS publickeyindexer_publickey_not_empty;
+
+INSERT INTO publickeyindexer (publickey, account, keyid, weight, updated_height, updated_at)
+SELECT ''::bytea, address, 0, 0, last_refreshed_height, last_refreshed_at
+FROM accounts
+WHERE status = 'keyless'
+ON CONFLICT DO NOTHING;
+
+DROP TABLE IF EXISTS accounts;
@@ -0,0 +1,30 @@
+-- Every known account with the outcome of its last refresh. Accounts without
+-- keys used to be marked by a "blank" key row, they are now status keyless.
+CREATE TABLE accounts (
+    address bytea PRIMARY KEY,
+    status text NOT NULL DEFAULT 'ok',
+    key_count int NOT NULL DEFAULT 0,
+    last_refreshed_height bigint NOT NULL DEFAULT 0,
+    last_refreshed_at timestamptz NOT NULL DEFAULT now(),
+    last_error text,
+    CONSTRAINT accounts_address_length CHECK (octet_length(address) = 8),
+    CONSTRAINT accounts_status_enum CHECK (status IN ('ok', 'keyless', 'over_cap', 'broken', 'error')),
+    CONSTRAINT accounts_key_count_range CHECK (key_count >= 0)
+);
+
+CREATE INDEX accounts_status_idx ON accounts (status) WHERE status <> 'ok';
+
+INSERT INTO accounts (address, status, key_count, last_refreshed_height, last_refreshed_at)
+SELECT
+    account,
+    CASE WHEN bool_and(octet_length(publickey) = 0) THEN 'keyless' ELSE 'ok' END,
+    count(*) FILTER (WHERE octet_length(publickey) > 0),
+    max(updated_height),
+    max(updated_at)
+FROM publickeyindexer
+GROUP BY account;
+
+DELETE FROM publickeyindexer WHERE octet_length(publickey) = 0;
+
+ALTER TABLE publickeyindexer
+    ADD CONSTRAINT publickeyindexer_publickey_not_empty CHECK (octet_length(publickey) > 0);
@@ -0,0 +1,16 @@
+-- Accounts whose keys were cut short by MaxAcctKeys. The remaining keys are
+-- fetched in pages starting at next_key_index, completed_at is set once the
+-- last page is stored.
+CREATE TABLE truncated_accounts (
+    address bytea PRIMARY KEY,
+    key_count int NOT NULL,
+    next_key_index int NOT NULL DEFAULT 0,
+    detected_height bigint NOT NULL DEFAULT 0,
+    detected_at timestamptz NOT NULL DEFAULT now(),
+    completed_at timestamptz,
+    CONSTRAINT truncated_accounts_address_length CHECK (octet_length(address) = 8),
+    CONSTRAINT truncated_accounts_key_count_range CHECK (key_count >= 0),
+    CONSTRAINT truncated_accounts_next_key_index_range CHECK (next_key_index >= 0)
+);
+
+CREATE INDEX truncated_accounts_pending_idx ON truncated_accounts (detected_at) WHERE completed_at IS NULL;
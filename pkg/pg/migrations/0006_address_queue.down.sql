@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS addressprocessing_claim_idx;
+
+ALTER TABLE addressprocessing
+    DROP COLUMN IF EXISTS priority,
+    DROP COLUMN IF EXISTS attempts,
+    DROP COLUMN IF EXISTS last_error,
+    DROP COLUMN IF EXISTS lease_expires_at;
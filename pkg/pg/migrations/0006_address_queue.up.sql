@@ -0,0 +1,10 @@
+-- addressprocessing becomes a durable work queue: rows are claimed with a
+-- lease, retried with their attempts and last error recorded, and deleted
+-- once the keys of the account are committed.
+ALTER TABLE addressprocessing
+    ADD COLUMN priority smallint NOT NULL DEFAULT 0,
+    ADD COLUMN attempts int NOT NULL DEFAULT 0,
+    ADD COLUMN last_error text,
+    ADD COLUMN lease_expires_at timestamptz;
+
+CREATE INDEX addressprocessing_claim_idx ON addressprocessing (priority, created_at);
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS publickeyindexer_suffix_idx;
+DROP INDEX IF EXISTS publickeyindexer_fingerprint_pending_idx;
+DROP INDEX IF EXISTS publickeyindexer_fingerprint_idx;
+
+ALTER TABLE publickeyindexer
+    DROP CONSTRAINT IF EXISTS publickeyindexer_fingerprint_length,
+    DROP COLUMN IF EXISTS fingerprint;
@@ -0,0 +1,13 @@
+-- fingerprint is the first 16 bytes of the SHA3-256 of the raw key, written
+-- by the indexer with every key and filled in for existing rows by
+-- FillKeyIdentifiers.
+ALTER TABLE publickeyindexer
+    ADD COLUMN fingerprint bytea,
+    ADD CONSTRAINT publickeyindexer_fingerprint_length CHECK (octet_length(fingerprint) = 16);
+
+CREATE INDEX publickeyindexer_fingerprint_idx ON publickeyindexer (fingerprint);
+CREATE INDEX publickeyindexer_fingerprint_pending_idx ON publickeyindexer (publickey) WHERE fingerprint IS NULL;
+
+-- suffix searches match the reversed hex key by prefix, prefix searches use
+-- the primary key
+CREATE INDEX publickeyindexer_suffix_idx ON publickeyindexer (reverse(encode(publickey, 'hex')) text_pattern_ops);
@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS publickeyindexer_identifiers_pending_idx;
+CREATE INDEX IF NOT EXISTS publickeyindexer_fingerprint_pending_idx ON publickeyindexer (publickey) WHERE fingerprint IS NULL;
+
+DROP INDEX IF EXISTS publickeyindexer_evm_address_idx;
+
+ALTER TABLE publickeyindexer
+    DROP CONSTRAINT IF EXISTS publickeyindexer_evm_address_length,
+    DROP COLUMN IF EXISTS evm_address;
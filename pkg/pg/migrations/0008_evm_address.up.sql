@@ -0,0 +1,13 @@
+-- evm_address is the Ethereum style address derived from ECDSA_secp256k1
+-- keys (sigalgo 2), written by the indexer with every key and filled in for
+-- existing rows by FillKeyIdentifiers.
+ALTER TABLE publickeyindexer
+    ADD COLUMN evm_address bytea,
+    ADD CONSTRAINT publickeyindexer_evm_address_length CHECK (octet_length(evm_address) = 20);
+
+CREATE INDEX publickeyindexer_evm_address_idx ON publickeyindexer (evm_address) WHERE evm_address IS NOT NULL;
+
+-- rows still missing a derived identifier, only 64 byte keys have an address
+DROP INDEX IF EXISTS publickeyindexer_fingerprint_pending_idx;
+CREATE INDEX publickeyindexer_identifiers_pending_idx ON publickeyindexer (publickey)
+    WHERE fingerprint IS NULL OR (sigalgo = 2 AND evm_address IS NULL AND octet_length(publickey) = 64);
@@ -0,0 +1,14 @@
+-- Accounts of the large connected components of the shared key graph, two
+-- accounts are connected when they hold the same unrevoked key. Rewritten by
+-- the maintenance job, cluster_id is the lowest address of the component.
+CREATE TABLE account_clusters (
+    account bytea PRIMARY KEY,
+    cluster_id bytea NOT NULL,
+    cluster_size int NOT NULL,
+    computed_at timestamptz NOT NULL DEFAULT now(),
+    CONSTRAINT account_clusters_account_length CHECK (octet_length(account) = 8),
+    CONSTRAINT account_clusters_cluster_id_length CHECK (octet_length(cluster_id) = 8),
+    CONSTRAINT account_clusters_cluster_size_range CHECK (cluster_size > 0)
+);
+
+CREATE INDEX account_clusters_cluster_id_idx ON account_clusters (cluster_id);
@@ -0,0 +1,3 @@
+ALTER TABLE truncated_accounts
+    DROP COLUMN IF EXISTS attempts,
+    DROP COLUMN IF EXISTS last_error;
@@ -0,0 +1,5 @@
+-- Truncated accounts record their failed fetches like the address queue, an
+-- account failing too often is left pending for inspection.
+ALTER TABLE truncated_accounts
+    ADD COLUMN attempts int NOT NULL DEFAULT 0,
+    ADD COLUMN last_error text;
@@ -0,0 +1,2 @@
+ALTER TABLE addressprocessing
+    DROP COLUMN IF EXISTS generation;
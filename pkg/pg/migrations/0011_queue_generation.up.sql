@@ -0,0 +1,5 @@
+-- Every enqueue of a queued address bumps its generation, a worker only
+-- deletes or fails the row of the generation it claimed so a key event
+-- arriving during a fetch is not lost.
+ALTER TABLE addressprocessing
+    ADD COLUMN generation bigint NOT NULL DEFAULT 0;
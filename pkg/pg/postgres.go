@@ -1,60 +1,105 @@
 package pg
 
 import (
-	"bytes"
 	"context"
+	"encoding/hex"
 	"example/flow-key-indexer/model"
 	"example/flow-key-indexer/utils"
 	"fmt"
-	"io"
+	"sync/atomic"
 
-	_ "github.com/golang-migrate/migrate/database/postgres"
-	_ "github.com/golang-migrate/migrate/source/file"
-	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"gorm.io/gorm"
-	"gorm.io/gorm/clause"
 )
 
 type Store struct {
 	conf   DatabaseConfig
 	logger zerolog.Logger
 	db     *Database
-	dsn    string
-	done   chan struct{} // Semaphore channel to limit concurrencyj
+	// replicas serve the API reads, see reader
+	replicas *replicaSet
+	done     chan struct{} // Semaphore channel to limit concurrencyj
+	// legacyPending is shared by copies of the store, set while rows still
+	// have to be drained from the legacy varchar table
+	legacyPending *atomic.Bool
 }
 
 func NewStore(conf DatabaseConfig, logger zerolog.Logger) *Store {
 	return &Store{
 		conf:   conf,
 		logger: logger,
-		dsn:    getDSN(conf),
 		done:   make(chan struct{}, 1), // Initialize semaphore with capacity 1
+		// shared so copies of the store see the drain finish
+		legacyPending: &atomic.Bool{},
 	}
 }
 
+// Start brings the schema up to date and connects. It fails when any
+// migration fails, leaving the schema version marked dirty.
 func (s *Store) Start(purgeOnStart bool) error {
-	var err error
-	s.db, err = NewDatabase(s.conf)
+	migrator, err := NewMigrator(s.conf, s.logger)
 	if err != nil {
 		return err
 	}
+	defer migrator.Close()
+
+	if purgeOnStart {
+		s.logger.Warn().Msg("Purging database, rolling back all migrations")
+		if err := migrator.Down(0); err != nil {
+			return err
+		}
+	}
+
+	if err := migrator.Up(); err != nil {
+		s.logger.Error().Err(err).Msg("Failed to migrate database")
+		return err
+	}
+
+	return s.connect()
+}
 
-	err = s.db.InitDatabase(purgeOnStart)
+// StartReadOnly connects without touching the schema, for replicas that only
+// serve the API and rely on an indexing replica to run the migrations.
+func (s *Store) StartReadOnly() error {
+	return s.connect()
+}
+
+func (s *Store) connect() error {
+	var err error
+	s.db, err = NewDatabase(s.conf)
 	if err != nil {
 		return err
 	}
 
-	// Call MigrateDatabase after initializing the database
-	err = s.db.MigrateDatabase()
+	s.replicas, err = newReplicaSet(s.conf, s.logger)
 	if err != nil {
-		s.logger.Error().Err(err).Msg("Failed to migrate database")
 		return err
 	}
+	if len(s.replicas.replicas) > 0 {
+		s.logger.Info().Msgf("Reading from %d replicas", len(s.replicas.replicas))
+		go s.replicas.monitor(context.Background())
+	}
 
-	s.logger.Info().Msg("Database migration completed successfully")
-	return nil
+	return s.detectLegacyTable()
+}
+
+// reader returns the connection for API reads, an up to date replica when one
+// is configured and the primary otherwise. Writes, the block cursor and the
+// work queue always use the primary.
+func (s Store) reader() *gorm.DB {
+	if s.replicas != nil {
+		if db := s.replicas.pick(); db != nil {
+			return db
+		}
+	}
+	return s.db.DB
+}
+
+// Ping checks the database can be reached.
+func (s Store) Ping(ctx context.Context) error {
+	return s.db.Ping(ctx)
 }
 
 func (s Store) Stats() model.PublicKeyStatus {
@@ -71,23 +116,8 @@ func (s Store) BatchInsertPublicKeyAccounts(ctx context.Context, publicKeys []mo
 		return 0, nil
 	}
 
-	batchSize := len(publicKeys)
-
-	// Ensure conflict resolution happens when account, keyid, and publickey all match
-	result := s.db.WithContext(ctx).Clauses(clause.OnConflict{
-		Columns: []clause.Column{
-			{Name: "account"},
-			{Name: "keyid"},
-			{Name: "publickey"},
-		}, // Detect conflict based on these three columns
-		DoUpdates: clause.AssignmentColumns([]string{"sigalgo", "hashalgo", "isrevoked"}), // Update SigAlgo, HashAlgo, and IsRevoked on conflict
-	}).CreateInBatches(publicKeys, batchSize)
-
-	if result.Error != nil {
-		return 0, result.Error
-	}
-
-	return result.RowsAffected, nil
+	// Stage the keys and upsert every mutable column, see upsertFromStagingSQL
+	return upsertWithGorm(ctx, s.db.DB, publicKeys)
 }
 
 func (s Store) InsertPublicKeyAccounts(ctx context.Context, publicKeys []model.PublicKeyAccountIndexer) error {
@@ -111,7 +141,7 @@ func (s Store) InsertPublicKeyAccounts(ctx context.Context, publicKeys []model.P
 
 func (s Store) GetUniqueAddresses() (<-chan string, error) {
 	out := make(chan string)
-	query := "SELECT DISTINCT account FROM publickeyindexer;"
+	query := "SELECT DISTINCT '0x' || encode(account, 'hex') FROM publickeyindexer;"
 
 	go func() {
 		defer close(out)
@@ -145,7 +175,7 @@ func (s Store) GetPublicKeyStats() (model.PublicKeyStatus, error) {
 
 	var uniquePublicKeys int
 
-	err := s.db.Raw(query).Scan(&uniquePublicKeys).Error
+	err := s.reader().Raw(query).Scan(&uniquePublicKeys).Error
 	if err != nil {
 		s.logger.Error().Err(err).Msgf("get status %v", uniquePublicKeys)
 	}
@@ -180,6 +210,8 @@ func (s Store) UpdateDistinctCount() {
 	}
 }
 
+// GetCount counts distinct public keys. Accounts without keys are tracked in
+// the accounts registry, so every publickeyindexer row is a real key.
 func (s Store) GetCount() (int, error) {
 	query := "SELECT COUNT(distinct publickey) as cnt FROM publickeyindexer;"
 	var cnt int
@@ -194,7 +226,14 @@ func (s Store) GetCount() (int, error) {
 	return cnt, nil
 }
 
-func (s Store) UpdateLoadedBlockHeight(blockNumber uint64) {
+// HasPublicKeys reports whether the index holds any key.
+func (s Store) HasPublicKeys(ctx context.Context) (bool, error) {
+	var exists bool
+	err := s.db.WithContext(ctx).Raw("SELECT EXISTS (SELECT 1 FROM publickeyindexer)").Scan(&exists).Error
+	return exists, err
+}
+
+func (s Store) UpdateLoadedBlockHeight(blockNumber uint64) error {
 	log.Debug().Msgf("Updating loaded block height to %v", blockNumber)
 	sqlStatement := `UPDATE publickeyindexer_stats SET pendingBlockheight = ?`
 
@@ -202,6 +241,7 @@ func (s Store) UpdateLoadedBlockHeight(blockNumber uint64) {
 	if err != nil {
 		s.logger.Error().Err(err).Msgf("could not update loading block height %v", blockNumber)
 	}
+	return err
 }
 
 func (s Store) GetLoadedBlockHeight() (uint64, error) {
@@ -216,20 +256,50 @@ func (s Store) GetLoadedBlockHeight() (uint64, error) {
 	return blockNumber, nil
 }
 
+// publicKeyReadColumns selects key rows in the text form used by the model.
+const publicKeyReadColumns = `encode(publickey, 'hex') AS publickey, '0x' || encode(account, 'hex') AS account,
+	keyid, weight, sigalgo, hashalgo, isrevoked, updated_height, coalesce(encode(fingerprint, 'hex'), '') AS fingerprint,
+	coalesce(encode(evm_address, 'hex'), '') AS evm_address, updated_at`
+
 func (s Store) GetAccountsByPublicKey(publicKey string) (model.PublicKeyIndexer, error) {
+	keyBytes, err := utils.DecodeHex(publicKey)
+	if err != nil || len(keyBytes) == 0 {
+		return model.PublicKeyIndexer{}, ErrInvalidPublicKey
+	}
+
 	var publickeys []model.PublicKeyAccountIndexer
-	err := s.db.Where("publickey = ?", publicKey).Find(&publickeys).Error
+	err = s.reader().Table("publickeyindexer").Select(publicKeyReadColumns).Where("publickey = ?", keyBytes).Find(&publickeys).Error
 
 	if err != nil {
 		return model.PublicKeyIndexer{}, err
 	}
 
+	// rows not yet converted from the legacy table, converted rows take precedence
+	legacy, errLegacy := s.legacyAccountsByPublicKey(publicKey)
+	if errLegacy != nil {
+		s.logger.Warn().Err(errLegacy).Msg("Could not read legacy public key rows")
+	}
+	seen := make(map[string]bool, len(publickeys))
+	for _, pk := range publickeys {
+		seen[fmt.Sprintf("%s/%d", pk.Account, pk.KeyId)] = true
+	}
+	for _, pk := range legacy {
+		if !seen[fmt.Sprintf("%s/%d", pk.Account, pk.KeyId)] {
+			publickeys = append(publickeys, pk)
+		}
+	}
+
 	accts := []model.AccountKey{}
+	evmAddress := ""
 	// consolidate account data
 	for _, pk := range publickeys {
-		a := utils.FixAccountLength(pk.Account)
+		if pk.SigAlgo == sigAlgoSecp256k1 && evmAddress == "" {
+			if address, err := utils.EVMAddress(keyBytes); err == nil {
+				evmAddress = utils.Add0xPrefix(hex.EncodeToString(address))
+			}
+		}
 		acct := model.AccountKey{
-			Account:   a,
+			Account:   pk.Account,
 			KeyId:     pk.KeyId,
 			Weight:    pk.Weight,
 			SigAlgo:   pk.SigAlgo,
@@ -242,12 +312,25 @@ func (s Store) GetAccountsByPublicKey(publicKey string) (model.PublicKeyIndexer,
 
 	}
 	publicKeyAccounts := model.PublicKeyIndexer{
-		PublicKey: publicKey,
-		Accounts:  accts,
+		PublicKey:   publicKey,
+		Fingerprint: hex.EncodeToString(utils.KeyFingerprint(keyBytes)),
+		EVMAddress:  evmAddress,
+		Accounts:    accts,
 	}
 	return publicKeyAccounts, err
 }
 
+// GetPublicKeysByAccount returns the stored key rows of an account ordered by key index.
+func (s Store) GetPublicKeysByAccount(account string) ([]model.PublicKeyAccountIndexer, error) {
+	accountBytes, err := utils.AccountToBytes(account)
+	if err != nil {
+		return nil, ErrInvalidAccount
+	}
+	var publickeys []model.PublicKeyAccountIndexer
+	err = s.db.Table("publickeyindexer").Select(publicKeyReadColumns).Where("account = ?", accountBytes).Order("keyid").Find(&publickeys).Error
+	return publickeys, err
+}
+
 func GetHashingAlgoString(hashAlgoInt int) string {
 	switch hashAlgoInt {
 	case 1:
@@ -281,41 +364,19 @@ func GetSignatureAlgoString(sigAlgoInt int) string {
 	}
 }
 
-func (s *Store) GetAccountsToProcess(limit int, ignoreList []string) ([]string, error) {
-	var addresses []string
-	err := s.db.Transaction(func(tx *gorm.DB) error {
-		// Select distinct accounts where either sigalgo or hashalgo is NULL
-		query := tx.Table("addressprocessing").
-			Select("account")
-
-		// Add condition for ignoring accounts in the ignore list if it's not empty
-		if len(ignoreList) > 0 {
-			query = query.Where("account NOT IN (?)", ignoreList)
-		}
-
-		// Fetch accounts with limit, no sorting
-		return query.
-			Limit(limit).
-			Pluck("account", &addresses).Error
-	})
-
-	if err != nil {
-		s.logger.Error().Err(err).Msg("Error fetching accounts")
-	}
-
-	return addresses, err
-}
-
-func (s *Store) RemoveAccountsProcessing(addressesToRemove []string) error {
+// RemoveAccountsProcessing deletes claimed addresses from the work queue once
+// their keys are committed. Addresses enqueued again since their claim stay
+// queued for the newer key events.
+func (s *Store) RemoveAccountsProcessing(ctx context.Context, addressesToRemove []QueuedAddress) error {
 	if len(addressesToRemove) == 0 {
 		s.logger.Warn().Msg("No accounts provided to remove")
 		return nil
 	}
 
-	err := s.db.Transaction(func(tx *gorm.DB) error {
-		// Delete rows where the address is in the addressesToRemove list
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Delete rows of the claimed generation of the addresses
 		return tx.Table("addressprocessing").
-			Where("account IN (?)", addressesToRemove).
+			Where("(account, generation) IN ?", claimKeys(addressesToRemove)).
 			Delete(nil).Error
 	})
 
@@ -328,128 +389,53 @@ func (s *Store) RemoveAccountsProcessing(addressesToRemove []string) error {
 	return nil
 }
 
-// Generate COPY-compatible string for batch inserting/updating data into PostgreSQL
-func (s Store) GenerateCopyStringForPublicKeyAccounts(ctx context.Context, publicKeys []model.PublicKeyAccountIndexer) (string, error) {
+// CopyPublicKeyAccounts streams the keys into the staging table with COPY on
+// a pooled connection and upserts them into publickeyindexer.
+func (s Store) CopyPublicKeyAccounts(ctx context.Context, publicKeys []model.PublicKeyAccountIndexer) (int64, error) {
 	if len(publicKeys) == 0 {
-		return "", nil
-	}
-
-	var buffer bytes.Buffer
-	const batchSize = 10000 // You can adjust this based on performance
-	fieldDelimiter := "\t"  // Tab delimiter for the COPY command (adjust based on requirements)
-	recordDelimiter := "\n"
-
-	for i := 0; i < len(publicKeys); i += batchSize {
-		end := i + batchSize
-		if end > len(publicKeys) {
-			end = len(publicKeys)
-		}
-
-		// Iterate through the batch and create the COPY-compatible string
-		for _, key := range publicKeys[i:end] {
-			// Generate the row, assuming PublicKeyAccountIndexer has these fields
-			row := fmt.Sprintf("%s%s%d%s%s%s%d%s%d%s%d%s%t%s",
-				key.Account, fieldDelimiter,
-				key.KeyId, fieldDelimiter,
-				key.PublicKey, fieldDelimiter,
-				key.Weight, fieldDelimiter,
-				key.SigAlgo, fieldDelimiter,
-				key.HashAlgo, fieldDelimiter,
-				key.IsRevoked, recordDelimiter)
-			// Append the row to the buffer
-			buffer.WriteString(row)
-		}
-	}
-
-	return buffer.String(), nil
-}
-
-func (s Store) LoadPublicKeyIndexerFromReader(ctx context.Context, file io.Reader) (int64, error) {
-
-	// Create a pgx pool or connection
-	pgxConn, err := pgxpool.New(ctx, s.dsn)
-	if err != nil {
-		log.Error().Err(err).Msg("Error creating pgx connection")
-		return 0, err
+		return 0, nil
 	}
-	defer pgxConn.Close()
 
 	// Begin a transaction
-	tx, err := pgxConn.Begin(ctx)
+	tx, err := s.db.pool.Begin(ctx)
 	if err != nil {
 		log.Error().Err(err).Msg("Error beginning transaction")
 		return 0, err
 	}
-	defer func() {
-		if err != nil {
-			tx.Rollback(ctx)
-		} else {
-			err = tx.Commit(ctx)
-			if err != nil {
-				log.Error().Err(err).Msg("Error committing transaction")
-			}
-		}
-	}()
+	defer tx.Rollback(ctx)
+
+	fillKeyIdentifiers(publicKeys)
 
 	// Create the temporary table
-	createTempTableQuery := `
-        CREATE TEMP TABLE temp_publickeyindexer (
-            account TEXT NOT NULL,
-            keyid INT NOT NULL,
-            publickey TEXT NOT NULL,
-            sigalgo INT,
-            hashalgo INT,
-            isrevoked BOOLEAN DEFAULT FALSE,
-            weight INT
-        ) ON COMMIT DROP;
-    `
-	_, err = tx.Exec(ctx, createTempTableQuery)
+	err = stageForCopy(ctx, tx)
 	if err != nil {
 		log.Error().Err(err).Msg("Error creating temp table")
 		return 0, err
 	}
 
-	// Perform the COPY FROM STDIN operation
-	copyFromQuery := `COPY temp_publickeyindexer (account, keyid, publickey, weight, sigalgo, hashalgo, isrevoked) FROM STDIN WITH (FORMAT csv, DELIMITER E'\t', HEADER false);`
-	pgConn := tx.Conn().PgConn()
-	rowsCopied, err := pgConn.CopyFrom(ctx, file, copyFromQuery)
+	// Copy the rows, fields follow the publicKeyColumns order
+	rowsCopied, err := tx.CopyFrom(ctx, pgx.Identifier{stagingTable}, publicKeyColumns,
+		pgx.CopyFromSlice(len(publicKeys), func(i int) ([]any, error) {
+			key := publicKeys[i]
+			return []any{key.Account, key.KeyId, key.PublicKey, key.Weight, key.SigAlgo, key.HashAlgo, key.IsRevoked, int64(key.UpdatedHeight), key.Fingerprint, key.EVMAddress}, nil
+		}))
 	if err != nil {
 		log.Error().Err(err).Msg("Error during COPY FROM STDIN")
 		return 0, err
 	}
 
 	// Insert data from the temp table into the main table
-	insertQuery := `
-        INSERT INTO publickeyindexer (account, keyid, publickey, weight, sigalgo, hashalgo, isrevoked)
-        SELECT account, keyid, publickey, weight, sigalgo, hashalgo, isrevoked FROM temp_publickeyindexer
-        ON CONFLICT (account, keyid, publickey)
-        DO UPDATE SET sigalgo = EXCLUDED.sigalgo, hashalgo = EXCLUDED.hashalgo, isrevoked = EXCLUDED.isrevoked;
-    `
-	cmdTag, err := tx.Exec(ctx, insertQuery)
+	rowsAffected, err := applyStagedUpsert(ctx, tx)
 	if err != nil {
 		log.Error().Err(err).Msg("Error executing INSERT INTO publickeyindexer")
 		return 0, err
 	}
+	if err := tx.Commit(ctx); err != nil {
+		log.Error().Err(err).Msg("Error committing transaction")
+		return 0, err
+	}
 
-	rowsAffected := cmdTag.RowsAffected()
-	log.Info().Msgf("Batch Bulk Loaded %d rows, %d affected", rowsCopied.RowsAffected(), rowsAffected)
+	log.Info().Msgf("Batch Bulk Loaded %d rows, %d affected", rowsCopied, rowsAffected)
 
 	return rowsAffected, nil
 }
-
-func (s *Store) StoreAddressesForProcessing(addresses []string) error {
-	return s.db.Transaction(func(tx *gorm.DB) error {
-		// Prepare the query with ON CONFLICT DO NOTHING
-		query := `INSERT INTO addressprocessing (account) VALUES (?) ON CONFLICT (account) DO NOTHING`
-
-		// Execute the query for each address
-		for _, addr := range addresses {
-			err := tx.Exec(query, addr).Error
-			if err != nil {
-				log.Error().Err(err).Msgf("Error storing address %v", addr)
-				return err
-			}
-		}
-		return nil
-	})
-}
@@ -0,0 +1,128 @@
+package pg
+
+import (
+	"context"
+	"time"
+
+	"example/flow-key-indexer/utils"
+
+	"gorm.io/gorm/clause"
+)
+
+// Priorities of the addressprocessing queue
+const (
+	// PriorityBackfill addresses come from the full address list
+	PriorityBackfill = 0
+	// PriorityEvent addresses had key events and are fetched first
+	PriorityEvent = 10
+)
+
+// queueMaxAttempts is the number of claims after which a failing address is
+// left in the queue for inspection instead of being retried
+const queueMaxAttempts = 10
+
+const claimAddressesSQL = `
+	UPDATE addressprocessing
+	SET lease_expires_at = now() + make_interval(secs => ?), attempts = attempts + 1
+	WHERE account IN (
+		SELECT account FROM addressprocessing
+		WHERE priority = ?
+		AND attempts < ?
+		AND (lease_expires_at IS NULL OR lease_expires_at < now())
+		ORDER BY created_at
+		LIMIT ?
+		FOR UPDATE SKIP LOCKED
+	)
+	RETURNING account, generation;`
+
+// failAddressesSQL records the error and keeps the lease for a back off that
+// grows with the attempts before the address can be claimed again.
+const failAddressesSQL = `
+	UPDATE addressprocessing
+	SET last_error = ?, lease_expires_at = now() + least(attempts, 10) * interval '1 minute'
+	WHERE (account, generation) IN ?;`
+
+// QueuedAddress is a claimed address of the work queue. Generation changes
+// whenever the address is enqueued again, so finishing a claim does not
+// remove a newer enqueue of the same address.
+type QueuedAddress struct {
+	Account    string
+	Generation int64
+}
+
+// claimKeys returns the (account, generation) pairs of the claims
+func claimKeys(claims []QueuedAddress) [][]interface{} {
+	keys := make([][]interface{}, len(claims))
+	for i, claim := range claims {
+		keys[i] = []interface{}{claim.Account, claim.Generation}
+	}
+	return keys
+}
+
+type queueRow struct {
+	Account  string `gorm:"column:account;primaryKey"`
+	Priority int    `gorm:"column:priority"`
+}
+
+func (queueRow) TableName() string {
+	return "addressprocessing"
+}
+
+// EnqueueAddresses adds addresses to the work queue. An address already queued
+// keeps the higher of both priorities and starts over as a new generation:
+// its attempts, lease and error are cleared, a claim of the previous
+// generation that is still being fetched no longer removes it.
+func (s Store) EnqueueAddresses(ctx context.Context, addresses []string, priority int) error {
+	rows := make([]queueRow, 0, len(addresses))
+	seen := make(map[string]bool, len(addresses))
+	for _, addr := range addresses {
+		account := utils.FixAccountLength(addr)
+		if seen[account] {
+			continue
+		}
+		seen[account] = true
+		rows = append(rows, queueRow{Account: account, Priority: priority})
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	return s.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "account"}},
+		DoUpdates: clause.Set{
+			{Column: clause.Column{Name: "priority"}, Value: clause.Expr{SQL: "GREATEST(addressprocessing.priority, EXCLUDED.priority)"}},
+			{Column: clause.Column{Name: "generation"}, Value: clause.Expr{SQL: "addressprocessing.generation + 1"}},
+			{Column: clause.Column{Name: "attempts"}, Value: 0},
+			{Column: clause.Column{Name: "lease_expires_at"}, Value: nil},
+			{Column: clause.Column{Name: "last_error"}, Value: nil},
+		},
+	}).CreateInBatches(rows, stagingBatchSize).Error
+}
+
+// ClaimAddresses leases up to limit queued addresses of the given priority,
+// oldest first. Rows locked or leased by another worker are skipped, a lease
+// that runs out makes the address available again.
+func (s Store) ClaimAddresses(ctx context.Context, priority int, limit int, lease time.Duration) ([]QueuedAddress, error) {
+	var addresses []QueuedAddress
+	err := s.db.WithContext(ctx).
+		Raw(claimAddressesSQL, lease.Seconds(), priority, queueMaxAttempts, limit).
+		Scan(&addresses).Error
+	return addresses, err
+}
+
+// FailAddresses records why the claimed addresses could not be processed,
+// they are claimed again once their back off ran out. Addresses enqueued
+// again since their claim are left as they are.
+func (s Store) FailAddresses(ctx context.Context, claims []QueuedAddress, cause error) error {
+	if len(claims) == 0 {
+		return nil
+	}
+	return s.db.WithContext(ctx).Exec(failAddressesSQL, cause.Error(), claimKeys(claims)).Error
+}
+
+// QueueDepth returns the number of queued addresses of the given priority.
+func (s Store) QueueDepth(priority int) (int64, error) {
+	var count int64
+	err := s.db.Table("addressprocessing").Where("priority = ?", priority).Count(&count).Error
+	return count, err
+}
@@ -0,0 +1,98 @@
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+)
+
+// replicaCheckInterval is how often the lag of each replica is measured
+const replicaCheckInterval = 10 * time.Second
+
+// replicaLagSQL measures how far a replica is behind the primary in seconds. A
+// replica that streams from the primary and replayed everything it received is
+// not behind, however old its last transaction is. Without a WAL receiver it
+// does not know what it missed, so its lag is the age of its last replayed
+// transaction, NULL when it has not replayed any.
+const replicaLagSQL = `
+	SELECT CASE
+		WHEN NOT pg_is_in_recovery() THEN 0
+		WHEN NOT EXISTS (SELECT 1 FROM pg_stat_wal_receiver) THEN EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp())
+		WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+		ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+	END;`
+
+type replica struct {
+	db *gorm.DB
+	// stale is set while the replica lags more than allowed or cannot be reached
+	stale atomic.Bool
+}
+
+// replicaSet spreads reads over the read replicas that are up to date.
+type replicaSet struct {
+	replicas []*replica
+	next     atomic.Uint64
+	maxLag   time.Duration
+	logger   zerolog.Logger
+}
+
+func newReplicaSet(conf DatabaseConfig, logger zerolog.Logger) (*replicaSet, error) {
+	set := &replicaSet{maxLag: conf.MaxReplicaLag, logger: logger}
+	for _, dsn := range conf.ReplicaDSNs {
+		db, _, err := connectPG(dsn, conf)
+		if err != nil {
+			return nil, err
+		}
+		set.replicas = append(set.replicas, &replica{db: db})
+	}
+	return set, nil
+}
+
+// pick returns the next up to date replica, nil when there is none.
+func (rs *replicaSet) pick() *gorm.DB {
+	n := len(rs.replicas)
+	start := rs.next.Add(1)
+	for i := 0; i < n; i++ {
+		r := rs.replicas[(start+uint64(i))%uint64(n)]
+		if !r.stale.Load() {
+			return r.db
+		}
+	}
+	return nil
+}
+
+// monitor measures the lag of every replica until ctx is done.
+func (rs *replicaSet) monitor(ctx context.Context) {
+	ticker := time.NewTicker(replicaCheckInterval)
+	defer ticker.Stop()
+	for {
+		for i, r := range rs.replicas {
+			rs.check(ctx, i, r)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (rs *replicaSet) check(ctx context.Context, i int, r *replica) {
+	var lagSeconds sql.NullFloat64
+	err := r.db.WithContext(ctx).Raw(replicaLagSQL).Scan(&lagSeconds).Error
+	lag := time.Duration(lagSeconds.Float64 * float64(time.Second))
+	stale := err != nil || !lagSeconds.Valid || (rs.maxLag > 0 && lag > rs.maxLag)
+	if r.stale.Swap(stale) != stale {
+		if stale && err == nil && !lagSeconds.Valid {
+			rs.logger.Warn().Msgf("Read replica %d is not receiving WAL, reading from the primary", i)
+		} else if stale {
+			rs.logger.Warn().Err(err).Msgf("Read replica %d is %s behind, reading from the primary", i, lag)
+		} else {
+			rs.logger.Info().Msgf("Read replica %d caught up", i)
+		}
+	}
+}
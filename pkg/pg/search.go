@@ -0,0 +1,235 @@
+package pg
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"example/flow-key-indexer/model"
+	"example/flow-key-indexer/utils"
+
+	"gorm.io/gorm"
+)
+
+// MinSearchLength is the number of hex characters a prefix or suffix search
+// needs at least, shorter ones would match a large part of the index.
+const MinSearchLength = 8
+
+// KeySearch selects keys by the start or end of their hex encoding or by
+// their fingerprint, every field that is set has to match.
+type KeySearch struct {
+	Prefix      string
+	Suffix      string
+	Fingerprint string
+}
+
+// sigAlgoSecp256k1 is the stored sigalgo of ECDSA_secp256k1 keys
+const sigAlgoSecp256k1 = 2
+
+// pendingIdentifiersSQL lists keys stored without their derived identifiers,
+// it matches the publickeyindexer_identifiers_pending_idx predicate.
+const pendingIdentifiersSQL = `
+	SELECT publickey, bool_or(sigalgo = 2) AS secp256k1
+	FROM publickeyindexer
+	WHERE fingerprint IS NULL OR (sigalgo = 2 AND evm_address IS NULL AND octet_length(publickey) = 64)
+	GROUP BY publickey
+	LIMIT $1;`
+
+// fillIdentifiersSQL sets the identifiers computed by FillKeyIdentifiers, $1
+// are the keys, $2 their fingerprints and $3 their EVM addresses.
+const fillIdentifiersSQL = `
+	UPDATE publickeyindexer
+	SET fingerprint = f.fingerprint,
+		evm_address = CASE WHEN publickeyindexer.sigalgo = 2 THEN f.evm_address ELSE publickeyindexer.evm_address END
+	FROM unnest($1::bytea[], $2::bytea[], $3::bytea[]) AS f(publickey, fingerprint, evm_address)
+	WHERE publickeyindexer.publickey = f.publickey;`
+
+// fillKeyIdentifiers sets the fingerprint of the keys, and the EVM address
+// of the secp256k1 keys, that have none yet.
+func fillKeyIdentifiers(publicKeys []model.PublicKeyAccountIndexer) {
+	for i := range publicKeys {
+		key, err := utils.DecodeHex(publicKeys[i].PublicKey)
+		if err != nil {
+			continue
+		}
+		if publicKeys[i].Fingerprint == "" {
+			publicKeys[i].Fingerprint = hex.EncodeToString(utils.KeyFingerprint(key))
+		}
+		if publicKeys[i].EVMAddress == "" && publicKeys[i].SigAlgo == sigAlgoSecp256k1 {
+			if address, err := utils.EVMAddress(key); err == nil {
+				publicKeys[i].EVMAddress = hex.EncodeToString(address)
+			}
+		}
+	}
+}
+
+// where adds the search conditions to db.
+func (q KeySearch) where(db *gorm.DB) (*gorm.DB, error) {
+	if q.Prefix == "" && q.Suffix == "" && q.Fingerprint == "" {
+		return nil, fmt.Errorf("%w: a prefix, suffix or fingerprint is required", ErrInvalidSearch)
+	}
+	if q.Prefix != "" {
+		prefix := utils.Strip0xPrefix(q.Prefix)
+		if len(prefix) < MinSearchLength {
+			return nil, fmt.Errorf("%w: prefix needs at least %d hex characters", ErrInvalidSearch, MinSearchLength)
+		}
+		lower, upper, err := utils.HexPrefixRange(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("%w: prefix is not hex", ErrInvalidSearch)
+		}
+		db = db.Where("publickey >= ?", lower)
+		if upper != nil {
+			db = db.Where("publickey < ?", upper)
+		}
+	}
+	if q.Suffix != "" {
+		suffix := strings.ToLower(utils.Strip0xPrefix(q.Suffix))
+		if len(suffix) < MinSearchLength {
+			return nil, fmt.Errorf("%w: suffix needs at least %d hex characters", ErrInvalidSearch, MinSearchLength)
+		}
+		if _, err := hex.DecodeString(padEven(suffix)); err != nil {
+			return nil, fmt.Errorf("%w: suffix is not hex", ErrInvalidSearch)
+		}
+		db = db.Where("reverse(encode(publickey, 'hex')) LIKE ?", reverse(suffix)+"%")
+	}
+	if q.Fingerprint != "" {
+		fingerprint, err := utils.DecodeHex(q.Fingerprint)
+		if err != nil || len(fingerprint) != utils.FingerprintLength {
+			return nil, fmt.Errorf("%w: fingerprint must be %d hex characters", ErrInvalidSearch, 2*utils.FingerprintLength)
+		}
+		db = db.Where("fingerprint = ?", fingerprint)
+	}
+	return db, nil
+}
+
+// SearchPublicKeys returns the keys matching q with their accounts, ordered
+// by key and paged by limit and offset.
+func (s Store) SearchPublicKeys(ctx context.Context, q KeySearch, limit int, offset int) ([]model.PublicKeyIndexer, error) {
+	keys, err := q.where(s.reader().WithContext(ctx).Table("publickeyindexer"))
+	if err != nil {
+		return nil, err
+	}
+	keys = keys.Distinct("publickey").Order("publickey").Limit(limit).Offset(offset)
+
+	var rows []model.PublicKeyAccountIndexer
+	err = s.reader().WithContext(ctx).Table("publickeyindexer").
+		Select(publicKeyReadColumns).
+		Where("publickey IN (?)", keys).
+		Order("publickey, account, keyid").
+		Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return groupKeyRows(rows), nil
+}
+
+// GetKeysByEVMAddress returns the secp256k1 keys deriving the EVM address
+// with their accounts.
+func (s Store) GetKeysByEVMAddress(ctx context.Context, address string) ([]model.PublicKeyIndexer, error) {
+	addressBytes, err := utils.DecodeHex(address)
+	if err != nil || len(addressBytes) != utils.EVMAddressLength {
+		return nil, ErrInvalidEVMAddress
+	}
+
+	var rows []model.PublicKeyAccountIndexer
+	err = s.reader().WithContext(ctx).Table("publickeyindexer").
+		Select(publicKeyReadColumns).
+		Where("evm_address = ?", addressBytes).
+		Order("publickey, account, keyid").
+		Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	return groupKeyRows(rows), nil
+}
+
+// groupKeyRows collects rows ordered by key into one entry per key.
+func groupKeyRows(rows []model.PublicKeyAccountIndexer) []model.PublicKeyIndexer {
+	results := []model.PublicKeyIndexer{}
+	for _, pk := range rows {
+		if len(results) == 0 || results[len(results)-1].PublicKey != pk.PublicKey {
+			results = append(results, model.PublicKeyIndexer{
+				PublicKey:   pk.PublicKey,
+				Fingerprint: pk.Fingerprint,
+				Accounts:    []model.AccountKey{},
+			})
+		}
+		last := &results[len(results)-1]
+		if pk.EVMAddress != "" {
+			last.EVMAddress = utils.Add0xPrefix(pk.EVMAddress)
+		}
+		last.Accounts = append(last.Accounts, toAccountKey(pk))
+	}
+	return results
+}
+
+// FillKeyIdentifiers computes the fingerprints and EVM addresses of keys
+// stored without them, batchSize keys at a time with a pause in between,
+// until none is left.
+func (s Store) FillKeyIdentifiers(ctx context.Context, batchSize int, pause time.Duration) error {
+	var total int
+	for {
+		rows, err := s.db.pool.Query(ctx, pendingIdentifiersSQL, batchSize)
+		if err != nil {
+			return err
+		}
+		var keys, fingerprints, addresses [][]byte
+		for rows.Next() {
+			var key []byte
+			var secp256k1 bool
+			if err := rows.Scan(&key, &secp256k1); err != nil {
+				rows.Close()
+				return err
+			}
+			var address []byte
+			if secp256k1 {
+				address, _ = utils.EVMAddress(key)
+			}
+			keys = append(keys, key)
+			fingerprints = append(fingerprints, utils.KeyFingerprint(key))
+			addresses = append(addresses, address)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			break
+		}
+
+		if _, err := s.db.pool.Exec(ctx, fillIdentifiersSQL, keys, fingerprints, addresses); err != nil {
+			return err
+		}
+		total += len(keys)
+		s.logger.Debug().Msgf("Filled in the identifiers of %d keys", len(keys))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pause):
+		}
+	}
+
+	if total > 0 {
+		s.logger.Info().Msgf("Filled in the fingerprints and EVM addresses of %d keys", total)
+	}
+	return nil
+}
+
+func padEven(s string) string {
+	if len(s)%2 == 1 {
+		return "0" + s
+	}
+	return s
+}
+
+func reverse(s string) string {
+	b := []byte(s)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
@@ -0,0 +1,116 @@
+package pg
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	"example/flow-key-indexer/model"
+	"example/flow-key-indexer/utils"
+)
+
+// SigningThreshold is the key weight a Flow transaction needs from an account,
+// stored weights are whole units of the on chain UFix64 weight.
+const SigningThreshold = 1000
+
+// MaxThresholdKeys caps the number of keys of one threshold request
+const MaxThresholdKeys = 100
+
+// GetAccountThresholds returns, for every account holding any of publicKeys,
+// the weight those keys sign with and the other keys needed to reach
+// SigningThreshold, ordered by account.
+func (s Store) GetAccountThresholds(ctx context.Context, publicKeys []string) ([]model.AccountThreshold, error) {
+	if len(publicKeys) == 0 || len(publicKeys) > MaxThresholdKeys {
+		return nil, fmt.Errorf("%w: expected 1 to %d keys", ErrInvalidPublicKey, MaxThresholdKeys)
+	}
+	given := make(map[string]bool, len(publicKeys))
+	keyBytes := make([][]byte, 0, len(publicKeys))
+	for _, publicKey := range publicKeys {
+		key, err := utils.DecodeHex(publicKey)
+		if err != nil || len(key) == 0 {
+			return nil, ErrInvalidPublicKey
+		}
+		given[hex.EncodeToString(key)] = true
+		keyBytes = append(keyBytes, key)
+	}
+
+	accounts := s.reader().WithContext(ctx).Table("publickeyindexer").
+		Distinct("account").
+		Where("publickey IN ?", keyBytes)
+
+	var rows []model.PublicKeyAccountIndexer
+	err := s.reader().WithContext(ctx).Table("publickeyindexer").
+		Select(publicKeyReadColumns).
+		Where("account IN (?)", accounts).
+		Order("account, keyid").
+		Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	return accountThresholds(given, rows), nil
+}
+
+// accountThresholds summarizes rows ordered by account, given holds the hex
+// keys the caller signs with.
+func accountThresholds(given map[string]bool, rows []model.PublicKeyAccountIndexer) []model.AccountThreshold {
+	results := []model.AccountThreshold{}
+	var others []model.AccountKey
+	for i, pk := range rows {
+		if len(results) == 0 || results[len(results)-1].Account != pk.Account {
+			results = append(results, model.AccountThreshold{
+				Account:    pk.Account,
+				Threshold:  SigningThreshold,
+				Keys:       []model.AccountKey{},
+				NeededKeys: []model.AccountKey{},
+			})
+			others = others[:0]
+		}
+		last := &results[len(results)-1]
+		key := toAccountKey(pk)
+		key.PublicKey = pk.PublicKey
+		if given[pk.PublicKey] {
+			last.Keys = append(last.Keys, key)
+			if !pk.IsRevoked {
+				last.Weight += pk.Weight
+			}
+		} else if !pk.IsRevoked && pk.Weight > 0 {
+			others = append(others, key)
+		}
+		if i == len(rows)-1 || rows[i+1].Account != pk.Account {
+			completeThreshold(last, others)
+		}
+	}
+	return results
+}
+
+// completeThreshold picks the heaviest of others until the threshold is met.
+func completeThreshold(t *model.AccountThreshold, others []model.AccountKey) {
+	t.MeetsThreshold = t.Weight >= t.Threshold
+	sort.SliceStable(others, func(i, j int) bool {
+		return others[i].Weight > others[j].Weight
+	})
+	weight := t.Weight
+	for _, key := range others {
+		if weight >= t.Threshold {
+			break
+		}
+		t.NeededKeys = append(t.NeededKeys, key)
+		weight += key.Weight
+	}
+	t.Reachable = weight >= t.Threshold
+}
+
+// toAccountKey converts a stored row to the key served for an account.
+func toAccountKey(pk model.PublicKeyAccountIndexer) model.AccountKey {
+	return model.AccountKey{
+		Account:   pk.Account,
+		KeyId:     pk.KeyId,
+		Weight:    pk.Weight,
+		SigAlgo:   pk.SigAlgo,
+		HashAlgo:  pk.HashAlgo,
+		Signing:   GetSignatureAlgoString(pk.SigAlgo),
+		Hashing:   GetHashingAlgoString(pk.HashAlgo),
+		IsRevoked: pk.IsRevoked,
+	}
+}
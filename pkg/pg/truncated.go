@@ -0,0 +1,151 @@
+package pg
+
+import (
+	"context"
+	"encoding/hex"
+	"time"
+
+	"example/flow-key-indexer/model"
+	"example/flow-key-indexer/utils"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// truncatedMaxAttempts is the number of failed fetches after which a
+// truncated account is left pending for inspection instead of being retried
+const truncatedMaxAttempts = 10
+
+// truncatedAccountRow is the truncated_accounts table row behind model.TruncatedAccount.
+type truncatedAccountRow struct {
+	Address        []byte     `gorm:"column:address;primaryKey"`
+	KeyCount       int        `gorm:"column:key_count"`
+	NextKeyIndex   int        `gorm:"column:next_key_index"`
+	DetectedHeight uint64     `gorm:"column:detected_height"`
+	DetectedAt     time.Time  `gorm:"column:detected_at"`
+	CompletedAt    *time.Time `gorm:"column:completed_at"`
+	Attempts       int        `gorm:"column:attempts"`
+	LastError      *string    `gorm:"column:last_error"`
+}
+
+func (truncatedAccountRow) TableName() string {
+	return "truncated_accounts"
+}
+
+// RecordTruncatedAccounts queues accounts whose keys were cut short. An account
+// seen truncated again is queued again from its new next key index, with its
+// failed attempts cleared.
+func (s Store) RecordTruncatedAccounts(ctx context.Context, accounts []model.TruncatedAccount) error {
+	rows := make([]truncatedAccountRow, 0, len(accounts))
+	seen := make(map[string]int, len(accounts))
+	for _, a := range accounts {
+		address, err := utils.AccountToBytes(a.Address)
+		if err != nil {
+			s.logger.Warn().Err(err).Msg("Skipping truncated account")
+			continue
+		}
+		row := truncatedAccountRow{
+			Address:        address,
+			KeyCount:       a.KeyCount,
+			NextKeyIndex:   a.NextKeyIndex,
+			DetectedHeight: a.DetectedHeight,
+			DetectedAt:     time.Now(),
+		}
+		// one row per address, ON CONFLICT cannot touch a row twice
+		if i, ok := seen[string(address)]; ok {
+			rows[i] = row
+			continue
+		}
+		seen[string(address)] = len(rows)
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	return s.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "address"}},
+		DoUpdates: clause.AssignmentColumns([]string{"key_count", "next_key_index", "detected_height", "detected_at", "completed_at", "attempts", "last_error"}),
+		Where: clause.Where{Exprs: []clause.Expression{
+			clause.Expr{SQL: "truncated_accounts.detected_height <= EXCLUDED.detected_height"},
+		}},
+	}).CreateInBatches(rows, stagingBatchSize).Error
+}
+
+// GetTruncatedAccounts lists truncated accounts, pending ones first.
+func (s Store) GetTruncatedAccounts(limit int, offset int) ([]model.TruncatedAccount, error) {
+	var rows []truncatedAccountRow
+	err := s.reader().
+		Order("completed_at IS NOT NULL, detected_at, address").
+		Limit(limit).
+		Offset(offset).
+		Find(&rows).Error
+	return toTruncatedAccounts(rows), err
+}
+
+// GetPendingTruncatedAccounts returns up to limit accounts whose remaining
+// keys have not been fetched yet, oldest first. Accounts that failed
+// truncatedMaxAttempts times are skipped.
+func (s Store) GetPendingTruncatedAccounts(limit int) ([]model.TruncatedAccount, error) {
+	var rows []truncatedAccountRow
+	err := s.db.
+		Where("completed_at IS NULL AND attempts < ?", truncatedMaxAttempts).
+		Order("detected_at, address").
+		Limit(limit).
+		Find(&rows).Error
+	return toTruncatedAccounts(rows), err
+}
+
+// UpdateTruncatedProgress moves the next key index of a truncated account
+// forward and marks it completed once all keys are stored.
+func (s Store) UpdateTruncatedProgress(ctx context.Context, address string, nextKeyIndex int, completed bool) error {
+	accountBytes, err := utils.AccountToBytes(address)
+	if err != nil {
+		return ErrInvalidAccount
+	}
+
+	updates := map[string]interface{}{"next_key_index": nextKeyIndex}
+	if completed {
+		updates["completed_at"] = time.Now()
+	}
+	return s.db.WithContext(ctx).
+		Model(&truncatedAccountRow{}).
+		Where("address = ?", accountBytes).
+		Updates(updates).Error
+}
+
+// FailTruncatedAccount records a failed fetch of the remaining keys of an
+// account, it is retried in a later round until it ran out of attempts.
+func (s Store) FailTruncatedAccount(ctx context.Context, address string, cause error) error {
+	accountBytes, err := utils.AccountToBytes(address)
+	if err != nil {
+		return ErrInvalidAccount
+	}
+	return s.db.WithContext(ctx).
+		Model(&truncatedAccountRow{}).
+		Where("address = ?", accountBytes).
+		Updates(map[string]interface{}{
+			"attempts":   gorm.Expr("attempts + 1"),
+			"last_error": cause.Error(),
+		}).Error
+}
+
+func toTruncatedAccounts(rows []truncatedAccountRow) []model.TruncatedAccount {
+	accounts := make([]model.TruncatedAccount, 0, len(rows))
+	for _, r := range rows {
+		account := model.TruncatedAccount{
+			Address:        utils.Add0xPrefix(hex.EncodeToString(r.Address)),
+			KeyCount:       r.KeyCount,
+			NextKeyIndex:   r.NextKeyIndex,
+			DetectedHeight: r.DetectedHeight,
+			DetectedAt:     r.DetectedAt,
+			CompletedAt:    r.CompletedAt,
+			Attempts:       r.Attempts,
+		}
+		if r.LastError != nil {
+			account.LastError = *r.LastError
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts
+}
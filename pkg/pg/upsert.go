@@ -0,0 +1,118 @@
+package pg
+
+import (
+	"context"
+
+	"example/flow-key-indexer/model"
+
+	"github.com/jackc/pgx/v5"
+	"gorm.io/gorm"
+)
+
+// publicKeyColumns is the column order shared by the staging table, the COPY
+// rows written by CopyPublicKeyAccounts and the upsert.
+var publicKeyColumns = []string{
+	"account",
+	"keyid",
+	"publickey",
+	"weight",
+	"sigalgo",
+	"hashalgo",
+	"isrevoked",
+	"updated_height",
+	"fingerprint",
+	"evm_address",
+}
+
+const stagingTable = "temp_publickeyindexer"
+
+// stagingBatchSize keeps multi-row inserts into the staging table well below
+// the 65535 bind parameter limit of the postgres protocol.
+const stagingBatchSize = 5000
+
+const createStagingTableSQL = `
+	CREATE TEMP TABLE temp_publickeyindexer (
+		account TEXT NOT NULL,
+		keyid INT NOT NULL,
+		publickey TEXT NOT NULL,
+		weight INT,
+		sigalgo INT,
+		hashalgo INT,
+		isrevoked BOOLEAN DEFAULT FALSE,
+		updated_height BIGINT DEFAULT 0,
+		fingerprint TEXT,
+		evm_address TEXT
+	) ON COMMIT DROP;`
+
+// Staged rows are text, these expressions convert them to the typed columns.
+// Accounts may come with or without 0x and leading zeros.
+const (
+	stagedAccountSQL   = `decode(lpad(regexp_replace(account, '^0x', ''), 16, '0'), 'hex')`
+	stagedPublicKeySQL = `decode(regexp_replace(publickey, '^0x', ''), 'hex')`
+)
+
+// upsertFromStagingSQL moves the staged rows into publickeyindexer. Every
+// mutable column is overwritten on conflict, duplicates inside one batch are
+// collapsed to the row seen at the highest height, and updated_height never
+// moves backwards. A row read at a lower height than the stored one does not
+// overwrite it, rows without a height (0) always do.
+const upsertFromStagingSQL = `
+	INSERT INTO publickeyindexer (account, keyid, publickey, weight, sigalgo, hashalgo, isrevoked, updated_height, fingerprint, evm_address, updated_at)
+	SELECT DISTINCT ON (account, keyid, publickey)
+		account, keyid, publickey, weight, sigalgo, hashalgo, isrevoked, updated_height, fingerprint, evm_address, now()
+	FROM (
+		SELECT ` + stagedAccountSQL + ` AS account, keyid, ` + stagedPublicKeySQL + ` AS publickey,
+			coalesce(weight, 0) AS weight, coalesce(sigalgo, 0) AS sigalgo, coalesce(hashalgo, 0) AS hashalgo,
+			coalesce(isrevoked, FALSE) AS isrevoked, coalesce(updated_height, 0) AS updated_height,
+			decode(nullif(fingerprint, ''), 'hex') AS fingerprint, decode(nullif(evm_address, ''), 'hex') AS evm_address
+		FROM temp_publickeyindexer
+	) staged
+	ORDER BY account, keyid, publickey, updated_height DESC
+	ON CONFLICT (account, keyid, publickey)
+	DO UPDATE SET
+		weight = EXCLUDED.weight,
+		sigalgo = EXCLUDED.sigalgo,
+		hashalgo = EXCLUDED.hashalgo,
+		isrevoked = EXCLUDED.isrevoked,
+		updated_height = GREATEST(publickeyindexer.updated_height, EXCLUDED.updated_height),
+		fingerprint = coalesce(EXCLUDED.fingerprint, publickeyindexer.fingerprint),
+		evm_address = CASE WHEN EXCLUDED.sigalgo = 2
+			THEN coalesce(EXCLUDED.evm_address, publickeyindexer.evm_address) END,
+		updated_at = EXCLUDED.updated_at
+	WHERE EXCLUDED.updated_height = 0
+		OR EXCLUDED.updated_height >= publickeyindexer.updated_height;`
+
+// upsertWithGorm stages the keys with a regular multi-row insert and applies
+// the shared upsert in the same transaction.
+func upsertWithGorm(ctx context.Context, db *gorm.DB, publicKeys []model.PublicKeyAccountIndexer) (int64, error) {
+	fillKeyIdentifiers(publicKeys)
+	var rowsAffected int64
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(createStagingTableSQL).Error; err != nil {
+			return err
+		}
+		if err := tx.Table(stagingTable).Select(publicKeyColumns).CreateInBatches(publicKeys, stagingBatchSize).Error; err != nil {
+			return err
+		}
+		result := tx.Exec(upsertFromStagingSQL)
+		rowsAffected = result.RowsAffected
+		return result.Error
+	})
+	return rowsAffected, err
+}
+
+// stageForCopy prepares the staging table inside a pgx transaction so the
+// caller can COPY rows into it before calling applyStagedUpsert.
+func stageForCopy(ctx context.Context, tx pgx.Tx) error {
+	_, err := tx.Exec(ctx, createStagingTableSQL)
+	return err
+}
+
+// applyStagedUpsert runs the shared upsert for rows staged with COPY.
+func applyStagedUpsert(ctx context.Context, tx pgx.Tx) (int64, error) {
+	cmdTag, err := tx.Exec(ctx, upsertFromStagingSQL)
+	if err != nil {
+		return 0, err
+	}
+	return cmdTag.RowsAffected(), nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/onflow/cadence"
+	"github.com/onflow/flow-go-sdk"
+	"github.com/onflow/flow-go-sdk/access"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// throttledRateDivisor bounds how far ResourceExhausted answers lower the rate
+	throttledRateDivisor = 10
+	// throttleRecovery is how long the rate stays lowered before it is raised a step
+	throttleRecovery = 30 * time.Second
+)
+
+// nodeLimiter is a token bucket for the calls made to one access node, shared
+// by all workers. The node answering ResourceExhausted halves the rate, it
+// recovers step by step once the node stops complaining.
+type nodeLimiter struct {
+	mu          sync.Mutex
+	limiter     *rate.Limiter
+	configured  rate.Limit
+	lastChanged time.Time
+}
+
+func newNodeLimiter(requestsPerSec float64, burst int) *nodeLimiter {
+	limit := rate.Limit(requestsPerSec)
+	if requestsPerSec <= 0 {
+		limit = rate.Inf
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &nodeLimiter{
+		limiter:    rate.NewLimiter(limit, burst),
+		configured: limit,
+	}
+}
+
+// Wait blocks until the node may be called or ctx is done.
+func (l *nodeLimiter) Wait(ctx context.Context) error {
+	l.recover()
+	return l.limiter.Wait(ctx)
+}
+
+// Observe lowers the rate when err tells the node is overloaded.
+func (l *nodeLimiter) Observe(err error) {
+	if status.Code(err) != codes.ResourceExhausted || l.configured == rate.Inf {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// one halving per recovery period, concurrent calls fail together
+	if time.Since(l.lastChanged) < throttleRecovery/2 {
+		return
+	}
+	limit := l.limiter.Limit() / 2
+	if floor := l.configured / throttledRateDivisor; limit < floor {
+		limit = floor
+	}
+	l.limiter.SetLimit(limit)
+	l.lastChanged = time.Now()
+	log.Warn().Msgf("Access node is overloaded, lowering the request rate to %.2f/s", float64(limit))
+}
+
+func (l *nodeLimiter) recover() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	current := l.limiter.Limit()
+	if current >= l.configured || time.Since(l.lastChanged) < throttleRecovery {
+		return
+	}
+	limit := current * 3 / 2
+	if limit > l.configured {
+		limit = l.configured
+	}
+	l.limiter.SetLimit(limit)
+	l.lastChanged = time.Now()
+}
+
+// rateLimitedClient waits on the node limiter before every call the indexer
+// makes to the access node.
+type rateLimitedClient struct {
+	access.Client
+	limiter *nodeLimiter
+}
+
+func newRateLimitedClient(client access.Client, limiter *nodeLimiter) *rateLimitedClient {
+	return &rateLimitedClient{Client: client, limiter: limiter}
+}
+
+func limitCall[T any](ctx context.Context, l *nodeLimiter, call func() (T, error)) (T, error) {
+	if err := l.Wait(ctx); err != nil {
+		var zero T
+		return zero, err
+	}
+	result, err := call()
+	l.Observe(err)
+	return result, err
+}
+
+func (c *rateLimitedClient) GetLatestBlockHeader(ctx context.Context, isSealed bool) (*flow.BlockHeader, error) {
+	return limitCall(ctx, c.limiter, func() (*flow.BlockHeader, error) {
+		return c.Client.GetLatestBlockHeader(ctx, isSealed)
+	})
+}
+
+func (c *rateLimitedClient) GetLatestBlock(ctx context.Context, isSealed bool) (*flow.Block, error) {
+	return limitCall(ctx, c.limiter, func() (*flow.Block, error) {
+		return c.Client.GetLatestBlock(ctx, isSealed)
+	})
+}
+
+func (c *rateLimitedClient) GetAccount(ctx context.Context, address flow.Address) (*flow.Account, error) {
+	return limitCall(ctx, c.limiter, func() (*flow.Account, error) {
+		return c.Client.GetAccount(ctx, address)
+	})
+}
+
+func (c *rateLimitedClient) GetAccountAtBlockHeight(ctx context.Context, address flow.Address, blockHeight uint64) (*flow.Account, error) {
+	return limitCall(ctx, c.limiter, func() (*flow.Account, error) {
+		return c.Client.GetAccountAtBlockHeight(ctx, address, blockHeight)
+	})
+}
+
+func (c *rateLimitedClient) ExecuteScriptAtLatestBlock(ctx context.Context, script []byte, arguments []cadence.Value) (cadence.Value, error) {
+	return limitCall(ctx, c.limiter, func() (cadence.Value, error) {
+		return c.Client.ExecuteScriptAtLatestBlock(ctx, script, arguments)
+	})
+}
+
+func (c *rateLimitedClient) ExecuteScriptAtBlockHeight(ctx context.Context, blockHeight uint64, script []byte, arguments []cadence.Value) (cadence.Value, error) {
+	return limitCall(ctx, c.limiter, func() (cadence.Value, error) {
+		return c.Client.ExecuteScriptAtBlockHeight(ctx, blockHeight, script, arguments)
+	})
+}
+
+func (c *rateLimitedClient) GetEventsForHeightRange(ctx context.Context, eventType string, startHeight uint64, endHeight uint64) ([]flow.BlockEvents, error) {
+	return limitCall(ctx, c.limiter, func() ([]flow.BlockEvents, error) {
+		return c.Client.GetEventsForHeightRange(ctx, eventType, startHeight, endHeight)
+	})
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNodeLimiterBacksOff(t *testing.T) {
+	l := newNodeLimiter(100, 10)
+
+	l.Observe(errors.New("some other failure"))
+	l.Observe(status.Error(codes.Unavailable, "down"))
+	if limit := l.limiter.Limit(); limit != 100 {
+		t.Fatalf("Expected errors other than ResourceExhausted to keep the rate, got %v", limit)
+	}
+
+	l.Observe(status.Error(codes.ResourceExhausted, "rate limited"))
+	if limit := l.limiter.Limit(); limit != 50 {
+		t.Fatalf("Expected the rate to be halved, got %v", limit)
+	}
+
+	// concurrent failures of the same overload halve the rate only once
+	l.Observe(status.Error(codes.ResourceExhausted, "rate limited"))
+	if limit := l.limiter.Limit(); limit != 50 {
+		t.Fatalf("Expected a single halving, got %v", limit)
+	}
+
+	for i := 0; i < 10; i++ {
+		l.lastChanged = time.Time{}
+		l.Observe(status.Error(codes.ResourceExhausted, "rate limited"))
+	}
+	if limit := l.limiter.Limit(); limit != 10 {
+		t.Fatalf("Expected the rate to stop at a tenth, got %v", limit)
+	}
+
+	// once the node recovered the rate steps back up to the configured one
+	for i := 0; i < 10; i++ {
+		l.lastChanged = time.Now().Add(-throttleRecovery)
+		l.recover()
+	}
+	if limit := l.limiter.Limit(); limit != 100 {
+		t.Fatalf("Expected the rate to recover to 100, got %v", limit)
+	}
+}
+
+func TestNodeLimiterUnlimited(t *testing.T) {
+	l := newNodeLimiter(0, 0)
+	l.Observe(status.Error(codes.ResourceExhausted, "rate limited"))
+	if limit := l.limiter.Limit(); limit != rate.Inf {
+		t.Fatalf("Expected no limit, got %v", limit)
+	}
+}
@@ -1,22 +1,39 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"example/flow-key-indexer/model"
+	"example/flow-key-indexer/pkg/config"
 	"example/flow-key-indexer/pkg/pg"
 	"example/flow-key-indexer/utils"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/zerolog/log"
 )
 
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+	// defaultClusterDepth and maxClusterDepth bound the shared keys between
+	// the start of a cluster walk and the accounts it returns
+	defaultClusterDepth = 3
+	maxClusterDepth     = 10
+)
+
 type Rest struct {
-	DB         pg.Store
-	flowClient FlowAdapter
-	config     Params
+	DB pg.Store
+	// flowClient is nil in api mode, the index is served without an access node
+	flowClient *FlowAdapter
+	config     config.Params
 }
 
-func NewRest(DB pg.Store, fa FlowAdapter, p Params) *Rest {
+func NewRest(DB pg.Store, fa *FlowAdapter, p config.Params) *Rest {
 	r := Rest{}
 	r.DB = DB
 	r.flowClient = fa
@@ -27,33 +44,79 @@ func NewRest(DB pg.Store, fa FlowAdapter, p Params) *Rest {
 func (rest *Rest) Start() {
 	// init router
 	r := mux.NewRouter()
-	r.HandleFunc("/key/{id}", rest.getKey).Methods("GET")
-	r.HandleFunc("/key/{id}", rest.getKey).Methods("OPTIONS")
-	r.HandleFunc("/status", rest.getStatus).Methods("GET")
+	r.HandleFunc("/health", rest.getHealth).Methods("GET")
+	r.HandleFunc("/metrics", rest.getMetrics).Methods("GET")
+	if rest.config.ServesAPI() {
+		r.HandleFunc("/key/{id}", rest.getKey).Methods("GET")
+		r.HandleFunc("/key/{id}", rest.getKey).Methods("OPTIONS")
+		r.HandleFunc("/status", rest.getStatus).Methods("GET")
+		r.HandleFunc("/accounts/truncated", rest.getTruncatedAccounts).Methods("GET")
+		r.HandleFunc("/accounts/threshold", rest.getAccountThresholds).Methods("GET")
+		r.HandleFunc("/accounts/{addr}/cluster", rest.getAccountCluster).Methods("GET")
+		if rest.config.ExportToken != "" {
+			r.HandleFunc("/export", rest.getExport).Methods("GET")
+		}
+		r.HandleFunc("/search/keys", rest.searchKeys).Methods("GET")
+		r.HandleFunc("/evm-address/{addr}/accounts", rest.getEVMAddressAccounts).Methods("GET")
+	}
 	// handleRequests()
 	log.Info().Msgf("Serving on PORT %s", rest.config.Port)
 	log.Fatal().Err(http.ListenAndServe(":"+rest.config.Port, r)).Msg("Server at %s crashed!")
 }
 
 func (rest *Rest) getStatus(w http.ResponseWriter, r *http.Request) {
-	block, err := rest.flowClient.GetCurrentBlockHeight()
-	if err != nil {
-		log.Error().Err(err).Msg("Could not get current block height")
-	}
 	stats := rest.DB.Stats()
-	stats.CurrentBlock = int(block)
-	if err != nil {
-		stats.CurrentBlock = -1
+	stats.CurrentBlock = -1
+	if rest.flowClient != nil {
+		block, err := rest.flowClient.GetCurrentBlockHeight()
+		if err != nil {
+			log.Error().Err(err).Msg("Could not get current block height")
+		} else {
+			stats.CurrentBlock = int(block)
+		}
 	}
 	respondWithJSON(w, http.StatusOK, stats)
 }
 
+func (rest *Rest) getHealth(w http.ResponseWriter, r *http.Request) {
+	if err := rest.DB.Ping(r.Context()); err != nil {
+		respondWithError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"status": "ok", "mode": rest.config.Mode})
+}
+
+// indexerMetrics are the gauges reported by /metrics
+type indexerMetrics struct {
+	PublicKeyCount     int   `json:"publicKeyCount"`
+	LoadedToBlock      int   `json:"loadedToBlockHeight"`
+	EventQueueDepth    int64 `json:"eventQueueDepth"`
+	BackfillQueueDepth int64 `json:"backfillQueueDepth"`
+}
+
+func (rest *Rest) getMetrics(w http.ResponseWriter, r *http.Request) {
+	stats := rest.DB.Stats()
+	metrics := indexerMetrics{PublicKeyCount: stats.Count, LoadedToBlock: stats.LoadedToBlock}
+	var err error
+	if metrics.EventQueueDepth, err = rest.DB.QueueDepth(pg.PriorityEvent); err != nil {
+		log.Error().Err(err).Msg("Could not get event queue depth")
+	}
+	if metrics.BackfillQueueDepth, err = rest.DB.QueueDepth(pg.PriorityBackfill); err != nil {
+		log.Error().Err(err).Msg("Could not get backfill queue depth")
+	}
+	respondWithJSON(w, http.StatusOK, metrics)
+}
+
 func (rest *Rest) getKey(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r) // get params
 	publicKey := params["id"]
 	key := utils.Strip0xPrefix(publicKey)
 	value, err := rest.DB.GetAccountsByPublicKey(key)
 
+	if errors.Is(err, pg.ErrInvalidPublicKey) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusNotFound, err.Error())
 		return
@@ -61,6 +124,183 @@ func (rest *Rest) getKey(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, http.StatusOK, value)
 }
 
+func (rest *Rest) getTruncatedAccounts(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := pageParams(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	accounts, err := rest.DB.GetTruncatedAccounts(limit, offset)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, accounts)
+}
+
+func (rest *Rest) getAccountThresholds(w http.ResponseWriter, r *http.Request) {
+	var keys []string
+	for _, v := range r.URL.Query()["keys"] {
+		for _, key := range strings.Split(v, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				keys = append(keys, strings.ToLower(utils.Strip0xPrefix(key)))
+			}
+		}
+	}
+	thresholds, err := rest.DB.GetAccountThresholds(r.Context(), keys)
+	if errors.Is(err, pg.ErrInvalidPublicKey) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, thresholds)
+}
+
+func (rest *Rest) getAccountCluster(w http.ResponseWriter, r *http.Request) {
+	limit, _, err := pageParams(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	depth := defaultClusterDepth
+	if v := r.URL.Query().Get("depth"); v != "" {
+		depth, err = strconv.Atoi(v)
+		if err != nil || depth < 1 || depth > maxClusterDepth {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("invalid depth %q, expected 1 to %d", v, maxClusterDepth))
+			return
+		}
+	}
+	cluster, err := rest.DB.GetAccountCluster(r.Context(), mux.Vars(r)["addr"], depth, limit)
+	if errors.Is(err, pg.ErrInvalidAccount) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, cluster)
+}
+
+func (rest *Rest) getExport(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(rest.config.ExportToken)) != 1 {
+		respondWithError(w, http.StatusUnauthorized, "invalid export token")
+		return
+	}
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = snapshotCSV
+	}
+	contentType, ok := snapshotContentTypes[format]
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("invalid format %q, expected csv, ndjson or parquet", format))
+		return
+	}
+	var filter pg.ExportFilter
+	if v := query.Get("sigAlgo"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("invalid sigAlgo %q", v))
+			return
+		}
+		filter.SigAlgo = n
+	}
+	if v := query.Get("since"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("invalid since %q", v))
+			return
+		}
+		filter.SinceHeight = n
+	}
+
+	started := false
+	count, err := exportSnapshot(r.Context(), rest.DB, rest.config.ChainId, format, filter, w, func(height uint64) {
+		started = true
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"keys-%d.%s\"", height, format))
+		w.Header().Set("X-Snapshot-Height", strconv.FormatUint(height, 10))
+	})
+	if err != nil && !started {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err != nil {
+		// the status is sent, cut the connection so the client sees a broken snapshot
+		log.Error().Err(err).Msgf("Export failed after %d keys", count)
+		panic(http.ErrAbortHandler)
+	}
+	log.Info().Msgf("Exported %d keys", count)
+}
+
+func (rest *Rest) searchKeys(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := pageParams(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	query := r.URL.Query()
+	search := pg.KeySearch{
+		Prefix:      query.Get("prefix"),
+		Suffix:      query.Get("suffix"),
+		Fingerprint: query.Get("fingerprint"),
+	}
+	keys, err := rest.DB.SearchPublicKeys(r.Context(), search, limit, offset)
+	if errors.Is(err, pg.ErrInvalidSearch) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, keys)
+}
+
+func (rest *Rest) getEVMAddressAccounts(w http.ResponseWriter, r *http.Request) {
+	address := strings.ToLower(utils.Add0xPrefix(mux.Vars(r)["addr"]))
+	keys, err := rest.DB.GetKeysByEVMAddress(r.Context(), address)
+	if errors.Is(err, pg.ErrInvalidEVMAddress) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, model.EVMAddressAccounts{EVMAddress: address, Keys: keys})
+}
+
+// pageParams reads the limit and offset query parameters, limit defaults to
+// defaultPageLimit and is capped at maxPageLimit.
+func pageParams(r *http.Request) (int, int, error) {
+	limit, offset := defaultPageLimit, 0
+	query := r.URL.Query()
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return 0, 0, fmt.Errorf("invalid limit %q", v)
+		}
+		limit = n
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("invalid offset %q", v)
+		}
+		offset = n
+	}
+	return limit, offset, nil
+}
+
 func respondWithError(w http.ResponseWriter, code int, message string) {
 	respondWithJSON(w, code, map[string]string{"error": message})
 }
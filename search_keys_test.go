@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"example/flow-key-indexer/model"
+	"example/flow-key-indexer/pkg/pg"
+	"example/flow-key-indexer/utils"
+	"testing"
+)
+
+func TestSearchPublicKeys(t *testing.T) {
+	db := newTestStore(t)
+
+	ctx := context.Background()
+	keys := []model.PublicKeyAccountIndexer{
+		{Account: "0x0000000000000b01", KeyId: 0, PublicKey: "a1b2c3d4e5f60718293a4b5c", Weight: 1000, SigAlgo: 2, HashAlgo: 3},
+		{Account: "0x0000000000000b02", KeyId: 1, PublicKey: "a1b2c3d4e5f60718293a4b5c", Weight: 500, SigAlgo: 2, HashAlgo: 3},
+		{Account: "0x0000000000000b03", KeyId: 0, PublicKey: "a1b2c3d4ffffffff00112233", Weight: 1000, SigAlgo: 3, HashAlgo: 1},
+	}
+	if _, err := savePublicKeys(ctx, db, keys); err != nil {
+		t.Fatalf("Failed to save keys: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		search  pg.KeySearch
+		keys    int
+		invalid bool
+	}{
+		{name: "prefix of both keys", search: pg.KeySearch{Prefix: "0xA1B2C3D4"}, keys: 2},
+		{name: "prefix", search: pg.KeySearch{Prefix: "a1b2c3d4e5"}, keys: 1},
+		{name: "odd prefix", search: pg.KeySearch{Prefix: "a1b2c3d4f"}, keys: 1},
+		{name: "suffix", search: pg.KeySearch{Suffix: "00112233"}, keys: 1},
+		{name: "prefix and suffix", search: pg.KeySearch{Prefix: "a1b2c3d4e5", Suffix: "00112233"}, keys: 0},
+		{name: "fingerprint", search: pg.KeySearch{Fingerprint: fingerprintOf(t, "a1b2c3d4ffffffff00112233")}, keys: 1},
+		{name: "short prefix", search: pg.KeySearch{Prefix: "a1b2c3d"}, invalid: true},
+		{name: "short suffix", search: pg.KeySearch{Suffix: "3a4b5c"}, invalid: true},
+		{name: "short fingerprint", search: pg.KeySearch{Fingerprint: "a1b2"}, invalid: true},
+		{name: "no search", search: pg.KeySearch{}, invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			found, err := db.SearchPublicKeys(ctx, tt.search, 10, 0)
+			if tt.invalid {
+				if !errors.Is(err, pg.ErrInvalidSearch) {
+					t.Errorf("Expected an invalid search, got %v, %v", found, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to search keys: %v", err)
+			}
+			if len(found) != tt.keys {
+				t.Fatalf("Expected %d keys, got %v", tt.keys, found)
+			}
+			for _, key := range found {
+				if key.Fingerprint != fingerprintOf(t, key.PublicKey) {
+					t.Errorf("Expected the fingerprint of %s, got %s", key.PublicKey, key.Fingerprint)
+				}
+			}
+		})
+	}
+
+	found, err := db.SearchPublicKeys(ctx, pg.KeySearch{Prefix: "a1b2c3d4e5"}, 10, 0)
+	if err != nil || len(found) != 1 || len(found[0].Accounts) != 2 {
+		t.Errorf("Expected one key with two accounts, got %v, %v", found, err)
+	}
+}
+
+func fingerprintOf(t *testing.T, publicKey string) string {
+	key, err := utils.DecodeHex(publicKey)
+	if err != nil {
+		t.Fatalf("Invalid key %s", publicKey)
+	}
+	return hex.EncodeToString(utils.KeyFingerprint(key))
+}
+
+func TestGetKeysByEVMAddress(t *testing.T) {
+	db := newTestStore(t)
+
+	ctx := context.Background()
+	// the public key of private key 1 on secp256k1
+	secp256k1Key := "79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798" +
+		"483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b8"
+	keys := []model.PublicKeyAccountIndexer{
+		{Account: "0x0000000000000c01", KeyId: 0, PublicKey: secp256k1Key, Weight: 1000, SigAlgo: 2, HashAlgo: 3},
+		{Account: "0x0000000000000c02", KeyId: 0, PublicKey: "a1b2c3d4e5f60718293a4b5c", Weight: 1000, SigAlgo: 1, HashAlgo: 3},
+	}
+	if _, err := savePublicKeys(ctx, db, keys); err != nil {
+		t.Fatalf("Failed to save keys: %v", err)
+	}
+
+	found, err := db.GetKeysByEVMAddress(ctx, "0x7e5f4552091a69125d5dfcb7b8c2659029395bdf")
+	if err != nil {
+		t.Fatalf("Failed to look up the EVM address: %v", err)
+	}
+	if len(found) != 1 || found[0].PublicKey != secp256k1Key || len(found[0].Accounts) != 1 || found[0].Accounts[0].Account != "0x0000000000000c01" {
+		t.Fatalf("Expected the secp256k1 key of 0x0000000000000c01, got %+v", found)
+	}
+	if found[0].EVMAddress != "0x7e5f4552091a69125d5dfcb7b8c2659029395bdf" {
+		t.Errorf("Unexpected EVM address %s", found[0].EVMAddress)
+	}
+
+	if _, err := db.GetKeysByEVMAddress(ctx, "0x7e5f4552"); !errors.Is(err, pg.ErrInvalidEVMAddress) {
+		t.Errorf("Expected an invalid address error, got %v", err)
+	}
+}
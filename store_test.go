@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/axiomzen/envconfig"
+	"github.com/rs/zerolog/log"
+
+	"example/flow-key-indexer/pkg/config"
+	"example/flow-key-indexer/pkg/pg"
+)
+
+// newTestStore starts a store on the database configured by the KEYIDX_
+// variables, the test is skipped when no database host is set.
+func newTestStore(t *testing.T) *pg.Store {
+	t.Helper()
+	if os.Getenv(config.EnvPrefix+"_POSTGRESQLHOST") == "" {
+		t.Skipf("%s_POSTGRESQLHOST is not set, skipping the database test", config.EnvPrefix)
+	}
+	var p config.Params
+	if err := envconfig.Process(config.EnvPrefix, &p); err != nil {
+		t.Fatalf("Failed to read the configuration: %v", err)
+	}
+	db := pg.NewStore(p.PostgresConfig(), log.Logger)
+	if err := db.Start(true); err != nil {
+		t.Fatalf("Failed to start database: %v", err)
+	}
+	return db
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"example/flow-key-indexer/model"
+
+	"github.com/onflow/flow-go-sdk"
+	"github.com/rs/zerolog/log"
+)
+
+// truncatedBatchSize is the number of pending truncated accounts picked up per round
+const truncatedBatchSize = 100
+
+// loadTruncatedAccounts pages through the remaining keys of accounts that were
+// cut short by MaxAcctKeys, TruncatedKeysPageSize keys per script call. A
+// round in which every account failed is followed by a pause, so accounts
+// that keep failing are not fetched again in a tight loop.
+func (a *App) loadTruncatedAccounts(ctx context.Context) {
+	pause := time.Duration(a.p.SyncDataPolIntervalMin) * time.Minute
+
+	for ctx.Err() == nil {
+		accounts, err := a.DB.GetPendingTruncatedAccounts(truncatedBatchSize)
+		if err != nil {
+			log.Error().Err(err).Msg("Truncated Could not get pending truncated accounts")
+		}
+		failed := 0
+		for _, account := range accounts {
+			if err := a.loadTruncatedAccount(ctx, account); err != nil {
+				failed++
+				log.Error().Err(err).Msgf("Truncated Failed to load remaining keys of %s", account.Address)
+				if err := a.DB.FailTruncatedAccount(ctx, account.Address, err); err != nil {
+					log.Error().Err(err).Msgf("Truncated Could not record the failure of %s", account.Address)
+				}
+			}
+		}
+
+		if len(accounts) > 0 && err == nil && failed < len(accounts) {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pause):
+		}
+	}
+}
+
+// loadTruncatedAccount stores the keys of one account from its next key index
+// on, recording progress after every page so a restart resumes where it stopped.
+func (a *App) loadTruncatedAccount(ctx context.Context, account model.TruncatedAccount) error {
+	address := flow.HexToAddress(account.Address)
+	pageSize := a.p.TruncatedKeysPageSize
+	next := account.NextKeyIndex
+	keyCount := account.KeyCount
+	height := account.DetectedHeight
+
+	for next < keyCount {
+		result, err := ProcessAddressKeyRange(ctx, a.p, address, next, next+pageSize, log.Logger, a.flowClient.Client)
+		if err != nil {
+			return err
+		}
+		if len(result.Keys) > 0 {
+			if _, err := savePublicKeys(ctx, a.DB, result.Keys); err != nil {
+				return err
+			}
+		}
+
+		page, ok := result.Accounts[address]
+		if !ok || page.NextKeyIndex <= next {
+			// the account has fewer keys than when it was detected
+			break
+		}
+		next = page.NextKeyIndex
+		keyCount = page.KeyCount
+		height = result.Height
+
+		if next < keyCount {
+			if err := a.DB.UpdateTruncatedProgress(ctx, account.Address, next, false); err != nil {
+				return err
+			}
+			log.Debug().Msgf("Truncated Loaded keys %d of %d for %s", next, keyCount, account.Address)
+		}
+	}
+
+	if err := a.DB.UpdateTruncatedProgress(ctx, account.Address, next, true); err != nil {
+		return err
+	}
+	recordAccounts(ctx, a.DB, []model.AccountRecord{{
+		Address:             account.Address,
+		Status:              model.AccountStatusOK,
+		KeyCount:            keyCount,
+		LastRefreshedHeight: height,
+	}})
+	log.Info().Msgf("Truncated Loaded all %d keys of %s", keyCount, account.Address)
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"example/flow-key-indexer/model"
+)
+
+func TestUpsertPublicKeyAccounts(t *testing.T) {
+	db := newTestStore(t)
+
+	ctx := context.Background()
+
+	// both write paths must go through the same upsert
+	paths := []struct {
+		name   string
+		insert func([]model.PublicKeyAccountIndexer) error
+	}{
+		{
+			name: "gorm",
+			insert: func(keys []model.PublicKeyAccountIndexer) error {
+				return db.InsertPublicKeyAccounts(ctx, keys)
+			},
+		},
+		{
+			name: "copy",
+			insert: func(keys []model.PublicKeyAccountIndexer) error {
+				_, err := savePublicKeys(ctx, db, keys)
+				return err
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		initial  model.PublicKeyAccountIndexer
+		updates  []model.PublicKeyAccountIndexer
+		expected model.PublicKeyAccountIndexer
+	}{
+		{
+			name:     "weight change",
+			initial:  model.PublicKeyAccountIndexer{Weight: 1000, SigAlgo: 1, HashAlgo: 3, UpdatedHeight: 10},
+			updates:  []model.PublicKeyAccountIndexer{{Weight: 500, SigAlgo: 1, HashAlgo: 3, UpdatedHeight: 20}},
+			expected: model.PublicKeyAccountIndexer{Weight: 500, SigAlgo: 1, HashAlgo: 3, UpdatedHeight: 20},
+		},
+		{
+			name:     "revoked",
+			initial:  model.PublicKeyAccountIndexer{Weight: 1000, SigAlgo: 2, HashAlgo: 1, UpdatedHeight: 10},
+			updates:  []model.PublicKeyAccountIndexer{{Weight: 1000, SigAlgo: 2, HashAlgo: 1, IsRevoked: true, UpdatedHeight: 20}},
+			expected: model.PublicKeyAccountIndexer{Weight: 1000, SigAlgo: 2, HashAlgo: 1, IsRevoked: true, UpdatedHeight: 20},
+		},
+		{
+			name:     "algorithms filled in",
+			initial:  model.PublicKeyAccountIndexer{Weight: 1000},
+			updates:  []model.PublicKeyAccountIndexer{{Weight: 1000, SigAlgo: 1, HashAlgo: 1, UpdatedHeight: 5}},
+			expected: model.PublicKeyAccountIndexer{Weight: 1000, SigAlgo: 1, HashAlgo: 1, UpdatedHeight: 5},
+		},
+		{
+			name:     "height never moves backwards",
+			initial:  model.PublicKeyAccountIndexer{Weight: 1000, SigAlgo: 1, HashAlgo: 3, UpdatedHeight: 30},
+			updates:  []model.PublicKeyAccountIndexer{{Weight: 750, SigAlgo: 1, HashAlgo: 3}},
+			expected: model.PublicKeyAccountIndexer{Weight: 750, SigAlgo: 1, HashAlgo: 3, UpdatedHeight: 30},
+		},
+		{
+			name:     "older height does not overwrite",
+			initial:  model.PublicKeyAccountIndexer{Weight: 1000, SigAlgo: 1, HashAlgo: 3, UpdatedHeight: 30},
+			updates:  []model.PublicKeyAccountIndexer{{Weight: 0, SigAlgo: 1, HashAlgo: 3, IsRevoked: true, UpdatedHeight: 20}},
+			expected: model.PublicKeyAccountIndexer{Weight: 1000, SigAlgo: 1, HashAlgo: 3, UpdatedHeight: 30},
+		},
+		{
+			name:    "duplicates in one batch",
+			initial: model.PublicKeyAccountIndexer{Weight: 1000, SigAlgo: 1, HashAlgo: 3, UpdatedHeight: 10},
+			updates: []model.PublicKeyAccountIndexer{
+				{Weight: 100, SigAlgo: 1, HashAlgo: 3, UpdatedHeight: 11},
+				{Weight: 200, SigAlgo: 1, HashAlgo: 3, UpdatedHeight: 12},
+			},
+			expected: model.PublicKeyAccountIndexer{Weight: 200, SigAlgo: 1, HashAlgo: 3, UpdatedHeight: 12},
+		},
+	}
+
+	for pathIndex, path := range paths {
+		for i, tt := range tests {
+			t.Run(path.name+"/"+tt.name, func(t *testing.T) {
+				// accounts and keys are stored as bytes, so they have to be hex
+				account := fmt.Sprintf("0x%016x", pathIndex*len(tests)+i+100)
+				publicKey := fmt.Sprintf("0b%04x", pathIndex*len(tests)+i)
+
+				withIdentity := func(k model.PublicKeyAccountIndexer) model.PublicKeyAccountIndexer {
+					k.Account = account
+					k.PublicKey = publicKey
+					k.KeyId = 0
+					return k
+				}
+
+				if err := path.insert([]model.PublicKeyAccountIndexer{withIdentity(tt.initial)}); err != nil {
+					t.Fatalf("Failed to insert initial key: %v", err)
+				}
+				updates := make([]model.PublicKeyAccountIndexer, len(tt.updates))
+				for j, u := range tt.updates {
+					updates[j] = withIdentity(u)
+				}
+				if err := path.insert(updates); err != nil {
+					t.Fatalf("Failed to upsert keys: %v", err)
+				}
+
+				rows, err := db.GetPublicKeysByAccount(account)
+				if err != nil {
+					t.Fatalf("Failed to get keys for %s: %v", account, err)
+				}
+				if len(rows) != 1 {
+					t.Fatalf("Expected 1 row for %s, got %d", account, len(rows))
+				}
+
+				got := rows[0]
+				if got.Weight != tt.expected.Weight ||
+					got.SigAlgo != tt.expected.SigAlgo ||
+					got.HashAlgo != tt.expected.HashAlgo ||
+					got.IsRevoked != tt.expected.IsRevoked ||
+					got.UpdatedHeight != tt.expected.UpdatedHeight {
+					t.Errorf("Unexpected row after upsert: got %+v, expected %+v", got, tt.expected)
+				}
+				if got.UpdatedAt.IsZero() {
+					t.Errorf("Expected updated_at to be set")
+				}
+			})
+		}
+	}
+}
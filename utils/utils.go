@@ -1,6 +1,18 @@
 package utils
 
-import "strings"
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// FingerprintLength is the number of bytes of a key fingerprint
+const FingerprintLength = 16
+
+// EVMAddressLength is the number of bytes of an EVM address
+const EVMAddressLength = 20
 
 func Strip0xPrefix(str string) string {
 	if strings.HasPrefix(str, "0x") {
@@ -29,3 +41,83 @@ func FixAccountLength(account string) string {
 
 	return Add0xPrefix(stripped)
 }
+
+// DecodeHex decodes a hex string with or without 0x prefix.
+func DecodeHex(s string) ([]byte, error) {
+	return hex.DecodeString(Strip0xPrefix(s))
+}
+
+// AccountToBytes converts a Flow address, with or without 0x prefix and
+// leading zeros, into its 8 bytes.
+func AccountToBytes(account string) ([]byte, error) {
+	stripped := Strip0xPrefix(account)
+	if len(stripped) == 0 || len(stripped) > 16 {
+		return nil, fmt.Errorf("invalid account address %q", account)
+	}
+	for len(stripped) < 16 {
+		stripped = "0" + stripped
+	}
+	return hex.DecodeString(stripped)
+}
+
+// KeyFingerprint is a short stable identifier of a public key, the first
+// FingerprintLength bytes of the SHA3-256 of the raw key.
+func KeyFingerprint(publicKey []byte) []byte {
+	sum := sha3.Sum256(publicKey)
+	return sum[:FingerprintLength]
+}
+
+// EVMAddress derives the Ethereum style address of a secp256k1 public key,
+// the last 20 bytes of the Keccak-256 of the 64 byte uncompressed key. Flow
+// stores keys without the 0x04 prefix of the uncompressed encoding, a key
+// with the prefix is accepted as well.
+func EVMAddress(publicKey []byte) ([]byte, error) {
+	if len(publicKey) == 65 && publicKey[0] == 0x04 {
+		publicKey = publicKey[1:]
+	}
+	if len(publicKey) != 64 {
+		return nil, fmt.Errorf("expected a 64 byte secp256k1 public key, got %d bytes", len(publicKey))
+	}
+	hash := sha3.NewLegacyKeccak256()
+	hash.Write(publicKey)
+	return hash.Sum(nil)[32-EVMAddressLength:], nil
+}
+
+// HexPrefixRange returns the byte range of the values whose hex encoding
+// starts with prefix: lower <= value < upper. An odd prefix ends in half a
+// byte, upper is nil when the range has no upper bound.
+func HexPrefixRange(prefix string) ([]byte, []byte, error) {
+	prefix = strings.ToLower(Strip0xPrefix(prefix))
+	if prefix == "" {
+		return nil, nil, fmt.Errorf("empty hex prefix")
+	}
+	lower, err := hex.DecodeString(padNibble(prefix))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the next prefix of the same length, nil once all digits were f
+	next := []byte(prefix)
+	i := len(next) - 1
+	for ; i >= 0 && next[i] == 'f'; i-- {
+		next[i] = '0'
+	}
+	if i < 0 {
+		return lower, nil, nil
+	}
+	switch next[i] {
+	case '9':
+		next[i] = 'a'
+	default:
+		next[i]++
+	}
+	upper, err := hex.DecodeString(padNibble(string(next)))
+	return lower, upper, err
+}
+
+func padNibble(s string) string {
+	if len(s)%2 == 1 {
+		return s + "0"
+	}
+	return s
+}
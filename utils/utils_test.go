@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"encoding/hex"
 	"testing"
 )
 
@@ -92,3 +93,112 @@ func TestFixAccountLength(t *testing.T) {
 		})
 	}
 }
+
+func TestAccountToBytes(t *testing.T) {
+	tests := []struct {
+		account  string
+		expected string
+		valid    bool
+	}{
+		{account: "0x2dbe0975051f24", expected: "002dbe0975051f24", valid: true},
+		{account: "002dbe0975051f24", expected: "002dbe0975051f24", valid: true},
+		{account: "0x137ecb679d3981a8", expected: "137ecb679d3981a8", valid: true},
+		{account: "0x1", expected: "0000000000000001", valid: true},
+		{account: "0x0137ecb679d3981a8", valid: false},
+		{account: "0x", valid: false},
+		{account: "Account1", valid: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.account, func(t *testing.T) {
+			result, err := AccountToBytes(tt.account)
+			if !tt.valid {
+				if err == nil {
+					t.Errorf("Expected an error for %s, got %x", tt.account, result)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error for %s: %v", tt.account, err)
+			}
+			if hex.EncodeToString(result) != tt.expected {
+				t.Errorf("Expected %s, got %x", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestDecodeHex(t *testing.T) {
+	result, err := DecodeHex("0xA1b2")
+	if err != nil || hex.EncodeToString(result) != "a1b2" {
+		t.Errorf("Expected a1b2, got %x, %v", result, err)
+	}
+	if _, err := DecodeHex("blank"); err == nil {
+		t.Errorf("Expected an error for a non hex string")
+	}
+}
+
+func TestKeyFingerprint(t *testing.T) {
+	key, _ := DecodeHex("0xa1b2c3")
+	fingerprint := KeyFingerprint(key)
+	if len(fingerprint) != FingerprintLength {
+		t.Fatalf("Expected %d bytes, got %d", FingerprintLength, len(fingerprint))
+	}
+	// first 16 bytes of SHA3-256(a1b2c3)
+	if got := hex.EncodeToString(fingerprint); got != "13a233555fce9b2052fc5f8ff54353ce" {
+		t.Errorf("Unexpected fingerprint %s", got)
+	}
+	other, _ := DecodeHex("a1b2c4")
+	if hex.EncodeToString(KeyFingerprint(other)) == hex.EncodeToString(fingerprint) {
+		t.Errorf("Expected different keys to have different fingerprints")
+	}
+}
+
+func TestHexPrefixRange(t *testing.T) {
+	tests := []struct {
+		prefix string
+		lower  string
+		upper  string
+	}{
+		{prefix: "a1b2", lower: "a1b2", upper: "a1b3"},
+		{prefix: "0xA1B", lower: "a1b0", upper: "a1c0"},
+		{prefix: "a19f", lower: "a19f", upper: "a1a0"},
+		{prefix: "ff", lower: "ff", upper: ""},
+		{prefix: "1ff", lower: "1ff0", upper: "2000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			lower, upper, err := HexPrefixRange(tt.prefix)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if hex.EncodeToString(lower) != tt.lower || hex.EncodeToString(upper) != tt.upper {
+				t.Errorf("Expected [%s, %s), got [%x, %x)", tt.lower, tt.upper, lower, upper)
+			}
+		})
+	}
+
+	if _, _, err := HexPrefixRange("a1g2"); err == nil {
+		t.Errorf("Expected an error for a non hex prefix")
+	}
+}
+
+func TestEVMAddress(t *testing.T) {
+	// the public key of private key 1, the generator point of secp256k1
+	key, _ := DecodeHex("79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798" +
+		"483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b8")
+	address, err := EVMAddress(key)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got := hex.EncodeToString(address); got != "7e5f4552091a69125d5dfcb7b8c2659029395bdf" {
+		t.Errorf("Unexpected address %s", got)
+	}
+
+	prefixed, err := EVMAddress(append([]byte{0x04}, key...))
+	if err != nil || hex.EncodeToString(prefixed) != hex.EncodeToString(address) {
+		t.Errorf("Expected the 0x04 prefix to be ignored, got %x, %v", prefixed, err)
+	}
+	if _, err := EVMAddress(key[:33]); err == nil {
+		t.Errorf("Expected an error for a compressed key")
+	}
+}